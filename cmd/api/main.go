@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
@@ -12,7 +15,8 @@ import (
 	"github.com/qs-lzh/movie-reservation/internal/app"
 	"github.com/qs-lzh/movie-reservation/internal/cache"
 	"github.com/qs-lzh/movie-reservation/internal/model"
-	"github.com/qs-lzh/movie-reservation/internal/security"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+	"github.com/qs-lzh/movie-reservation/internal/service"
 )
 
 func main() {
@@ -21,13 +25,11 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	security.InitJWT(cfg.JWTSecretKey)
-
 	db, err := gorm.Open(postgres.Open(cfg.DatabaseDSN), &gorm.Config{})
 	if err != nil {
 		log.Fatalf("Failed to open gorm.DB: %v", err)
 	}
-	initDB(db)
+	initDB(db, cfg.ShowtimeCleaningBuffer)
 
 	cache := cache.NewRedisCache(cfg.CacheURL)
 
@@ -42,6 +44,23 @@ func main() {
 	app := app.New(cfg, db, cache, logger)
 	defer app.Close()
 
+	// the API can't issue tokens before a signing key is loaded
+	if err := app.KeyService.RotateKeys(); err != nil {
+		app.Logger.Fatal("Failed to load signing keys", zap.Error(err))
+	}
+
+	// the permission checks need the built-in roles
+	if err := app.RoleService.SeedRoles(); err != nil {
+		app.Logger.Fatal("Failed to seed roles", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.StartHoldSweeper(ctx)
+	app.StartNotificationWorker(ctx)
+	app.StartWebhookWorker(ctx)
+	app.StartKeyRotation(ctx)
+
 	router := web.InitRouter(app)
 
 	if err := router.RunTLS(cfg.Addr, cfg.CertPath, cfg.KeyPath); err != nil {
@@ -52,14 +71,80 @@ func main() {
 	}
 }
 
-func initDB(db *gorm.DB) {
-	db.Migrator().AutoMigrate(
+// initDB migrates the schema, cleaningBuffer is the one of config.Config used to schedule the showtimes
+func initDB(db *gorm.DB, cleaningBuffer time.Duration) {
+	// the ticket index used to cover cancelled reservations too, it is replaced by idx_active_ticket
+	if db.Migrator().HasIndex(&model.Reservation{}, "idx_unique_ticket") {
+		if err := db.Migrator().DropIndex(&model.Reservation{}, "idx_unique_ticket"); err != nil {
+			log.Fatalf("Failed to drop the index idx_unique_ticket: %v", err)
+		}
+	}
+	if db.Migrator().HasIndex(&model.Seat{}, "idx_seats_label") {
+		if err := db.Migrator().DropIndex(&model.Seat{}, "idx_seats_label"); err != nil {
+			log.Fatalf("Failed to drop the index idx_seats_label: %v", err)
+		}
+	}
+	if err := labelSeats(db); err != nil {
+		log.Fatalf("Failed to label the seats: %v", err)
+	}
+	if err := db.Migrator().AutoMigrate(
 		&model.User{},
+		&model.Role{},
 		&model.Movie{},
 		&model.Showtime{},
 		&model.Reservation{},
 		&model.Hall{},
 		&model.Seat{},
 		&model.ShowtimeSeat{},
-	)
+		&model.SeatClassPrice{},
+		&model.Order{},
+		&model.PaymentEvent{},
+		&model.Refund{},
+		&model.WaitlistEntry{},
+		&model.OutboxMessage{},
+		&model.InboxMessage{},
+		&model.WebhookEndpoint{},
+		&model.WebhookDelivery{},
+		&model.SigningKey{},
+		&model.APIKey{},
+	); err != nil {
+		log.Fatalf("Failed to migrate the database: %v", err)
+	}
+	// showtimes scheduled before EndAt existed occupy their hall like the new ones, an end equal to the start
+	// was set by an earlier backfill which let new showtimes overlap them
+	if err := db.Exec(`UPDATE showtimes SET end_at = showtimes.start_at + make_interval(mins => movies.runtime_minutes, secs => ?)
+		FROM movies WHERE movies.id = showtimes.movie_id AND (showtimes.end_at IS NULL OR showtimes.end_at = showtimes.start_at)`,
+		cleaningBuffer.Seconds()).Error; err != nil {
+		log.Fatalf("Failed to backfill the end of the showtimes: %v", err)
+	}
+}
+
+// labelSeats labels the seats created before labels existed, before the labels become unique in their hall
+func labelSeats(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&model.Seat{}) {
+		return nil
+	}
+	if err := db.Migrator().AutoMigrate(&model.Hall{}); err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&model.Seat{}, "Label") {
+		if err := db.Migrator().AddColumn(&model.Seat{}, "Label"); err != nil {
+			return err
+		}
+	}
+
+	var halls []model.Hall
+	unlabelled := db.Model(&model.Seat{}).Select("hall_id").Where("label IS NULL OR label = ''")
+	if err := db.Where("id IN (?)", unlabelled).Find(&halls).Error; err != nil {
+		return err
+	}
+	seatService := service.NewseatService(db, repository.NewSeatRepoGorm(db))
+	for i := range halls {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return seatService.RelabelSeatsForHallTx(tx, &halls[i])
+		}); err != nil {
+			return fmt.Errorf("hall %d: %w", halls[i].ID, err)
+		}
+	}
+	return nil
 }
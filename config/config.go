@@ -1,7 +1,13 @@
 package config
 
 import (
+	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/qs-lzh/movie-reservation/internal/util"
 )
@@ -9,31 +15,316 @@ import (
 type Config struct {
 	DatabaseDSN       string
 	Addr              string
-	JWTSecretKey      string
 	CertPath          string
 	KeyPath           string
 	CacheURL          string
 	AdminRolePassword string
+	// AccessTokenTTL is how long an access token is valid, a client refreshes it with its refresh token
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a session survives without being refreshed
+	RefreshTokenTTL time.Duration
+	// CookieSameSite and CookieSecure apply to the auth and CSRF cookies, SameSite None requires Secure
+	CookieSameSite http.SameSite
+	CookieSecure   bool
+	// JWTSigningAlgorithm is RS256 or EdDSA, it applies to the keys created from then on
+	JWTSigningAlgorithm string
+	// JWTKeyRotationInterval is how long a signing key signs before it is replaced
+	JWTKeyRotationInterval time.Duration
+	// JWTKeyGracePeriod is how long a replaced key still verifies, it must outlast AccessTokenTTL
+	JWTKeyGracePeriod time.Duration
+	// JWTKeyRefreshInterval is how often every instance reloads the signing keys and rotates them when due
+	JWTKeyRefreshInterval time.Duration
+	// SeatHoldTTL is how long a reserved seat stays locked before it must be confirmed
+	SeatHoldTTL time.Duration
+	// HoldSweepInterval is how often expired seat holds are returned to available
+	HoldSweepInterval time.Duration
+	// MaxSeatsPerUser caps how many seats one user can reserve for a single showtime
+	MaxSeatsPerUser int
+	// PaymentWebhookSecret signs the webhooks sent by the payment provider
+	PaymentWebhookSecret string
+	// ShowtimeCleaningBuffer is added after the movie runtime before the hall can host the next showtime
+	ShowtimeCleaningBuffer time.Duration
+	// WaitlistOfferTTL is how long seats offered to a waitlisted user stay held for them
+	WaitlistOfferTTL time.Duration
+	// SMTPAddr ("host:port") enables the email notifications, SMTPUsername is only needed by servers requiring auth
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+	// NotifyWebhookURL enables the webhook notifications
+	NotifyWebhookURL string
+	// NotifyPollInterval is how often the outbox is drained
+	NotifyPollInterval time.Duration
+	// NotifyMaxAttempts is how many times a notification is tried before it is given up
+	NotifyMaxAttempts int
+	// NotifyRetryBackoff is the delay before the first retry, it doubles after every failure
+	NotifyRetryBackoff time.Duration
+	// WebhookPollInterval is how often the due partner webhook deliveries are sent
+	WebhookPollInterval time.Duration
+	// WebhookMaxAttempts is how many times a webhook delivery is tried before it is given up
+	WebhookMaxAttempts int
+	// WebhookRetryBackoff is the delay before the first retry of a delivery, it doubles after every failure
+	WebhookRetryBackoff time.Duration
+	// WebhookDisableAfter is how many failed attempts in a row disable a webhook endpoint
+	WebhookDisableAfter int
+	// CancellationPolicy is ordered from the earliest tier to the latest one
+	CancellationPolicy []RefundTier
 }
 
+// RefundTier refunds Percent of the price when a reservation is cancelled
+// at least Before the showtime starts
+type RefundTier struct {
+	Before  time.Duration
+	Percent int
+}
+
+// the default policy: full refund until 24h before the showtime, 50% until 2h, none after
+const defaultCancellationPolicy = "24h:100,2h:50"
+
 func LoadConfig() (*Config, error) {
 	if err := util.LoadEnv(); err != nil {
 		return nil, err
 	}
 	databaseDSN := os.Getenv("DATABASE_DSN")
 	addr := os.Getenv("ADDR")
-	jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
 	crtPath := os.Getenv("CERT_PATH")
 	keyPath := os.Getenv("KEY_PATH")
 	cacheURL := os.Getenv("CACHE_URL")
 	adminRolePassword := os.Getenv("ADMIN_ROLE_PASSWORD")
+	paymentWebhookSecret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	// anyone could sign the payment webhooks with an empty secret
+	if paymentWebhookSecret == "" {
+		return nil, fmt.Errorf("PAYMENT_WEBHOOK_SECRET is required")
+	}
+	accessTokenTTL, err := durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	refreshTokenTTL, err := durationFromEnv("REFRESH_TOKEN_TTL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cookieSameSite, err := sameSiteFromEnv("COOKIE_SAMESITE", http.SameSiteLaxMode)
+	if err != nil {
+		return nil, err
+	}
+	cookieSecure, err := boolFromEnv("COOKIE_SECURE", false)
+	if err != nil {
+		return nil, err
+	}
+	if cookieSameSite == http.SameSiteNoneMode && !cookieSecure {
+		return nil, fmt.Errorf("invalid COOKIE_SAMESITE: none requires COOKIE_SECURE")
+	}
+	jwtSigningAlgorithm := os.Getenv("JWT_SIGNING_ALG")
+	switch jwtSigningAlgorithm {
+	case "":
+		jwtSigningAlgorithm = "RS256"
+	case "RS256", "EdDSA":
+	default:
+		return nil, fmt.Errorf("invalid JWT_SIGNING_ALG: must be RS256 or EdDSA")
+	}
+	jwtKeyRotationInterval, err := durationFromEnv("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	jwtKeyGracePeriod, err := durationFromEnv("JWT_KEY_GRACE_PERIOD", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if jwtKeyGracePeriod < accessTokenTTL {
+		return nil, fmt.Errorf("invalid JWT_KEY_GRACE_PERIOD: must not be shorter than ACCESS_TOKEN_TTL")
+	}
+	jwtKeyRefreshInterval, err := durationFromEnv("JWT_KEY_REFRESH_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	seatHoldTTL, err := durationFromEnv("SEAT_HOLD_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	holdSweepInterval, err := durationFromEnv("HOLD_SWEEP_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	maxSeatsPerUser, err := intFromEnv("MAX_SEATS_PER_USER", 6)
+	if err != nil {
+		return nil, err
+	}
+	waitlistOfferTTL, err := durationFromEnv("WAITLIST_OFFER_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	showtimeCleaningBuffer, err := durationFromEnv("SHOWTIME_CLEANING_BUFFER", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	notifyPollInterval, err := durationFromEnv("NOTIFY_POLL_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	notifyMaxAttempts, err := intFromEnv("NOTIFY_MAX_ATTEMPTS", 8)
+	if err != nil {
+		return nil, err
+	}
+	notifyRetryBackoff, err := durationFromEnv("NOTIFY_RETRY_BACKOFF", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	webhookPollInterval, err := durationFromEnv("WEBHOOK_POLL_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	webhookMaxAttempts, err := intFromEnv("WEBHOOK_MAX_ATTEMPTS", 10)
+	if err != nil {
+		return nil, err
+	}
+	webhookRetryBackoff, err := durationFromEnv("WEBHOOK_RETRY_BACKOFF", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	webhookDisableAfter, err := intFromEnv("WEBHOOK_DISABLE_AFTER", 20)
+	if err != nil {
+		return nil, err
+	}
+	cancellationPolicy, err := cancellationPolicyFromEnv("CANCELLATION_POLICY", defaultCancellationPolicy)
+	if err != nil {
+		return nil, err
+	}
 	return &Config{
 		DatabaseDSN:       databaseDSN,
 		Addr:              addr,
-		JWTSecretKey:      jwtSecretKey,
 		CertPath:          crtPath,
 		KeyPath:           keyPath,
 		CacheURL:          cacheURL,
 		AdminRolePassword: adminRolePassword,
+		AccessTokenTTL:    accessTokenTTL,
+		RefreshTokenTTL:   refreshTokenTTL,
+		SeatHoldTTL:       seatHoldTTL,
+		HoldSweepInterval: holdSweepInterval,
+		MaxSeatsPerUser:   maxSeatsPerUser,
+		WaitlistOfferTTL:  waitlistOfferTTL,
+
+		CookieSameSite: cookieSameSite,
+		CookieSecure:   cookieSecure,
+
+		JWTSigningAlgorithm:    jwtSigningAlgorithm,
+		JWTKeyRotationInterval: jwtKeyRotationInterval,
+		JWTKeyGracePeriod:      jwtKeyGracePeriod,
+		JWTKeyRefreshInterval:  jwtKeyRefreshInterval,
+
+		PaymentWebhookSecret: paymentWebhookSecret,
+		CancellationPolicy:   cancellationPolicy,
+
+		ShowtimeCleaningBuffer: showtimeCleaningBuffer,
+
+		SMTPAddr:           os.Getenv("SMTP_ADDR"),
+		SMTPFrom:           os.Getenv("SMTP_FROM"),
+		SMTPUsername:       os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:       os.Getenv("SMTP_PASSWORD"),
+		NotifyWebhookURL:   os.Getenv("NOTIFY_WEBHOOK_URL"),
+		NotifyPollInterval: notifyPollInterval,
+		NotifyMaxAttempts:  notifyMaxAttempts,
+		NotifyRetryBackoff: notifyRetryBackoff,
+
+		WebhookPollInterval: webhookPollInterval,
+		WebhookMaxAttempts:  webhookMaxAttempts,
+		WebhookRetryBackoff: webhookRetryBackoff,
+		WebhookDisableAfter: webhookDisableAfter,
 	}, nil
 }
+
+// durationFromEnv parses the env var as a time.Duration (e.g. "10m"), falling back when it is unset
+func durationFromEnv(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+	return d, nil
+}
+
+// intFromEnv parses the env var as a positive int, falling back when it is unset
+func intFromEnv(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+	return n, nil
+}
+
+// boolFromEnv parses the env var as a bool (e.g. "true", "1"), falling back when it is unset
+func boolFromEnv(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// sameSiteFromEnv parses the env var as "lax", "strict" or "none", falling back when it is unset
+func sameSiteFromEnv(key string, fallback http.SameSite) (http.SameSite, error) {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "":
+		return fallback, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid %s: must be lax, strict or none", key)
+	}
+}
+
+// cancellationPolicyFromEnv parses the env var as comma separated "before:percent" tiers (e.g. "24h:100,2h:50"),
+// falling back when it is unset
+func cancellationPolicyFromEnv(key string, fallback string) ([]RefundTier, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fallback
+	}
+	var tiers []RefundTier
+	for _, part := range strings.Split(value, ",") {
+		before, percent, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: tier %q is not before:percent", key, part)
+		}
+		d, err := time.ParseDuration(before)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid %s: duration must not be negative", key)
+		}
+		p, err := strconv.Atoi(percent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid %s: percent must be between 0 and 100", key)
+		}
+		tiers = append(tiers, RefundTier{Before: d, Percent: p})
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].Before > tiers[j].Before
+	})
+	return tiers, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/qs-lzh/movie-reservation/internal/app"
 	"github.com/qs-lzh/movie-reservation/internal/handler"
 	"github.com/qs-lzh/movie-reservation/internal/middleware"
+	"github.com/qs-lzh/movie-reservation/internal/model"
 )
 
 func InitRouter(app *app.App) *gin.Engine {
@@ -15,6 +16,13 @@ func InitRouter(app *app.App) *gin.Engine {
 	reservationHandler := handler.NewReservationHandler(app)
 	hallHandler := handler.NewHallHandler(app)
 	captchaHandler := handler.NewCaptchaHandler(app)
+	orderHandler := handler.NewOrderHandler(app)
+	paymentHandler := handler.NewPaymentHandler(app)
+	inboxHandler := handler.NewInboxHandler(app)
+	webhookHandler := handler.NewWebhookHandler(app)
+	jwksHandler := handler.NewJWKSHandler(app)
+	apiKeyHandler := handler.NewAPIKeyHandler(app)
+	roleHandler := handler.NewRoleHandler(app)
 
 	r := gin.New()
 
@@ -22,8 +30,12 @@ func InitRouter(app *app.App) *gin.Engine {
 	r.Use(
 		middleware.ZapLogger(app.Logger),
 		middleware.ErrorLogger(app.Logger),
+		middleware.RequireCSRF(),
 	)
 
+	// [Other services] the public keys verifying our access tokens
+	r.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
 	r.GET("/captcha", captchaHandler.GenerateCaptcha)
 	r.POST("/captcha", captchaHandler.VerifyCaptcha)
 
@@ -33,6 +45,27 @@ func InitRouter(app *app.App) *gin.Engine {
 		users.POST("/register", authHandler.Register)
 		users.POST("/login", authHandler.Login)
 		users.POST("/logout", authHandler.Logout)
+		users.POST("/refresh", authHandler.Refresh)
+		users.POST("/logout-all", middleware.RequireAuth(app.AuthService), authHandler.LogoutAll)
+		// [User]
+		users.GET("/me/inbox", middleware.RequireAuth(app.AuthService, "inbox"), inboxHandler.GetMyInbox)
+		users.POST("/me/inbox/:id/read", middleware.RequireAuth(app.AuthService, "inbox"), inboxHandler.MarkInboxMessageRead)
+		users.POST("/me/api-keys", middleware.RequireAuth(app.AuthService), apiKeyHandler.CreateAPIKey)
+		users.GET("/me/api-keys", middleware.RequireAuth(app.AuthService), apiKeyHandler.GetMyAPIKeys)
+		users.DELETE("/me/api-keys/:id", middleware.RequireAuth(app.AuthService), apiKeyHandler.RevokeAPIKey)
+		// [Admin]
+		users.PUT("/:id/role", middleware.RequireAuth(app.AuthService),
+			middleware.RequirePermission(app.RoleService, model.PermRoleManage), roleHandler.AssignRole)
+	}
+
+	roles := r.Group("roles")
+	roles.Use(middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermRoleManage))
+	{
+		// [Admin]
+		roles.GET("/", roleHandler.GetRoles)
+		roles.GET("/permissions", roleHandler.GetPermissions)
+		roles.PUT("/:name", roleHandler.SaveRole)
+		roles.DELETE("/:name", roleHandler.DeleteRole)
 	}
 
 	movies := r.Group("movies")
@@ -41,9 +74,9 @@ func InitRouter(app *app.App) *gin.Engine {
 		movies.GET("/:id", movieHandler.GetMovieByID)
 		movies.GET("/:id/showtimes", movieHandler.GetMovieShowtimes)
 		// [Admin]
-		movies.POST("/", middleware.RequireAuth(), middleware.RequireAdmin(), movieHandler.CreateMovie)
-		movies.PUT("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), movieHandler.UpdateMovie)
-		movies.DELETE("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), movieHandler.DeleteMovie)
+		movies.POST("/", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermMovieWrite), movieHandler.CreateMovie)
+		movies.PUT("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermMovieWrite), movieHandler.UpdateMovie)
+		movies.DELETE("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermMovieWrite), movieHandler.DeleteMovie)
 	}
 
 	showtimes := r.Group("showtimes")
@@ -51,14 +84,22 @@ func InitRouter(app *app.App) *gin.Engine {
 		showtimes.GET("/", showtimeHandler.ListAllShowtimes)
 		showtimes.GET("/:id", showtimeHandler.GetShowtimeByID)
 		showtimes.GET("/:id/availability", showtimeHandler.GetShowtimeAvailability)
+		showtimes.GET("/:id/seats", showtimeHandler.GetShowtimeSeats)
+		showtimes.GET("/:id/seats/stream", showtimeHandler.StreamShowtimeSeats)
+		// [User]
+		showtimes.POST("/:id/best-available", middleware.RequireAuth(app.AuthService, "reservations"), showtimeHandler.GetBestAvailableSeats)
 		// [Admin]
-		showtimes.POST("/", middleware.RequireAuth(), middleware.RequireAdmin(), showtimeHandler.CreateShowtime)
-		showtimes.PUT("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), showtimeHandler.UpdateShowtime)
-		showtimes.DELETE("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), showtimeHandler.DeleteShowtimeByID)
+		showtimes.POST("/", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.CreateShowtime)
+		showtimes.POST("/bulk", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.BulkCreateShowtimes)
+		showtimes.PUT("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.UpdateShowtime)
+		showtimes.PUT("/:id/price", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.UpdateShowtimePrice)
+		showtimes.DELETE("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.DeleteShowtimeByID)
+		showtimes.POST("/:id/seats/:seat_id/block", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.BlockShowtimeSeat)
+		showtimes.DELETE("/:id/seats/:seat_id/block", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermShowtimeWrite), showtimeHandler.UnblockShowtimeSeat)
 	}
 
 	reservations := r.Group("reservations")
-	reservations.Use(middleware.RequireAuth())
+	reservations.Use(middleware.RequireAuth(app.AuthService, "reservations"))
 	{
 		// [User]
 		reservations.POST("/", reservationHandler.CreateReservation)
@@ -66,14 +107,58 @@ func InitRouter(app *app.App) *gin.Engine {
 		reservations.DELETE("/:id", reservationHandler.CancelReservation)
 	}
 
+	waitlist := r.Group("waitlist")
+	waitlist.Use(middleware.RequireAuth(app.AuthService, "waitlist"))
+	{
+		// [User]
+		waitlist.POST("/", reservationHandler.JoinWaitlist)
+		waitlist.GET("/me", reservationHandler.GetMyWaitlist)
+		waitlist.DELETE("/:id", reservationHandler.LeaveWaitlist)
+	}
+
+	orders := r.Group("orders")
+	orders.Use(middleware.RequireAuth(app.AuthService, "orders"))
+	{
+		// [User]
+		orders.GET("/me", orderHandler.GetMyOrders)
+		orders.GET("/:id", orderHandler.GetOrderByID)
+		orders.POST("/:id/pay", orderHandler.PayOrder)
+		// [Admin]
+		orders.POST("/:id/refund", middleware.RequirePermission(app.RoleService, model.PermReservationRefund), orderHandler.RefundOrder)
+	}
+
+	payments := r.Group("payments")
+	{
+		// [Payment provider]
+		payments.POST("/webhook", paymentHandler.HandleWebhook)
+	}
+
+	webhooks := r.Group("webhooks")
+	webhooks.Use(middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermWebhookManage))
+	{
+		// [Admin]
+		webhooks.POST("/", webhookHandler.CreateWebhook)
+		webhooks.GET("/", webhookHandler.GetWebhooks)
+		webhooks.PUT("/:id", webhookHandler.UpdateWebhook)
+		webhooks.DELETE("/:id", webhookHandler.DeleteWebhook)
+		webhooks.GET("/:id/deliveries", webhookHandler.GetWebhookDeliveries)
+		webhooks.POST("/deliveries/:id/replay", webhookHandler.ReplayWebhookDelivery)
+	}
+
 	halls := r.Group("halls")
 	{
 		halls.GET("/", hallHandler.GetAllHalls)
 		halls.GET("/:id", hallHandler.GetHallByID)
+		halls.GET("/:id/prices", hallHandler.GetHallPrices)
 		// [Admin]
-		halls.POST("/", middleware.RequireAuth(), middleware.RequireAdmin(), hallHandler.CreateHall)
-		halls.PUT("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), hallHandler.UpdateHall)
-		halls.DELETE("/:id", middleware.RequireAuth(), middleware.RequireAdmin(), hallHandler.DeleteHall)
+		halls.POST("/", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.CreateHall)
+		halls.PUT("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.UpdateHall)
+		halls.PUT("/:id/prices", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.UpdateHallPrices)
+		halls.PUT("/:id/seating-rules", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.UpdateSeatingRules)
+		halls.PUT("/:id/seats/:seat_id/class", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.UpdateSeatClass)
+		halls.DELETE("/:id", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.DeleteHall)
+		halls.POST("/:id/seats/:seat_id/block", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.BlockHallSeat)
+		halls.DELETE("/:id/seats/:seat_id/block", middleware.RequireAuth(app.AuthService), middleware.RequirePermission(app.RoleService, model.PermHallWrite), hallHandler.UnblockHallSeat)
 	}
 
 	return r
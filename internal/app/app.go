@@ -5,9 +5,14 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/qs-lzh/movie-reservation/config"
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
 	"github.com/qs-lzh/movie-reservation/internal/cache"
+	"github.com/qs-lzh/movie-reservation/internal/notify"
+	"github.com/qs-lzh/movie-reservation/internal/payment"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
+	"github.com/qs-lzh/movie-reservation/internal/security"
 	"github.com/qs-lzh/movie-reservation/internal/service"
+	"github.com/qs-lzh/movie-reservation/internal/webhook"
 )
 
 type App struct {
@@ -16,14 +21,23 @@ type App struct {
 	DB     *gorm.DB
 	Cache  *cache.RedisCache
 	Logger *zap.Logger
+	// Bus publishes the domain events once their transaction commits, subscribe to it to react to them
+	Bus *event.Bus
 
-	UserRepo         *repository.UserRepo
-	MovieRepo        *repository.MovieRepo
-	ShowtimeRepo     *repository.ShowtimeRepo
-	ReservationRepo  *repository.ReservationRepo
-	HallRepo         *repository.HallRepo
-	SeatRepo         *repository.SeatRepo
-	ShowtimeSeatRepo *repository.ShowtimeSeatRepo
+	UserRepo           *repository.UserRepo
+	MovieRepo          *repository.MovieRepo
+	ShowtimeRepo       *repository.ShowtimeRepo
+	ReservationRepo    *repository.ReservationRepo
+	HallRepo           *repository.HallRepo
+	SeatRepo           *repository.SeatRepo
+	ShowtimeSeatRepo   *repository.ShowtimeSeatRepo
+	SeatClassPriceRepo *repository.SeatClassPriceRepo
+	OrderRepo          *repository.OrderRepo
+	PaymentEventRepo   *repository.PaymentEventRepo
+	RefundRepo         *repository.RefundRepo
+	WaitlistRepo       *repository.WaitlistRepo
+
+	PaymentProvider payment.PaymentProvider
 
 	UserService         service.UserService
 	MovieService        service.MovieService
@@ -33,7 +47,14 @@ type App struct {
 	SeatService         service.SeatService
 	ShowtimeSeatService service.ShowtimeSeatService
 	AuthService         service.AuthService
+	KeyService          service.KeyService
+	APIKeyService       service.APIKeyService
+	RoleService         service.RoleService
 	CaptchaService      service.CaptchaService
+	PricingService      service.PricingService
+	OrderService        service.OrderService
+	NotificationService service.NotificationService
+	WebhookService      service.WebhookService
 }
 
 func New(config *config.Config, db *gorm.DB, cache *cache.RedisCache, logger *zap.Logger) *App {
@@ -45,22 +66,60 @@ func New(config *config.Config, db *gorm.DB, cache *cache.RedisCache, logger *za
 	hallRepo := repository.NewHallRepoGorm(db)
 	seatRepo := repository.NewSeatRepoGorm(db)
 	showtimeSeatRepo := repository.NewShowtimeSeatRepoGorm(db)
+	seatClassPriceRepo := repository.NewSeatClassPriceRepoGorm(db)
+	orderRepo := repository.NewOrderRepoGorm(db)
+	paymentEventRepo := repository.NewPaymentEventRepoGorm(db)
+	refundRepo := repository.NewRefundRepoGorm(db)
+	waitlistRepo := repository.NewWaitlistRepoGorm(db)
+	outboxRepo := repository.NewOutboxRepoGorm(db)
+	inboxRepo := repository.NewInboxRepoGorm(db)
+	webhookEndpointRepo := repository.NewWebhookEndpointRepoGorm(db)
+	webhookDeliveryRepo := repository.NewWebhookDeliveryRepoGorm(db)
+	signingKeyRepo := repository.NewSigningKeyRepoGorm(db)
+	apiKeyRepo := repository.NewAPIKeyRepoGorm(db)
+	roleRepo := repository.NewRoleRepoGorm(db)
+
+	bus := event.NewBus(logger)
+
+	// the fake provider is the only one so far, swap it here for a real gateway
+	paymentProvider := payment.NewFakeProvider(config.PaymentWebhookSecret)
+	notificationService := service.NewNotificationService(db, outboxRepo, inboxRepo, notificationChannels(config, userRepo,
+		inboxRepo, logger), config.NotifyMaxAttempts, config.NotifyRetryBackoff)
+	webhookService := service.NewWebhookService(db, webhookEndpointRepo, webhookDeliveryRepo, webhook.NewSender(nil),
+		config.WebhookMaxAttempts, config.WebhookRetryBackoff, config.WebhookDisableAfter)
 
 	seatService := service.NewseatService(db, seatRepo)
-	showtimeSeatService := service.NewShowtimeSeatService(db, showtimeSeatRepo, seatService)
-	showtimeService := service.NewShowtimeService(db, showtimeRepo, showtimeSeatService)
-	hallService := service.NewHallService(db, hallRepo, seatService, showtimeService)
-	reservationService := service.NewReservationService(db, reservationRepo, showtimeRepo, hallRepo, showtimeSeatService)
+	showtimeSeatService := service.NewShowtimeSeatService(db, showtimeSeatRepo, seatService, cache, bus)
+	orderService := service.NewOrderService(db, orderRepo, reservationRepo, paymentEventRepo, refundRepo, showtimeSeatService,
+		paymentProvider, bus)
+	showtimeService := service.NewShowtimeService(db, showtimeRepo, hallRepo, movieRepo, reservationRepo, showtimeSeatService,
+		orderService, notificationService, config.ShowtimeCleaningBuffer, bus)
+	hallService := service.NewHallService(db, hallRepo, seatService, showtimeService, showtimeSeatService, bus)
+	pricingService := service.NewPricingService(db, seatClassPriceRepo, seatRepo, showtimeRepo, hallRepo)
+	reservationService := service.NewReservationService(db, reservationRepo, orderRepo, showtimeRepo, hallRepo, seatRepo, showtimeSeatService,
+		pricingService, orderService, waitlistRepo, notificationService, config.SeatHoldTTL, config.WaitlistOfferTTL,
+		config.MaxSeatsPerUser, config.CancellationPolicy, bus)
 	movieService := service.NewMovieService(db, movieRepo, showtimeSeatService, showtimeService)
-	userService := service.NewUserService(db, userRepo, reservationService)
+	userService := service.NewUserService(db, userRepo, reservationService, bus)
 	captchaService := service.NewCaptchaService(cache)
-	authService := service.NewJWTAuthService(userService)
+	keyManager := security.NewKeyManager()
+	// a new key is published for two refreshes before it signs, so every instance knows it by then
+	keyService := service.NewKeyService(db, signingKeyRepo, keyManager, config.JWTSigningAlgorithm,
+		config.JWTKeyRotationInterval, config.JWTKeyGracePeriod, 2*config.JWTKeyRefreshInterval)
+	apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+	roleService := service.NewRoleService(db, roleRepo, userRepo)
+	authService := service.NewJWTAuthService(userService, cache, keyManager, apiKeyService, config.AccessTokenTTL,
+		config.RefreshTokenTTL)
+
+	subscribeEvents(bus, showtimeSeatService, webhookService, reservationService, logger)
 
 	return &App{
 		Config:              config,
 		DB:                  db,
 		Cache:               cache,
 		Logger:              logger,
+		Bus:                 bus,
+		PaymentProvider:     paymentProvider,
 		UserService:         userService,
 		MovieService:        movieService,
 		ShowtimeService:     showtimeService,
@@ -69,8 +128,35 @@ func New(config *config.Config, db *gorm.DB, cache *cache.RedisCache, logger *za
 		SeatService:         seatService,
 		ShowtimeSeatService: showtimeSeatService,
 		AuthService:         authService,
+		KeyService:          keyService,
+		APIKeyService:       apiKeyService,
+		RoleService:         roleService,
 		CaptchaService:      captchaService,
+		PricingService:      pricingService,
+		OrderService:        orderService,
+		NotificationService: notificationService,
+		WebhookService:      webhookService,
+	}
+}
+
+// notificationChannels always delivers to the in-app inbox, plus email and webhook when they are configured.
+// Without any of those two, notifications are logged instead.
+func notificationChannels(config *config.Config, userRepo repository.UserRepo, inboxRepo repository.InboxRepo,
+	logger *zap.Logger) map[string]notify.Notifier {
+	channels := map[string]notify.Notifier{
+		"inbox": notify.NewInboxNotifier(inboxRepo),
+	}
+	if config.SMTPAddr != "" {
+		channels["email"] = notify.NewSMTPNotifier(config.SMTPAddr, config.SMTPFrom, config.SMTPUsername,
+			config.SMTPPassword, userRepo)
+	}
+	if config.NotifyWebhookURL != "" {
+		channels["webhook"] = notify.NewWebhookNotifier(config.NotifyWebhookURL)
+	}
+	if len(channels) == 1 {
+		channels["log"] = notify.NewLogNotifier(logger)
 	}
+	return channels
 }
 
 func (app *App) Close() error {
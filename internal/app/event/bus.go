@@ -0,0 +1,198 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Handler reacts to one event, its error is only logged since the change is already committed
+type Handler func(ctx context.Context, event Event) error
+
+// TxHandler stores what one event needs in the transaction recording it, its error rolls the transaction back
+type TxHandler func(tx *gorm.DB, event Event) error
+
+// Bus dispatches the published events to the subscribers of their name.
+// Sync subscribers run one after the other on the publishing goroutine, before the publisher returns,
+// async subscribers each run on their own goroutine.
+// Tx subscribers run in the transaction recording the event, right before it commits.
+type Bus struct {
+	mu     sync.RWMutex
+	sync   map[string][]Handler
+	async  map[string][]Handler
+	tx     map[string][]TxHandler
+	logger *zap.Logger
+}
+
+func NewBus(logger *zap.Logger) *Bus {
+	return &Bus{
+		sync:   make(map[string][]Handler),
+		async:  make(map[string][]Handler),
+		tx:     make(map[string][]TxHandler),
+		logger: logger,
+	}
+}
+
+// Subscribe registers a sync handler of the events of type E
+func Subscribe[E Event](bus *Bus, handler func(ctx context.Context, event E) error) {
+	bus.subscribe(bus.sync, typed(handler))
+}
+
+// SubscribeAsync registers an async handler of the events of type E
+func SubscribeAsync[E Event](bus *Bus, handler func(ctx context.Context, event E) error) {
+	bus.subscribe(bus.async, typed(handler))
+}
+
+// SubscribeTx registers a tx handler of the events of type E, for the work that must not be lost
+// once the change reporting the event is committed
+func SubscribeTx[E Event](bus *Bus, handler func(tx *gorm.DB, event E) error) {
+	var zero E
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.tx[zero.Name()] = append(bus.tx[zero.Name()], func(tx *gorm.DB, event Event) error {
+		return handler(tx, event.(E))
+	})
+}
+
+func (b *Bus) subscribe(handlers map[string][]Handler, handler namedHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	handlers[handler.name] = append(handlers[handler.name], handler.handle)
+}
+
+type namedHandler struct {
+	name   string
+	handle Handler
+}
+
+func typed[E Event](handler func(ctx context.Context, event E) error) namedHandler {
+	var zero E
+	return namedHandler{
+		name: zero.Name(),
+		handle: func(ctx context.Context, event Event) error {
+			return handler(ctx, event.(E))
+		},
+	}
+}
+
+// Publish dispatches the events right away, use Record for the events of a transaction
+func (b *Bus) Publish(ctx context.Context, events ...Event) {
+	for _, event := range events {
+		b.mu.RLock()
+		syncHandlers := b.sync[event.Name()]
+		asyncHandlers := b.async[event.Name()]
+		b.mu.RUnlock()
+
+		for _, handler := range syncHandlers {
+			b.run(ctx, handler, event)
+		}
+		for _, handler := range asyncHandlers {
+			// the publisher's context may end before the handler runs
+			go b.run(context.WithoutCancel(ctx), handler, event)
+		}
+	}
+}
+
+// run keeps a failing or panicking subscriber from affecting the publisher and the other subscribers
+func (b *Bus) run(ctx context.Context, handler Handler, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Error("Event subscriber panicked", zap.String("event", event.Name()), zap.Any("panic", r))
+		}
+	}()
+	if err := handler(ctx, event); err != nil {
+		b.logger.Error("Event subscriber failed", zap.String("event", event.Name()), zap.Error(err))
+	}
+}
+
+type pendingKey struct{}
+
+// pending collects the events recorded during a transaction
+type pending struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (p *pending) add(events ...Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, events...)
+}
+
+// Transaction runs fc in a transaction of db like db.Transaction, hands the events recorded with Record
+// during fc to the tx subscribers before committing and publishes them once the transaction commits.
+// Nothing is published when fc, a tx subscriber or the commit fails.
+// Nested in another Transaction, the events are handed over to the outer one.
+func (b *Bus) Transaction(db *gorm.DB, fc func(tx *gorm.DB) error) error {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	outer, _ := ctx.Value(pendingKey{}).(*pending)
+	inner := &pending{}
+	err := db.WithContext(context.WithValue(ctx, pendingKey{}, inner)).Transaction(func(tx *gorm.DB) error {
+		if err := fc(tx); err != nil {
+			return err
+		}
+		// the outermost transaction runs the tx subscribers of the nested ones too
+		if outer != nil {
+			return nil
+		}
+		inner.mu.Lock()
+		defer inner.mu.Unlock()
+		return b.handleTx(tx, inner.events)
+	})
+	if err != nil {
+		return err
+	}
+	if outer != nil {
+		outer.add(inner.events...)
+		return nil
+	}
+	b.Publish(context.WithoutCancel(ctx), inner.events...)
+	return nil
+}
+
+// Record queues the events to be published once the transaction of tx commits.
+// tx must come from Transaction, otherwise the events are published at once.
+func (b *Bus) Record(tx *gorm.DB, events ...Event) {
+	if tx.Statement.Context != nil {
+		if p, ok := tx.Statement.Context.Value(pendingKey{}).(*pending); ok {
+			p.add(events...)
+			return
+		}
+	}
+	b.logger.Warn("Events recorded outside of a bus transaction are published before commit",
+		zap.String("events", fmt.Sprint(names(events))))
+	if err := b.handleTx(tx, events); err != nil {
+		b.logger.Error("Event tx subscriber failed", zap.String("events", fmt.Sprint(names(events))), zap.Error(err))
+	}
+	b.Publish(context.Background(), events...)
+}
+
+// handleTx runs the tx subscribers of the events in tx and stops at the first error
+func (b *Bus) handleTx(tx *gorm.DB, events []Event) error {
+	for _, event := range events {
+		b.mu.RLock()
+		handlers := b.tx[event.Name()]
+		b.mu.RUnlock()
+
+		for _, handler := range handlers {
+			if err := handler(tx, event); err != nil {
+				return fmt.Errorf("%s subscriber: %w", event.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func names(events []Event) []string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, event.Name())
+	}
+	return names
+}
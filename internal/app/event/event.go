@@ -0,0 +1,71 @@
+// Package event is the in-process bus of the domain events. Services record events inside their transaction,
+// the events are only published once it commits, so subscribers never see a change that was rolled back.
+package event
+
+import (
+	"time"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// Event is a fact about the domain, Name identifies its type for the subscribers.
+// Events are marshalled to JSON for the outbound webhooks, so their fields are part of the public API.
+type Event interface {
+	Name() string
+}
+
+// ReservationCreated is recorded for every group of seats held in a new pending order
+type ReservationCreated struct {
+	OrderID        uint      `json:"order_id"`
+	UserID         uint      `json:"user_id"`
+	ShowtimeID     uint      `json:"showtime_id"`
+	ReservationIDs []uint    `json:"reservation_ids"`
+	SeatIDs        []uint    `json:"seat_ids"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func (ReservationCreated) Name() string { return "reservation.created" }
+
+// ReservationCancelled is recorded when a reservation is cancelled, by its user or because its seat disappeared
+type ReservationCancelled struct {
+	ReservationID uint `json:"reservation_id"`
+	UserID        uint `json:"user_id"`
+	ShowtimeID    uint `json:"showtime_id"`
+	SeatID        uint `json:"seat_id"`
+	// RefundPercent is the share of the price refunded
+	RefundPercent int `json:"refund_percent"`
+}
+
+func (ReservationCancelled) Name() string { return "reservation.cancelled" }
+
+// ShowtimeRescheduled is recorded when a showtime changes its start time or its hall
+type ShowtimeRescheduled struct {
+	ShowtimeID uint      `json:"showtime_id"`
+	OldHallID  uint      `json:"old_hall_id"`
+	HallID     uint      `json:"hall_id"`
+	OldStartAt time.Time `json:"old_start_at"`
+	StartAt    time.Time `json:"start_at"`
+}
+
+func (ShowtimeRescheduled) Name() string { return "showtime.rescheduled" }
+
+// SeatStatusChanged is recorded for every status transition of a showtime seat
+type SeatStatusChanged struct {
+	ShowtimeID     uint                     `json:"showtime_id"`
+	ShowtimeSeatID uint                     `json:"showtime_seat_id"`
+	SeatID         uint                     `json:"seat_id"`
+	From           model.ShowtimeSeatStatus `json:"from"`
+	To             model.ShowtimeSeatStatus `json:"to"`
+	At             time.Time                `json:"at"`
+}
+
+func (SeatStatusChanged) Name() string { return "seat.status_changed" }
+
+// UserRegistered is recorded when an account is created
+type UserRegistered struct {
+	UserID   uint           `json:"user_id"`
+	UserName string         `json:"user_name"`
+	Role     model.UserRole `json:"role"`
+}
+
+func (UserRegistered) Name() string { return "user.registered" }
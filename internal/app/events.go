@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+// subscribeEvents registers the built-in subscribers of the bus.
+// The live seat map has to follow the seats closely so it subscribes synchronously,
+// the audit log must not slow down the requests so it runs async.
+// The webhook deliveries are stored in the transaction recording the event, so a committed event is never lost.
+// A cancelled seat is offered to the waitlist async, the sweeper offers it anyway if that fails.
+func subscribeEvents(bus *event.Bus, showtimeSeatService service.ShowtimeSeatService, webhookService service.WebhookService,
+	reservationService service.ReservationService, logger *zap.Logger) {
+	event.Subscribe(bus, showtimeSeatService.BroadcastSeatStatus)
+	event.SubscribeAsync(bus, func(ctx context.Context, e event.ReservationCancelled) error {
+		_, err := reservationService.OfferWaitlist(e.ShowtimeID)
+		return err
+	})
+
+	subscribeWebhook[event.ReservationCreated](bus, webhookService)
+	subscribeWebhook[event.ReservationCancelled](bus, webhookService)
+	subscribeWebhook[event.ShowtimeRescheduled](bus, webhookService)
+
+	audit := logger.Named("audit")
+	event.SubscribeAsync(bus, func(ctx context.Context, e event.ReservationCreated) error {
+		audit.Info(e.Name(), zap.Uint("order_id", e.OrderID), zap.Uint("user_id", e.UserID),
+			zap.Uint("showtime_id", e.ShowtimeID), zap.Uints("seat_ids", e.SeatIDs), zap.Time("expires_at", e.ExpiresAt))
+		return nil
+	})
+	event.SubscribeAsync(bus, func(ctx context.Context, e event.ReservationCancelled) error {
+		audit.Info(e.Name(), zap.Uint("reservation_id", e.ReservationID), zap.Uint("user_id", e.UserID),
+			zap.Uint("showtime_id", e.ShowtimeID), zap.Uint("seat_id", e.SeatID), zap.Int("refund_percent", e.RefundPercent))
+		return nil
+	})
+	event.SubscribeAsync(bus, func(ctx context.Context, e event.ShowtimeRescheduled) error {
+		audit.Info(e.Name(), zap.Uint("showtime_id", e.ShowtimeID), zap.Uint("old_hall_id", e.OldHallID),
+			zap.Uint("hall_id", e.HallID), zap.Time("old_start_at", e.OldStartAt), zap.Time("start_at", e.StartAt))
+		return nil
+	})
+	event.SubscribeAsync(bus, func(ctx context.Context, e event.UserRegistered) error {
+		audit.Info(e.Name(), zap.Uint("user_id", e.UserID), zap.String("user_name", e.UserName),
+			zap.String("role", string(e.Role)))
+		return nil
+	})
+}
+
+func subscribeWebhook[E event.Event](bus *event.Bus, webhookService service.WebhookService) {
+	event.SubscribeTx(bus, func(tx *gorm.DB, e E) error {
+		return webhookService.EnqueueEventTx(tx, e)
+	})
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StartKeyRotation reloads the signing keys and rotates them when due every JWTKeyRefreshInterval until ctx is done
+func (app *App) StartKeyRotation(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(app.Config.JWTKeyRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := app.KeyService.RotateKeys(); err != nil {
+					app.Logger.Error("Failed to rotate signing keys", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// StartNotificationWorker delivers the outbox every NotifyPollInterval until ctx is done
+func (app *App) StartNotificationWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(app.Config.NotifyPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sent, err := app.NotificationService.DeliverDue()
+				if err != nil {
+					app.Logger.Error("Failed to deliver notifications", zap.Error(err))
+					continue
+				}
+				if sent > 0 {
+					app.Logger.Info("delivered notifications", zap.Int("count", sent))
+				}
+			}
+		}
+	}()
+}
+
+// StartWebhookWorker sends the due partner webhook deliveries every WebhookPollInterval until ctx is done
+func (app *App) StartWebhookWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(app.Config.WebhookPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				delivered, err := app.WebhookService.DeliverDue()
+				if err != nil {
+					app.Logger.Error("Failed to deliver webhooks", zap.Error(err))
+					continue
+				}
+				if delivered > 0 {
+					app.Logger.Info("delivered webhooks", zap.Int("count", delivered))
+				}
+			}
+		}
+	}()
+}
+
+// StartHoldSweeper expires unpaid orders, returns expired seat holds to available, pays out the refunds
+// of cancellations and offers the freed seats to the waitlists every HoldSweepInterval until ctx is done
+func (app *App) StartHoldSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(app.Config.HoldSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expired, err := app.OrderService.ExpirePendingOrders()
+				if err != nil {
+					app.Logger.Error("Failed to expire pending orders", zap.Error(err))
+				} else if expired > 0 {
+					app.Logger.Info("expired pending orders", zap.Int("count", expired))
+				}
+
+				released, err := app.ReservationService.ReleaseExpiredHolds()
+				if err != nil {
+					app.Logger.Error("Failed to release expired seat holds", zap.Error(err))
+				} else if released > 0 {
+					app.Logger.Info("released expired seat holds", zap.Int("count", released))
+				}
+
+				refunded, err := app.OrderService.ProcessRefunds()
+				if err != nil {
+					app.Logger.Error("Failed to pay out refunds", zap.Error(err))
+				} else if refunded > 0 {
+					app.Logger.Info("paid out refunds", zap.Int("count", refunded))
+				}
+
+				// the showtimes without an error made their offers anyway
+				offered, err := app.ReservationService.ProcessWaitlists()
+				if err != nil {
+					app.Logger.Error("Failed to process waitlists", zap.Error(err))
+				}
+				if offered > 0 {
+					app.Logger.Info("offered seats to waitlisted users", zap.Int("count", offered))
+				}
+			}
+		}
+	}()
+}
@@ -10,6 +10,9 @@ import (
 
 var ctx = context.Background()
 
+// ErrCacheMiss is returned by Get and GetDel when the key doesn't exist
+var ErrCacheMiss = redis.Nil
+
 type RedisCache struct {
 	client *redis.Client
 }
@@ -41,6 +44,44 @@ func (r *RedisCache) Get(key string, dest any) error {
 	return json.Unmarshal(data, dest)
 }
 
+// GetDel reads the key and deletes it atomically, so only one caller can consume it
+func (r *RedisCache) GetDel(key string, dest any) error {
+	data, err := r.client.GetDel(ctx, key).Bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
+
+func (r *RedisCache) Exists(key string) (bool, error) {
+	n, err := r.client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *RedisCache) Delete(keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// SetAdd adds the member to the set stored at key and resets the expiration of the whole set
+func (r *RedisCache) SetAdd(key, member string, expiration time.Duration) error {
+	pipe := r.client.TxPipeline()
+	pipe.SAdd(ctx, key, member)
+	pipe.Expire(ctx, key, expiration)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisCache) SetMembers(key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+func (r *RedisCache) SetRemove(key, member string) error {
+	return r.client.SRem(ctx, key, member).Err()
+}
+
 func (r *RedisCache) SetBool(key string, value bool) error {
 	strValue := "false"
 	if value {
@@ -56,3 +97,45 @@ func (r *RedisCache) GetBool(key string) (value bool, err error) {
 	}
 	return value, nil
 }
+
+func (r *RedisCache) Publish(channel string, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, channel, data).Err()
+}
+
+// Subscribe forwards every payload published on the channel until subCtx is done,
+// the returned channel is closed once the subscription ends
+func (r *RedisCache) Subscribe(subCtx context.Context, channel string) (<-chan []byte, error) {
+	pubsub := r.client.Subscribe(subCtx, channel)
+	// wait for the subscription to be confirmed so no message published afterwards is missed
+	if _, err := pubsub.Receive(subCtx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	payloads := make(chan []byte)
+	go func() {
+		defer close(payloads)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-subCtx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case payloads <- []byte(msg.Payload):
+				case <-subCtx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return payloads, nil
+}
@@ -12,6 +12,7 @@ type Response struct {
 type ErrorInfo struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
 }
 
 func Success(c *gin.Context, statusCode int, data any) {
@@ -39,6 +40,18 @@ func Error(c *gin.Context, statusCode int, code string, message string) {
 	})
 }
 
+// ErrorWithDetails is Error with extra data helping the client to fix the request
+func ErrorWithDetails(c *gin.Context, statusCode int, code string, message string, details any) {
+	c.JSON(statusCode, Response{
+		Success: false,
+		Error: &ErrorInfo{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
+
 func BadRequest(c *gin.Context, message string) {
 	Error(c, 400, "BAD_REQUEST", message)
 }
@@ -59,6 +72,10 @@ func Conflict(c *gin.Context, code string, message string) {
 	Error(c, 409, code, message)
 }
 
+func ConflictWithDetails(c *gin.Context, code string, message string, details any) {
+	ErrorWithDetails(c, 409, code, message, details)
+}
+
 func InternalServerError(c *gin.Context, message string) {
 	Error(c, 500, "INTERNAL_SERVER_ERROR", message)
 }
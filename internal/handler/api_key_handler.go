@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type APIKeyHandler struct {
+	App *app.App
+}
+
+func NewAPIKeyHandler(app *app.App) *APIKeyHandler {
+	return &APIKeyHandler{
+		App: app,
+	}
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" binding:"required,max=64"`
+	Scopes []string `json:"scopes" binding:"required"`
+	// ExpiresAt is optional, the key never expires without it
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// @route POST /users/me/api-keys
+// The key is only returned in this response
+func (h *APIKeyHandler) CreateAPIKey(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	key, err := h.App.APIKeyService.CreateAPIKey(userID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidAPIKeyScope) || errors.Is(err, service.ErrInvalidAPIKeyExpiry) {
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to create API key")
+		return
+	}
+
+	dto.Success(ctx, http.StatusCreated, key)
+}
+
+// @route GET /users/me/api-keys
+func (h *APIKeyHandler) GetMyAPIKeys(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	keys, err := h.App.APIKeyService.GetAPIKeysByUserID(userID)
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve API keys")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, keys)
+}
+
+// @route DELETE /users/me/api-keys/:id
+func (h *APIKeyHandler) RevokeAPIKey(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid API key id")
+		return
+	}
+
+	if err := h.App.APIKeyService.RevokeAPIKey(userID, uint(id)); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "API key not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to revoke API key")
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "API key revoked")
+}
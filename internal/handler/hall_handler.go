@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -59,10 +60,27 @@ func (h *HallHandler) GetHallByID(ctx *gin.Context) {
 }
 
 type CreateHallRequest struct {
-	Name      string `json:"name"`
-	SeatCount int    `json:"seat_count"`
-	Rows      int    `json:"rows"`
-	Cols      int    `json:"cols"`
+	Name string `json:"name" binding:"required"`
+	Rows int    `json:"rows"`
+	Cols int    `json:"cols"`
+	// Layout is an ASCII map or a JSON grid (see service.ParseHallLayout), it replaces Rows and Cols,
+	// the seat count is always derived from the seats
+	Layout      json.RawMessage        `json:"layout"`
+	LabelScheme *model.SeatLabelScheme `json:"label_scheme"`
+	// PreventOrphanSeats rejects reservations leaving a single available seat isolated in a row
+	PreventOrphanSeats bool `json:"prevent_orphan_seats"`
+}
+
+// hallLayout returns the layout document when there is one, or else a rows x cols rectangle.
+// It returns nil when neither is given.
+func hallLayout(document json.RawMessage, rows, cols int, scheme model.SeatLabelScheme) (*service.HallLayout, error) {
+	if len(document) != 0 && string(document) != "null" {
+		return service.ParseHallLayout(document, scheme)
+	}
+	if rows == 0 && cols == 0 {
+		return nil, nil
+	}
+	return service.RectangleLayout(rows, cols, scheme)
 }
 
 // @route POST /halls
@@ -80,14 +98,30 @@ func (h *HallHandler) CreateHall(ctx *gin.Context) {
 		return
 	}
 
+	var scheme model.SeatLabelScheme
+	if req.LabelScheme != nil {
+		scheme = *req.LabelScheme
+	}
+	layout, err := hallLayout(req.Layout, req.Rows, req.Cols, scheme)
+	if err == nil && layout == nil {
+		err = errors.New("either layout or rows and cols are required")
+	}
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, fmt.Sprintf("Invalid hall layout: %v", err))
+		return
+	}
+
 	hall = &model.Hall{
-		Name:      req.Name,
-		SeatCount: req.SeatCount,
-		Rows:      req.Rows,
-		Cols:      req.Cols,
+		Name:               req.Name,
+		LabelScheme:        scheme,
+		PreventOrphanSeats: req.PreventOrphanSeats,
+	}
+	if len(req.Layout) != 0 {
+		hall.Layout = string(req.Layout)
 	}
 
-	err = h.App.HallService.CreateHall(hall)
+	err = h.App.HallService.CreateHall(hall, layout)
 	if err != nil {
 		ctx.Error(err)
 		dto.InternalServerError(ctx, "Failed to create hall")
@@ -98,10 +132,13 @@ func (h *HallHandler) CreateHall(ctx *gin.Context) {
 }
 
 type UpdateHallRequest struct {
-	Name      string `json:"name"`
-	SeatCount int    `json:"seat_count"`
-	Rows      int    `json:"rows"`
-	Cols      int    `json:"cols"`
+	Name string `json:"name"`
+	// the seats are only replaced when Layout or Rows and Cols are given, see CreateHallRequest
+	// changing only LabelScheme relabels the current seats
+	Rows        int                    `json:"rows"`
+	Cols        int                    `json:"cols"`
+	Layout      json.RawMessage        `json:"layout"`
+	LabelScheme *model.SeatLabelScheme `json:"label_scheme"`
 }
 
 // @route PUT /halls/:id
@@ -134,14 +171,33 @@ func (h *HallHandler) UpdateHall(ctx *gin.Context) {
 		return
 	}
 
-	existingHall.Name = req.Name
-	existingHall.SeatCount = req.SeatCount
-	existingHall.Rows = req.Rows
-	existingHall.Cols = req.Cols
+	scheme := existingHall.LabelScheme
+	if req.LabelScheme != nil {
+		scheme = *req.LabelScheme
+	}
+	document := req.Layout
+	layout, err := hallLayout(document, req.Rows, req.Cols, scheme)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, fmt.Sprintf("Invalid hall layout: %v", err))
+		return
+	}
+
+	if req.Name != "" {
+		existingHall.Name = req.Name
+	}
+	existingHall.LabelScheme = scheme
+	if layout != nil {
+		existingHall.Layout = string(document)
+	}
 
-	err = h.App.HallService.UpdateHall(existingHall)
+	err = h.App.HallService.UpdateHall(existingHall, layout)
 	if err != nil {
 		ctx.Error(err)
+		if errors.Is(err, service.ErrRelatedResourceExists) {
+			dto.Conflict(ctx, "HALL_IN_USE", "The seats of a hall having showtimes can't be replaced")
+			return
+		}
 		dto.InternalServerError(ctx, "Failed to update hall")
 		return
 	}
@@ -173,3 +229,194 @@ func (h *HallHandler) DeleteHall(ctx *gin.Context) {
 
 	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Hall deleted successfully")
 }
+
+// @route GET /halls/:id/prices
+func (h *HallHandler) GetHallPrices(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid hall id")
+		return
+	}
+
+	multipliers, err := h.App.PricingService.GetClassMultipliers(uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Hall not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to get hall prices")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, gin.H{"multipliers": multipliers})
+}
+
+type UpdateHallPricesRequest struct {
+	Multipliers map[model.SeatClass]float64 `json:"multipliers" binding:"required"`
+}
+
+// @route PUT /halls/:id/prices
+func (h *HallHandler) UpdateHallPrices(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid hall id")
+		return
+	}
+
+	var req UpdateHallPricesRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	err = h.App.PricingService.SetClassMultipliers(uint(id), req.Multipliers)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Hall not exists")
+		case errors.Is(err, service.ErrInvalidSeatClass), errors.Is(err, service.ErrInvalidMultiplier):
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to update hall prices")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Hall prices updated successfully")
+}
+
+type UpdateSeatClassRequest struct {
+	Class model.SeatClass `json:"class" binding:"required"`
+}
+
+// @route PUT /halls/:id/seats/:seat_id/class
+func (h *HallHandler) UpdateSeatClass(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid hall id")
+		return
+	}
+	seatIDParam := ctx.Param("seat_id")
+	seatID, err := strconv.ParseUint(seatIDParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid seat id")
+		return
+	}
+
+	var req UpdateSeatClassRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	err = h.App.PricingService.SetSeatClass(uint(id), uint(seatID), req.Class)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Seat not exists in the hall")
+		case errors.Is(err, service.ErrInvalidSeatClass):
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to update seat class")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Seat class updated successfully")
+}
+
+// @route POST /halls/:id/seats/:seat_id/block
+// Takes the seat out of service and blocks it in every upcoming showtime where it isn't reserved
+func (h *HallHandler) BlockHallSeat(ctx *gin.Context) {
+	h.setHallSeatOutOfService(ctx, true)
+}
+
+// @route DELETE /halls/:id/seats/:seat_id/block
+func (h *HallHandler) UnblockHallSeat(ctx *gin.Context) {
+	h.setHallSeatOutOfService(ctx, false)
+}
+
+func (h *HallHandler) setHallSeatOutOfService(ctx *gin.Context, outOfService bool) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid hall id")
+		return
+	}
+	seatIDParam := ctx.Param("seat_id")
+	seatID, err := strconv.ParseUint(seatIDParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid seat id")
+		return
+	}
+
+	report, err := h.App.HallService.SetSeatOutOfService(uint(id), uint(seatID), outOfService)
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Seat not exists in the hall")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to update seat")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, report)
+}
+
+type UpdateSeatingRulesRequest struct {
+	PreventOrphanSeats *bool `json:"prevent_orphan_seats" binding:"required"`
+}
+
+// @route PUT /halls/:id/seating-rules
+// Unlike PUT /halls/:id, the rules can be changed while the hall has showtimes
+func (h *HallHandler) UpdateSeatingRules(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid hall id")
+		return
+	}
+
+	var req UpdateSeatingRulesRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	err = h.App.HallService.SetPreventOrphanSeats(uint(id), *req.PreventOrphanSeats)
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Hall not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to update seating rules")
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Seating rules updated successfully")
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type InboxHandler struct {
+	App *app.App
+}
+
+func NewInboxHandler(app *app.App) *InboxHandler {
+	return &InboxHandler{
+		App: app,
+	}
+}
+
+// @route GET /users/me/inbox
+func (h *InboxHandler) GetMyInbox(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	messages, err := h.App.NotificationService.GetInbox(userID)
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve the inbox")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, messages)
+}
+
+// @route POST /users/me/inbox/:id/read
+func (h *InboxHandler) MarkInboxMessageRead(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid message id")
+		return
+	}
+
+	err = h.App.NotificationService.MarkInboxMessageRead(userID, uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Message not found")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to mark the message as read")
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Message marked as read")
+}
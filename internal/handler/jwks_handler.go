@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+)
+
+type JWKSHandler struct {
+	App *app.App
+}
+
+func NewJWKSHandler(app *app.App) *JWKSHandler {
+	return &JWKSHandler{
+		App: app,
+	}
+}
+
+// @route GET /.well-known/jwks.json
+// The key set is served bare, not in the usual response envelope, so standard JWT libraries can read it
+func (h *JWKSHandler) GetJWKS(ctx *gin.Context) {
+	// new keys are published before they sign, so clients may cache the set as long as the keys are refreshed
+	ctx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.App.Config.JWTKeyRefreshInterval.Seconds())))
+	ctx.JSON(http.StatusOK, h.App.KeyService.JWKS())
+}
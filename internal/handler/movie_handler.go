@@ -76,8 +76,9 @@ func (h *MovieHandler) GetMovieShowtimes(ctx *gin.Context) {
 }
 
 type CreateMovieRequest struct {
-	Title       string `json:"title" binding:"required"`
-	Description string `json:"description"`
+	Title          string `json:"title" binding:"required"`
+	Description    string `json:"description"`
+	RuntimeMinutes int    `json:"runtime_minutes" binding:"required,min=1"`
 }
 
 // @route POST /movies
@@ -97,8 +98,9 @@ func (h *MovieHandler) CreateMovie(ctx *gin.Context) {
 	}
 
 	movie := &model.Movie{
-		Title:       req.Title,
-		Description: req.Description,
+		Title:          req.Title,
+		Description:    req.Description,
+		RuntimeMinutes: req.RuntimeMinutes,
 	}
 
 	err = h.App.MovieService.CreateMovie(movie)
@@ -112,8 +114,9 @@ func (h *MovieHandler) CreateMovie(ctx *gin.Context) {
 }
 
 type UpdateMovieRequest struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	RuntimeMinutes int    `json:"runtime_minutes" binding:"min=0"`
 }
 
 // @route PUT /movies/:id
@@ -148,6 +151,9 @@ func (h *MovieHandler) UpdateMovie(ctx *gin.Context) {
 
 	existingMovie.Title = req.Title
 	existingMovie.Description = req.Description
+	if req.RuntimeMinutes != 0 {
+		existingMovie.RuntimeMinutes = req.RuntimeMinutes
+	}
 
 	err = h.App.MovieService.UpdateMovie(existingMovie)
 	if err != nil {
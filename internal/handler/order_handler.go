@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/payment"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type OrderHandler struct {
+	App *app.App
+}
+
+func NewOrderHandler(app *app.App) *OrderHandler {
+	return &OrderHandler{
+		App: app,
+	}
+}
+
+// @route GET /orders/me
+func (h *OrderHandler) GetMyOrders(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	orders, err := h.App.OrderService.GetOrdersByUserID(userID)
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve orders")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, orders)
+}
+
+// @route GET /orders/:id
+func (h *OrderHandler) GetOrderByID(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	idParam := ctx.Param("id")
+	orderID, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid order ID")
+		return
+	}
+
+	order, err := h.App.OrderService.GetOrderByID(uint(orderID))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Order not found")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve order")
+		return
+	}
+	if order.UserID != userID {
+		dto.Forbidden(ctx, "You are not allowed to see this order")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, order)
+}
+
+// @route POST /orders/:id/pay
+func (h *OrderHandler) PayOrder(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	idParam := ctx.Param("id")
+	orderID, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid order ID")
+		return
+	}
+
+	order, err := h.App.OrderService.Pay(uint(orderID), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Order not found")
+		case errors.Is(err, service.ErrOrderNotOwned):
+			ctx.Error(err)
+			dto.Forbidden(ctx, "You are not allowed to pay this order")
+		case errors.Is(err, service.ErrOrderNotPending):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ORDER_NOT_PENDING", "The order is not waiting for payment")
+		case errors.Is(err, service.ErrOrderExpired):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ORDER_EXPIRED", "The order has expired")
+		case errors.Is(err, service.ErrOrderAmountChanged):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ORDER_AMOUNT_CHANGED", "The order changed during the payment, pay it again")
+		case errors.Is(err, payment.ErrPaymentDeclined):
+			ctx.Error(err)
+			dto.Error(ctx, http.StatusPaymentRequired, "PAYMENT_DECLINED", "The payment was declined")
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to pay order")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, order, "Order paid successfully")
+}
+
+// @route POST /orders/:id/refund
+func (h *OrderHandler) RefundOrder(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	orderID, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid order ID")
+		return
+	}
+
+	order, err := h.App.OrderService.Refund(uint(orderID))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Order not found")
+		case errors.Is(err, service.ErrOrderNotPaid):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ORDER_NOT_PAID", "Only paid orders can be refunded")
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to refund order")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, order, "Order refunded successfully")
+}
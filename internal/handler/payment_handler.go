@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/payment"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type PaymentHandler struct {
+	App *app.App
+}
+
+func NewPaymentHandler(app *app.App) *PaymentHandler {
+	return &PaymentHandler{
+		App: app,
+	}
+}
+
+// @route POST /payments/webhook
+// Called by the payment provider, authenticated by the payload signature instead of a user token
+func (h *PaymentHandler) HandleWebhook(ctx *gin.Context) {
+	payload, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Failed to read request body")
+		return
+	}
+
+	err = h.App.OrderService.HandleWebhook(payload, ctx.GetHeader("X-Payment-Signature"))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrPaymentEventMismatch):
+			// logged for a human to look at, answering an error would only make the provider retry forever
+			ctx.Error(err)
+			dto.Success(ctx, http.StatusOK, nil)
+		case errors.Is(err, payment.ErrInvalidSignature):
+			ctx.Error(err)
+			dto.Unauthorized(ctx, "Invalid webhook signature")
+		case errors.Is(err, service.ErrUnknownPaymentEvent):
+			ctx.Error(err)
+			dto.BadRequest(ctx, "Unknown webhook event type")
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Order not found")
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to handle webhook")
+		}
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, nil)
+}
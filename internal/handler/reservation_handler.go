@@ -2,6 +2,7 @@ package handler
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -24,12 +25,17 @@ func NewReservationHandler(app *app.App) *ReservationHandler {
 
 var ErrUnauthorized = errors.New("Unauthorized")
 
+// CreateReservationRequest takes the seats by ID, by label or both, at least one seat is required
 type CreateReservationRequest struct {
-	ShowtimeID uint `json:"showtime_id" binding:"required"`
-	SeatID     uint `json:"seat_id" binding:"required"`
+	ShowtimeID uint     `json:"showtime_id" binding:"required"`
+	SeatIDs    []uint   `json:"seat_ids"`
+	Seats      []string `json:"seats"`
 }
 
 // @route POST /reservations
+// All the seats are held for the user until the returned expires_at,
+// the returned order must be paid before then or the seats are released.
+// Either every seat is reserved or none is.
 func (h *ReservationHandler) CreateReservation(ctx *gin.Context) {
 	// Extract user_id from context (guaranteed to exist by RequireAuth middleware)
 	userIDValue, exists := ctx.Get("user_id")
@@ -46,18 +52,28 @@ func (h *ReservationHandler) CreateReservation(ctx *gin.Context) {
 		return
 	}
 
-	err := h.App.ReservationService.Reserve(userID, req.ShowtimeID, req.SeatID)
+	hold, err := h.App.ReservationService.Reserve(userID, req.ShowtimeID, req.SeatIDs, req.Seats)
 	if err != nil {
+		var orphanErr *service.OrphanSeatError
 		switch {
+		case errors.As(err, &orphanErr):
+			ctx.Error(err)
+			writeOrphanSeatError(ctx, orphanErr)
 		case errors.Is(err, service.ErrShowtimeNotExist):
 			ctx.Error(err)
 			dto.NotFound(ctx, "Showtime not found")
 		case errors.Is(err, service.ErrNoTicketsAvailable):
 			ctx.Error(err)
-			dto.Conflict(ctx, "NO_TICKETS", "No tickets available")
-		case errors.Is(err, service.ErrAlreadyReserved):
+			dto.Conflict(ctx, "NO_TICKETS", "No tickets available, join the waitlist to be offered freed seats")
+		case errors.Is(err, service.ErrInvalidSeatSelection):
+			ctx.Error(err)
+			dto.BadRequest(ctx, "Seats must be distinct seats of the showtime")
+		case errors.Is(err, service.ErrSeatUnavailable):
 			ctx.Error(err)
-			dto.Conflict(ctx, "ALREADY_RESERVED", "You have already reserved this showtime")
+			dto.Conflict(ctx, "SEAT_UNAVAILABLE", "One of the seats is already taken")
+		case errors.Is(err, service.ErrSeatLimitExceeded):
+			ctx.Error(err)
+			dto.Conflict(ctx, "SEAT_LIMIT_EXCEEDED", fmt.Sprintf("You can reserve at most %d seats for a showtime", h.App.Config.MaxSeatsPerUser))
 		default:
 			ctx.Error(err)
 			dto.InternalServerError(ctx, "Failed to create reservation")
@@ -65,7 +81,15 @@ func (h *ReservationHandler) CreateReservation(ctx *gin.Context) {
 		return
 	}
 
-	dto.SuccessWithMessage(ctx, http.StatusCreated, nil, "Reservation created successfully")
+	dto.SuccessWithMessage(ctx, http.StatusCreated, hold, "Seats held, pay the order before it expires")
+}
+
+// writeOrphanSeatError tells which seats the selection would isolate and which seats to pick instead
+func writeOrphanSeatError(ctx *gin.Context, err *service.OrphanSeatError) {
+	dto.ConflictWithDetails(ctx, "ORPHAN_SEAT", "The selection would leave a single seat isolated", gin.H{
+		"orphan_seats": err.OrphanSeats,
+		"alternatives": err.Alternatives,
+	})
 }
 
 // @route GET /reservations/me
@@ -132,12 +156,126 @@ func (h *ReservationHandler) CancelReservation(ctx *gin.Context) {
 	}
 
 	// Cancel the reservation
-	err = h.App.ReservationService.CancelReservation(uint(reservationID))
+	refund, err := h.App.ReservationService.CancelReservation(uint(reservationID))
+	if err != nil {
+		ctx.Error(err)
+		switch {
+		case errors.Is(err, service.ErrReservationNotActive):
+			dto.Conflict(ctx, "RESERVATION_NOT_ACTIVE", "Reservation is already cancelled or expired")
+		case errors.Is(err, service.ErrShowtimeStarted):
+			dto.Conflict(ctx, "SHOWTIME_STARTED", "The showtime has already started")
+		case errors.Is(err, service.ErrOrderRefunding):
+			dto.Conflict(ctx, "ORDER_REFUNDING", "The order of the reservation is being refunded")
+		default:
+			dto.InternalServerError(ctx, "Failed to cancel reservation")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, refund, "Reservation cancelled successfully")
+}
+
+type JoinWaitlistRequest struct {
+	ShowtimeID uint `json:"showtime_id" binding:"required"`
+	Seats      int  `json:"seats" binding:"required,min=1"`
+}
+
+// @route POST /waitlist
+// Only for showtimes without enough free seats. When seats are freed, they are held for the first waiting
+// user in a pending order, which must be paid before it expires or the seats go to the next user.
+func (h *ReservationHandler) JoinWaitlist(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	var req JoinWaitlistRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	entry, err := h.App.ReservationService.JoinWaitlist(userID, req.ShowtimeID, req.Seats)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrShowtimeNotExist):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Showtime not found")
+		case errors.Is(err, service.ErrShowtimeStarted):
+			ctx.Error(err)
+			dto.Conflict(ctx, "SHOWTIME_STARTED", "The showtime has already started")
+		case errors.Is(err, service.ErrTicketsAvailable):
+			ctx.Error(err)
+			dto.Conflict(ctx, "TICKETS_AVAILABLE", "Enough tickets are available, reserve them instead")
+		case errors.Is(err, service.ErrAlreadyOnWaitlist):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ALREADY_ON_WAITLIST", "You are already on the waitlist of this showtime")
+		case errors.Is(err, service.ErrSeatLimitExceeded):
+			ctx.Error(err)
+			dto.BadRequest(ctx, fmt.Sprintf("You can wait for at most %d seats", h.App.Config.MaxSeatsPerUser))
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to join the waitlist")
+		}
+		return
+	}
+
+	dto.Success(ctx, http.StatusCreated, entry)
+}
+
+// @route GET /waitlist/me
+func (h *ReservationHandler) GetMyWaitlist(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+
+	entries, err := h.App.ReservationService.GetWaitlistByUserID(userID)
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve the waitlist")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, entries)
+}
+
+// @route DELETE /waitlist/:id
+func (h *ReservationHandler) LeaveWaitlist(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
 	if err != nil {
 		ctx.Error(err)
-		dto.InternalServerError(ctx, "Failed to cancel reservation")
+		dto.BadRequest(ctx, "Invalid waitlist entry id")
+		return
+	}
+
+	err = h.App.ReservationService.LeaveWaitlist(userID, uint(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Waitlist entry not found")
+		case errors.Is(err, service.ErrWaitlistEntryNotOpen):
+			ctx.Error(err)
+			dto.Conflict(ctx, "WAITLIST_ENTRY_NOT_OPEN", "The entry is no longer waiting")
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to leave the waitlist")
+		}
 		return
 	}
 
-	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Reservation cancelled successfully")
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Left the waitlist")
 }
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type RoleHandler struct {
+	App *app.App
+}
+
+func NewRoleHandler(app *app.App) *RoleHandler {
+	return &RoleHandler{
+		App: app,
+	}
+}
+
+// @route GET /roles
+func (h *RoleHandler) GetRoles(ctx *gin.Context) {
+	roles, err := h.App.RoleService.GetRoles()
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve roles")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, roles)
+}
+
+// @route GET /roles/permissions
+func (h *RoleHandler) GetPermissions(ctx *gin.Context) {
+	dto.Success(ctx, http.StatusOK, model.Permissions)
+}
+
+type SaveRoleRequest struct {
+	Description string   `json:"description" binding:"max=255"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+// @route PUT /roles/:name
+// Creates the role or replaces its description and permissions
+func (h *RoleHandler) SaveRole(ctx *gin.Context) {
+	name := model.UserRole(ctx.Param("name"))
+
+	var req SaveRoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	role, err := h.App.RoleService.SaveRole(name, req.Description, req.Permissions)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidRoleName), errors.Is(err, service.ErrInvalidPermission):
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+		case errors.Is(err, service.ErrBuiltinRole):
+			ctx.Error(err)
+			dto.Forbidden(ctx, err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to save role")
+		}
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, role)
+}
+
+// @route DELETE /roles/:name
+func (h *RoleHandler) DeleteRole(ctx *gin.Context) {
+	name := model.UserRole(ctx.Param("name"))
+
+	if err := h.App.RoleService.DeleteRole(name); err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Role not exists")
+		case errors.Is(err, service.ErrBuiltinRole):
+			ctx.Error(err)
+			dto.Forbidden(ctx, err.Error())
+		case errors.Is(err, service.ErrRoleInUse):
+			ctx.Error(err)
+			dto.Conflict(ctx, "ROLE_IN_USE", err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to delete role")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Role deleted")
+}
+
+type AssignRoleRequest struct {
+	Role model.UserRole `json:"role" binding:"required"`
+}
+
+// @route PUT /users/:id/role
+func (h *RoleHandler) AssignRole(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid user id")
+		return
+	}
+
+	var req AssignRoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	if err := h.App.RoleService.AssignRole(uint(id), req.Role); err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "User not exists")
+		case errors.Is(err, service.ErrUnknownRole):
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+		case errors.Is(err, service.ErrLastAdmin):
+			ctx.Error(err)
+			dto.Conflict(ctx, "LAST_ADMIN", err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to assign role")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Role assigned")
+}
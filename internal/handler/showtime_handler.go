@@ -2,8 +2,11 @@ package handler
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +30,8 @@ type CreateShowtimeRequest struct {
 	MovieID uint      `json:"movie_id" binding:"required"`
 	StartAt time.Time `json:"start_at" binding:"required"`
 	HallID  uint      `json:"hall_id" binding:"required"`
+	// BasePrice is in cents
+	BasePrice int64 `json:"base_price" binding:"min=0"`
 }
 
 // @route GET /showtimes/
@@ -50,16 +55,144 @@ func (h *ShowtimeHandler) CreateShowtime(ctx *gin.Context) {
 		return
 	}
 
-	err := h.App.ShowtimeService.CreateShowtime(req.MovieID, req.StartAt, req.HallID)
+	err := h.App.ShowtimeService.CreateShowtime(req.MovieID, req.StartAt, req.HallID, req.BasePrice)
 	if err != nil {
 		ctx.Error(err)
-		dto.InternalServerError(ctx, "Failed to create showtime")
+		if !writeSchedulingError(ctx, err) {
+			dto.InternalServerError(ctx, "Failed to create showtime")
+		}
 		return
 	}
 
 	dto.SuccessWithMessage(ctx, http.StatusCreated, nil, "Showtime created successfully")
 }
 
+// writeSchedulingError writes the response for the errors of scheduling a showtime into a hall,
+// it reports false when err is none of them
+func writeSchedulingError(ctx *gin.Context, err error) bool {
+	var conflictErr *service.ShowtimeConflictError
+	switch {
+	case errors.As(err, &conflictErr):
+		dto.ConflictWithDetails(ctx, "SHOWTIME_CONFLICT", "The hall is already used by other showtimes at that time",
+			service.ShowtimeSlots(conflictErr.Conflicts))
+	case errors.Is(err, service.ErrMovieRuntimeMissing):
+		dto.BadRequest(ctx, "The movie runtime must be set before scheduling it")
+	case errors.Is(err, service.ErrNotFound):
+		dto.NotFound(ctx, "Movie or hall not exists")
+	default:
+		return false
+	}
+	return true
+}
+
+type BulkCreateShowtimesRequest struct {
+	MovieID uint   `json:"movie_id" binding:"required"`
+	HallIDs []uint `json:"hall_ids" binding:"required,min=1"`
+	// Days are lowercase short weekday names ("mon".."sun"), every day when empty
+	Days []string `json:"days"`
+	// Times are "15:04" wall clock times in Timezone
+	Times []string `json:"times" binding:"required,min=1"`
+	// From and Until are inclusive "2006-01-02" dates
+	From     string `json:"from" binding:"required"`
+	Until    string `json:"until" binding:"required"`
+	Timezone string `json:"timezone"`
+	// BasePrice is in cents
+	BasePrice int64 `json:"base_price" binding:"min=0"`
+	DryRun    bool  `json:"dry_run"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// toRule parses the request into a recurrence rule, the timezone defaults to UTC
+func (req *BulkCreateShowtimesRequest) toRule() (*service.RecurrenceRule, error) {
+	location := time.UTC
+	if req.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(req.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	from, err := time.ParseInLocation(time.DateOnly, req.From, location)
+	if err != nil {
+		return nil, err
+	}
+	until, err := time.ParseInLocation(time.DateOnly, req.Until, location)
+	if err != nil {
+		return nil, err
+	}
+	rule := &service.RecurrenceRule{
+		MovieID:   req.MovieID,
+		HallIDs:   req.HallIDs,
+		From:      from,
+		Until:     until,
+		Location:  location,
+		BasePrice: req.BasePrice,
+	}
+	for _, day := range req.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		rule.Weekdays = append(rule.Weekdays, weekday)
+	}
+	for _, clock := range req.Times {
+		t, err := time.Parse("15:04", clock)
+		if err != nil {
+			return nil, err
+		}
+		rule.Times = append(rule.Times, service.ClockTime{Hour: t.Hour(), Minute: t.Minute()})
+	}
+	return rule, nil
+}
+
+// @route POST /showtimes/bulk
+func (h *ShowtimeHandler) BulkCreateShowtimes(ctx *gin.Context) {
+	var req BulkCreateShowtimesRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+	rule, err := req.toRule()
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid recurrence rule")
+		return
+	}
+
+	schedule, err := h.App.ShowtimeService.ScheduleShowtimes(rule, req.DryRun)
+	if err != nil {
+		ctx.Error(err)
+		switch {
+		case errors.Is(err, service.ErrShowtimeConflict):
+			dto.ConflictWithDetails(ctx, "SHOWTIME_CONFLICT", "Some showtimes clash with others, nothing was created", schedule)
+		case errors.Is(err, service.ErrInvalidRecurrence), errors.Is(err, service.ErrInvalidPrice):
+			dto.BadRequest(ctx, "Invalid recurrence rule")
+		case errors.Is(err, service.ErrRecurrenceTooLarge):
+			dto.BadRequest(ctx, "The recurrence rule expands into too many showtimes")
+		default:
+			if !writeSchedulingError(ctx, err) {
+				dto.InternalServerError(ctx, "Failed to create showtimes")
+			}
+		}
+		return
+	}
+
+	if req.DryRun {
+		dto.Success(ctx, http.StatusOK, schedule)
+		return
+	}
+	dto.Success(ctx, http.StatusCreated, schedule)
+}
+
 type UpdateShowtimeRequest struct {
 	StartAt time.Time `json:"start_at"`
 	HallID  uint      `json:"hall_id"`
@@ -89,19 +222,69 @@ func (h *ShowtimeHandler) UpdateShowtime(ctx *gin.Context) {
 		return
 	}
 
-	err = h.App.ShowtimeService.UpdateShowtime(uint(id), req.StartAt, req.HallID)
+	update, err := h.App.ShowtimeService.UpdateShowtime(uint(id), req.StartAt, req.HallID)
 	if err != nil {
 		if errors.Is(err, service.ErrNotFound) {
 			ctx.Error(err)
 			dto.NotFound(ctx, "Showtime not exists")
 			return
 		}
+		if errors.Is(err, service.ErrShowtimeStarted) {
+			ctx.Error(err)
+			dto.Conflict(ctx, "SHOWTIME_STARTED", "The showtime has already started")
+			return
+		}
+		if errors.Is(err, service.ErrOrderRefunding) {
+			ctx.Error(err)
+			dto.Conflict(ctx, "ORDER_REFUNDING", "An order of the showtime is being refunded, try again shortly")
+			return
+		}
 		ctx.Error(err)
-		dto.InternalServerError(ctx, "Failed to update showtime")
+		if !writeSchedulingError(ctx, err) {
+			dto.InternalServerError(ctx, "Failed to update showtime")
+		}
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, update, "Showtime updated successfully")
+}
+
+type UpdateShowtimePriceRequest struct {
+	// BasePrice is in cents
+	BasePrice *int64 `json:"base_price" binding:"required,min=0"`
+}
+
+// @route PUT /showtimes/:id/price
+// Only affects reservations made afterwards, existing ones keep their price
+func (h *ShowtimeHandler) UpdateShowtimePrice(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid showtime id")
+		return
+	}
+
+	var req UpdateShowtimePriceRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	err = h.App.PricingService.SetShowtimeBasePrice(uint(id), *req.BasePrice)
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Showtime not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to update showtime price")
 		return
 	}
 
-	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Showtime updated successfully")
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Showtime price updated successfully")
 }
 
 // @route DELETE /showtimes/:id
@@ -174,3 +357,212 @@ func (h *ShowtimeHandler) GetShowtimeAvailability(ctx *gin.Context) {
 	}
 	dto.Success(ctx, http.StatusOK, gin.H{"remaining_tickets": remainingTickets})
 }
+
+// @route GET /showtimes/:id/seats
+func (h *ShowtimeHandler) GetShowtimeSeats(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid showtime id")
+		return
+	}
+	seatMap, err := h.App.ShowtimeService.GetSeatMap(uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Showtime not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to get showtime seats")
+		return
+	}
+	dto.Success(ctx, http.StatusOK, seatMap)
+}
+
+// interval of the keep-alive comments sent on idle seat streams
+const seatStreamHeartbeat = 30 * time.Second
+
+// @route GET /showtimes/:id/seats/stream
+// Server-Sent Events: a "seat" event is pushed for every seat status change of the showtime
+func (h *ShowtimeHandler) StreamShowtimeSeats(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid showtime id")
+		return
+	}
+	if _, err := h.App.ShowtimeService.GetShowtimeByID(uint(id)); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Showtime not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to get showtime")
+		return
+	}
+
+	events, err := h.App.ShowtimeSeatService.SubscribeSeatStatus(ctx.Request.Context(), uint(id))
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to subscribe to seat status")
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+
+	heartbeat := time.NewTicker(seatStreamHeartbeat)
+	defer heartbeat.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent("seat", event)
+			return true
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+			return true
+		}
+	})
+}
+
+// @route POST /showtimes/:id/seats/:seat_id/block
+func (h *ShowtimeHandler) BlockShowtimeSeat(ctx *gin.Context) {
+	h.setShowtimeSeatBlocked(ctx, true)
+}
+
+// @route DELETE /showtimes/:id/seats/:seat_id/block
+func (h *ShowtimeHandler) UnblockShowtimeSeat(ctx *gin.Context) {
+	h.setShowtimeSeatBlocked(ctx, false)
+}
+
+func (h *ShowtimeHandler) setShowtimeSeatBlocked(ctx *gin.Context, blocked bool) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid showtime id")
+		return
+	}
+	seatIDParam := ctx.Param("seat_id")
+	seatID, err := strconv.ParseUint(seatIDParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid seat id")
+		return
+	}
+
+	err = h.App.ShowtimeService.SetShowtimeSeatBlocked(uint(id), uint(seatID), blocked)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Seat not exists in the showtime")
+		case errors.Is(err, service.ErrSeatUnavailable):
+			ctx.Error(err)
+			dto.Conflict(ctx, "SEAT_UNAVAILABLE", "The seat is reserved or already blocked")
+		case errors.Is(err, service.ErrSeatNotBlocked):
+			ctx.Error(err)
+			dto.Conflict(ctx, "SEAT_NOT_BLOCKED", "The seat is not blocked")
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to update seat")
+		}
+		return
+	}
+
+	if blocked {
+		dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Seat blocked successfully")
+		return
+	}
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Seat unblocked successfully")
+}
+
+// @route POST /showtimes/:id/best-available?count=N&hold=true
+// Finds the best count seats, preferring adjacent seats in one row near the center of the hall.
+// With hold=true the seats are also reserved for the user like POST /reservations does.
+func (h *ShowtimeHandler) GetBestAvailableSeats(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid showtime id")
+		return
+	}
+	count, err := strconv.Atoi(ctx.Query("count"))
+	if err != nil || count < 1 {
+		if err != nil {
+			ctx.Error(err)
+		}
+		dto.BadRequest(ctx, "count must be a positive number")
+		return
+	}
+	if count > h.App.Config.MaxSeatsPerUser {
+		dto.BadRequest(ctx, fmt.Sprintf("count must be at most %d", h.App.Config.MaxSeatsPerUser))
+		return
+	}
+	hold := false
+	if holdParam := ctx.Query("hold"); holdParam != "" {
+		hold, err = strconv.ParseBool(holdParam)
+		if err != nil {
+			ctx.Error(err)
+			dto.BadRequest(ctx, "Invalid hold")
+			return
+		}
+	}
+
+	if !hold {
+		recommendation, err := h.App.ShowtimeService.RecommendSeats(uint(id), count)
+		if err != nil {
+			h.writeBestAvailableError(ctx, err)
+			return
+		}
+		dto.Success(ctx, http.StatusOK, gin.H{"recommendation": recommendation})
+		return
+	}
+
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+	recommendation, seatHold, err := h.App.ReservationService.ReserveBestAvailable(userID, uint(id), count)
+	if err != nil {
+		h.writeBestAvailableError(ctx, err)
+		return
+	}
+	dto.SuccessWithMessage(ctx, http.StatusCreated, gin.H{
+		"recommendation": recommendation,
+		"hold":           seatHold,
+	}, "Seats held, pay the order before it expires")
+}
+
+func (h *ShowtimeHandler) writeBestAvailableError(ctx *gin.Context, err error) {
+	ctx.Error(err)
+	var orphanErr *service.OrphanSeatError
+	switch {
+	case errors.As(err, &orphanErr):
+		writeOrphanSeatError(ctx, orphanErr)
+	case errors.Is(err, service.ErrNotFound), errors.Is(err, service.ErrShowtimeNotExist):
+		dto.NotFound(ctx, "Showtime not exists")
+	case errors.Is(err, service.ErrNoTicketsAvailable):
+		dto.Conflict(ctx, "NO_TICKETS", "Not enough seats available")
+	case errors.Is(err, service.ErrSeatUnavailable):
+		dto.Conflict(ctx, "SEAT_UNAVAILABLE", "One of the seats is already taken")
+	case errors.Is(err, service.ErrSeatLimitExceeded):
+		dto.Conflict(ctx, "SEAT_LIMIT_EXCEEDED", fmt.Sprintf("You can reserve at most %d seats for a showtime", h.App.Config.MaxSeatsPerUser))
+	default:
+		dto.InternalServerError(ctx, "Failed to find the best available seats")
+	}
+}
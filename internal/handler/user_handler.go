@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/qs-lzh/movie-reservation/internal/app"
 	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/middleware"
 	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/security"
 	"github.com/qs-lzh/movie-reservation/internal/service"
 )
 
@@ -27,6 +30,7 @@ type RegisterRequest struct {
 	UserName          string         `json:"username" binding:"required"`
 	Password          string         `json:"password" binding:"required"`
 	Role              model.UserRole `json:"user_role" binding:"required"`
+	Email             string         `json:"email" binding:"omitempty,email"`
 	CacheKey          string         `json:"key" binding:"required"`
 	AdminRolePassword string         `json:"admin_role_password"`
 }
@@ -51,6 +55,12 @@ func (h *AuthHandler) Register(ctx *gin.Context) {
 		return
 	}
 
+	// the staff roles are assigned by an admin, only customers and admins can register
+	if req.Role != model.RoleUser && req.Role != model.RoleAdmin {
+		dto.BadRequest(ctx, "Invalid request body: user_role must be user or admin")
+		return
+	}
+
 	// If the user want to register an admin account, need admin-role-password
 	if req.Role == model.RoleAdmin {
 		if req.AdminRolePassword == "" {
@@ -65,7 +75,7 @@ func (h *AuthHandler) Register(ctx *gin.Context) {
 		}
 	}
 
-	if err := h.App.UserService.CreateUser(req.UserName, req.Password, req.Role); err != nil {
+	if err := h.App.UserService.CreateUser(req.UserName, req.Password, req.Email, req.Role); err != nil {
 		if errors.Is(err, service.ErrAlreadyExists) {
 			ctx.Error(err)
 			dto.Conflict(ctx, "USER_CONFLICTS", fmt.Sprintf("User named %s already exists", req.UserName))
@@ -104,14 +114,22 @@ func (h *AuthHandler) Login(ctx *gin.Context) {
 		dto.Unauthorized(ctx, "Captcha not passed")
 		return
 	}
-	tokenStr, err := h.App.AuthService.Login(req.UserName, req.Password, req.CacheKey)
+	tokens, err := h.App.AuthService.Login(req.UserName, req.Password, req.CacheKey)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredential) {
+			ctx.Error(err)
+			dto.Unauthorized(ctx, "Wrong username or password")
+			return
+		}
 		ctx.Error(err)
 		dto.InternalServerError(ctx, "Failed to login")
 		return
 	}
-	// change the parameter secure to true when deploy
-	ctx.SetCookie("jwt", tokenStr, 3600, "/", "", false, true)
+	if err := h.setTokenCookies(ctx, tokens); err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to set token cookies")
+		return
+	}
 
 	// Get user role to return in response
 	userRole, err := h.App.UserService.GetUserRoleByName(req.UserName)
@@ -125,10 +143,107 @@ func (h *AuthHandler) Login(ctx *gin.Context) {
 		"status":   "Login successfully",
 		"username": req.UserName,
 		"role":     userRole,
+		"tokens":   tokens,
 	})
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// @route POST /users/refresh
+// The refresh token is read from the body, or else from the refresh_token cookie
+func (h *AuthHandler) Refresh(ctx *gin.Context) {
+	var req RefreshRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.Error(err)
+			dto.BadRequest(ctx, "Invalid request body")
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		req.RefreshToken, _ = ctx.Cookie(middleware.RefreshTokenCookie)
+	}
+	if req.RefreshToken == "" {
+		dto.Unauthorized(ctx, "Missing refresh token")
+		return
+	}
+
+	tokens, err := h.App.AuthService.Refresh(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidRefreshToken) || errors.Is(err, service.ErrRefreshTokenReused) {
+			ctx.Error(err)
+			h.clearTokenCookies(ctx)
+			dto.Unauthorized(ctx, err.Error())
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to refresh tokens")
+		return
+	}
+	if err := h.setTokenCookies(ctx, tokens); err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to set token cookies")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, tokens)
+}
+
+// @route POST /users/logout
+// Ends the session of the request tokens, it succeeds even without a valid token
 func (h *AuthHandler) Logout(ctx *gin.Context) {
-	ctx.SetCookie("jwt", "", -1, "/", "", false, true)
+	refreshToken, _ := ctx.Cookie(middleware.RefreshTokenCookie)
+	if err := h.App.AuthService.Logout(middleware.AccessToken(ctx), refreshToken); err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to logout")
+		return
+	}
+	h.clearTokenCookies(ctx)
 	dto.Success(ctx, http.StatusOK, "Logged out successfully")
 }
+
+// @route POST /users/logout-all
+// Ends every session of the user, on every device
+func (h *AuthHandler) LogoutAll(ctx *gin.Context) {
+	userID, err := getUserIDFromContext(ctx)
+	if err != nil {
+		ctx.Error(err)
+		dto.Unauthorized(ctx, "User not authenticated")
+		return
+	}
+	if err := h.App.AuthService.LogoutAll(userID); err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to logout from all devices")
+		return
+	}
+	h.clearTokenCookies(ctx)
+	dto.Success(ctx, http.StatusOK, "Logged out from all devices successfully")
+}
+
+// setTokenCookies hands the tokens to browsers, the refresh token cookie is only sent to /users.
+// The CSRF token lives as long as the session, it is readable by the page to echo it in the X-CSRF-Token header.
+func (h *AuthHandler) setTokenCookies(ctx *gin.Context, tokens *service.TokenPair) error {
+	csrfToken, err := security.NewTokenID()
+	if err != nil {
+		return err
+	}
+	secure := h.App.Config.CookieSecure
+	ctx.SetSameSite(h.App.Config.CookieSameSite)
+	ctx.SetCookie(middleware.AccessTokenCookie, tokens.AccessToken, int(time.Until(tokens.AccessTokenExpiresAt).Seconds()),
+		"/", "", secure, true)
+	ctx.SetCookie(middleware.RefreshTokenCookie, tokens.RefreshToken, int(time.Until(tokens.RefreshTokenExpiresAt).Seconds()),
+		"/users", "", secure, true)
+	ctx.SetCookie(middleware.CSRFTokenCookie, csrfToken, int(time.Until(tokens.RefreshTokenExpiresAt).Seconds()),
+		"/", "", secure, false)
+	return nil
+}
+
+func (h *AuthHandler) clearTokenCookies(ctx *gin.Context) {
+	secure := h.App.Config.CookieSecure
+	ctx.SetSameSite(h.App.Config.CookieSameSite)
+	ctx.SetCookie(middleware.AccessTokenCookie, "", -1, "/", "", secure, true)
+	ctx.SetCookie(middleware.RefreshTokenCookie, "", -1, "/users", "", secure, true)
+	ctx.SetCookie(middleware.CSRFTokenCookie, "", -1, "/", "", secure, false)
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/movie-reservation/internal/app"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+type WebhookHandler struct {
+	App *app.App
+}
+
+func NewWebhookHandler(app *app.App) *WebhookHandler {
+	return &WebhookHandler{
+		App: app,
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL        string   `json:"url" binding:"required"`
+	EventTypes []string `json:"event_types" binding:"required"`
+	// Secret is generated when it is omitted
+	Secret string `json:"secret"`
+}
+
+// @route POST /webhooks
+// The secret is only returned in this response
+func (h *WebhookHandler) CreateWebhook(ctx *gin.Context) {
+	var req CreateWebhookRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	subscription, err := h.App.WebhookService.CreateEndpoint(req.URL, req.EventTypes, req.Secret)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidWebhookURL) || errors.Is(err, service.ErrInvalidWebhookEventType) {
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to create webhook")
+		return
+	}
+
+	dto.Success(ctx, http.StatusCreated, subscription)
+}
+
+// @route GET /webhooks
+func (h *WebhookHandler) GetWebhooks(ctx *gin.Context) {
+	subscriptions, err := h.App.WebhookService.GetEndpoints()
+	if err != nil {
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve webhooks")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, subscriptions)
+}
+
+type UpdateWebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+// @route PUT /webhooks/:id
+// Setting active to true enables an endpoint that was disabled after failing persistently
+func (h *WebhookHandler) UpdateWebhook(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid webhook id")
+		return
+	}
+
+	var req UpdateWebhookRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid request body")
+		return
+	}
+
+	subscription, err := h.App.WebhookService.UpdateEndpoint(uint(id), req.URL, req.EventTypes, req.Active)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrNotFound):
+			ctx.Error(err)
+			dto.NotFound(ctx, "Webhook not exists")
+		case errors.Is(err, service.ErrInvalidWebhookURL), errors.Is(err, service.ErrInvalidWebhookEventType):
+			ctx.Error(err)
+			dto.BadRequest(ctx, err.Error())
+		default:
+			ctx.Error(err)
+			dto.InternalServerError(ctx, "Failed to update webhook")
+		}
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, subscription)
+}
+
+// @route DELETE /webhooks/:id
+func (h *WebhookHandler) DeleteWebhook(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid webhook id")
+		return
+	}
+
+	if err := h.App.WebhookService.DeleteEndpoint(uint(id)); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Webhook not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to delete webhook")
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusOK, nil, "Webhook deleted successfully")
+}
+
+// @route GET /webhooks/:id/deliveries
+func (h *WebhookHandler) GetWebhookDeliveries(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid webhook id")
+		return
+	}
+
+	deliveries, err := h.App.WebhookService.GetDeliveries(uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Webhook not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	dto.Success(ctx, http.StatusOK, deliveries)
+}
+
+// @route POST /webhooks/deliveries/:id/replay
+func (h *WebhookHandler) ReplayWebhookDelivery(ctx *gin.Context) {
+	idParam := ctx.Param("id")
+	id, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		ctx.Error(err)
+		dto.BadRequest(ctx, "Invalid delivery id")
+		return
+	}
+
+	delivery, err := h.App.WebhookService.ReplayDelivery(uint(id))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.Error(err)
+			dto.NotFound(ctx, "Delivery not exists")
+			return
+		}
+		ctx.Error(err)
+		dto.InternalServerError(ctx, "Failed to replay webhook delivery")
+		return
+	}
+
+	dto.SuccessWithMessage(ctx, http.StatusAccepted, delivery, "Delivery scheduled for replay")
+}
@@ -2,40 +2,101 @@ package middleware
 
 import (
 	"errors"
+	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/qs-lzh/movie-reservation/internal/dto"
 	"github.com/qs-lzh/movie-reservation/internal/security"
+	"github.com/qs-lzh/movie-reservation/internal/service"
 )
 
-func RequireAuth() gin.HandlerFunc {
+// cookies set by the login
+const (
+	AccessTokenCookie  = "jwt"
+	RefreshTokenCookie = "refresh_token"
+)
+
+// the auth sources recorded in the request context as "auth_source"
+const (
+	AuthSourceCookie = "cookie"
+	AuthSourceBearer = "bearer"
+	AuthSourceAPIKey = "api_key"
+)
+
+// AccessToken returns the access token of the request, from the Authorization bearer header
+// or else from the cookie, empty when there is none
+func AccessToken(c *gin.Context) string {
+	token, _ := bearerOrCookieToken(c)
+	return token
+}
+
+// bearerOrCookieToken returns the token of the request and where it came from
+func bearerOrCookieToken(c *gin.Context) (token, source string) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(token)
+		if strings.HasPrefix(token, service.APIKeyPrefix) {
+			return token, AuthSourceAPIKey
+		}
+		return token, AuthSourceBearer
+	}
+	token, _ = c.Cookie(AccessTokenCookie)
+	return token, AuthSourceCookie
+}
+
+// RequireAuth accepts an access token, or an API key with the scope of one of the resources:
+// "<resource>:read" for GET and HEAD requests and "<resource>:write" for the others.
+// API keys are rejected on routes without resources, such as the admin routes and the key management itself.
+func RequireAuth(authService service.AuthService, resources ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenStr, err := c.Cookie("jwt")
-		if err != nil {
-			dto.Unauthorized(c, "Failed to get jwt token from cookie")
+		tokenStr, source := bearerOrCookieToken(c)
+		if tokenStr == "" {
+			dto.Unauthorized(c, "Missing access token")
+			c.Abort()
 			return
 		}
-		claims, err := security.VerifyToken(tokenStr)
+		principal, err := authService.Authenticate(tokenStr)
 		if err != nil {
-			if errors.Is(err, security.ErrInvalidToken) {
+			if errors.Is(err, security.ErrInvalidToken) || errors.Is(err, security.ErrInvalidClaim) ||
+				errors.Is(err, service.ErrInvalidAPIKey) {
 				dto.Unauthorized(c, "Invalid token")
+				c.Abort()
 				return
 			}
+			c.Error(err)
 			dto.InternalServerError(c, "Failed to verify token")
+			c.Abort()
 			return
 		}
+		c.Set("auth_source", source)
 
-		// Extract user_id from claims and convert from float64 to uint
-		userIDFloat, ok := claims["user_id"].(float64)
-		if !ok {
-			dto.InternalServerError(c, "Invalid user_id in token")
-			return
+		if principal.APIKeyID != 0 {
+			c.Set("api_key_id", principal.APIKeyID)
+			if !hasScope(principal.Scopes, c.Request.Method, resources) {
+				dto.Forbidden(c, "API key not permitted to use")
+				c.Abort()
+				return
+			}
 		}
-		userID := uint(userIDFloat)
 
-		c.Set("user_id", userID)
-		c.Set("user_role", claims["user_role"])
+		c.Set("user_id", principal.UserID)
+		c.Set("user_role", string(principal.Role))
 
 		c.Next()
 	}
 }
+
+// hasScope reports whether the scopes allow the method on one of the resources
+func hasScope(scopes []string, method string, resources []string) bool {
+	access := "write"
+	if method == http.MethodGet || method == http.MethodHead {
+		access = "read"
+	}
+	for _, resource := range resources {
+		if slices.Contains(scopes, resource+":"+access) {
+			return true
+		}
+	}
+	return false
+}
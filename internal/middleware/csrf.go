@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+)
+
+// the double-submit CSRF token, set as a cookie readable by the page which echoes it in the header
+const (
+	CSRFTokenCookie = "csrf_token"
+	CSRFTokenHeader = "X-CSRF-Token"
+)
+
+// RequireCSRF rejects the state-changing requests authenticated by cookie whose X-CSRF-Token header
+// doesn't match the csrf_token cookie. Another site can make the browser send the cookies, but can't read them.
+// Requests authenticated by a Bearer token or API key are exempt, browsers never add those on their own,
+// but any other Authorization header still needs the CSRF token since the cookie is what authenticates it.
+func RequireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if token, source := bearerOrCookieToken(c); (token != "" && source != AuthSourceCookie) || !hasAuthCookie(c) {
+			c.Next()
+			return
+		}
+
+		cookieToken, _ := c.Cookie(CSRFTokenCookie)
+		headerToken := c.GetHeader(CSRFTokenHeader)
+		if cookieToken == "" || subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+			dto.Forbidden(c, "Invalid CSRF token")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func hasAuthCookie(c *gin.Context) bool {
+	for _, name := range []string{AccessTokenCookie, RefreshTokenCookie} {
+		if token, err := c.Cookie(name); err == nil && token != "" {
+			return true
+		}
+	}
+	return false
+}
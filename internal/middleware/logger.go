@@ -26,6 +26,8 @@ func ZapLogger(zapLogger *zap.Logger) gin.HandlerFunc {
 			zap.String("user_agent", c.Request.UserAgent()),
 			zap.Duration("latency", cost),
 			zap.Int("size", c.Writer.Size()),
+			zap.String("auth_source", c.GetString("auth_source")),
+			zap.Uint("user_id", c.GetUint("user_id")),
 		)
 	}
 }
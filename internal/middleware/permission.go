@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/qs-lzh/movie-reservation/internal/dto"
+	"github.com/qs-lzh/movie-reservation/internal/service"
+)
+
+// RequirePermission lets the request through when the current role of the user grants every one of the permissions,
+// it goes after RequireAuth. API keys are rejected, the staff routes need the user to log in.
+func RequirePermission(roleService service.RoleService, permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key_id"); ok {
+			dto.Forbidden(c, "API key not permitted to use")
+			c.Abort()
+			return
+		}
+		userID, ok := c.Get("user_id")
+		if !ok {
+			dto.InternalServerError(c, "Failed to get user id from claims")
+			c.Abort()
+			return
+		}
+		allowed, err := roleService.HasPermission(userID.(uint), permissions...)
+		if err != nil {
+			c.Error(err)
+			dto.InternalServerError(c, "Failed to check permissions")
+			c.Abort()
+			return
+		}
+		if !allowed {
+			dto.Forbidden(c, "Not permitted to use")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
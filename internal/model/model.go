@@ -9,55 +9,383 @@ type User struct {
 	Name           string   `gorm:"size:64;not null;uniqueIndex"`
 	HashedPassword string   `gorm:"not null"`
 	Role           UserRole `gorm:"type:varchar(16);not null"`
+	// Email is where email notifications are sent, users without one only get the other channels
+	Email string `gorm:"size:254"`
 }
 
+// UserRole names a Role, it decides the permissions of the user
 type UserRole string
 
 const (
 	RoleUser  UserRole = "user"
 	RoleAdmin UserRole = "admin"
+	// staff roles, created on the first start
+	RoleBoxOffice UserRole = "box_office"
+	RoleScheduler UserRole = "scheduler"
+	RoleFinance   UserRole = "finance"
+	RoleSupport   UserRole = "support"
 )
 
+// the permissions a role can grant
+const (
+	PermMovieWrite        = "movie:write"
+	PermShowtimeWrite     = "showtime:write"
+	PermHallWrite         = "hall:write"
+	PermReservationRefund = "reservation:refund"
+	PermReportRead        = "report:read"
+	PermWebhookManage     = "webhook:manage"
+	PermRoleManage        = "role:manage"
+)
+
+// Permissions lists every permission, the admin role always has all of them
+var Permissions = []string{
+	PermMovieWrite,
+	PermShowtimeWrite,
+	PermHallWrite,
+	PermReservationRefund,
+	PermReportRead,
+	PermWebhookManage,
+	PermRoleManage,
+}
+
+// Role maps a role name to the permissions it grants
+type Role struct {
+	Name        UserRole `gorm:"primaryKey;type:varchar(16)"`
+	Description string   `gorm:"size:255"`
+	Permissions string   `gorm:"type:text;not null"` // comma separated
+}
+
 type Movie struct {
 	ID          uint   `gorm:"primaryKey"`
 	Title       string `gorm:"size:100;not null;uniqueIndex"`
 	Description string `gorm:"type:text"`
+	// RuntimeMinutes is how long the movie plays, it decides how long a showtime occupies its hall
+	RuntimeMinutes int `gorm:"not null;default:0"`
 }
 
 type Showtime struct {
 	ID      uint      `gorm:"primaryKey"`
 	MovieID uint      `gorm:"not null;index"`
-	HallID  uint      `gorm:"not null;index"`
-	StartAt time.Time `gorm:"not null"`
+	HallID  uint      `gorm:"not null;index;index:idx_showtime_hall_period"`
+	StartAt time.Time `gorm:"not null;index:idx_showtime_hall_period"`
+	// EndAt is StartAt plus the movie runtime and the cleaning buffer, fixed when the showtime is scheduled
+	EndAt time.Time `gorm:"index:idx_showtime_hall_period"`
+	// BasePrice is in cents, the price of a seat is BasePrice times the multiplier of its class
+	BasePrice int64 `gorm:"not null;default:0"`
 
 	Movie Movie `gorm:"foreignKey:MovieID"`
 	Hall  Hall  `gorm:"foreignKey:HallID"`
 }
 
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"
+	ReservationCancelled ReservationStatus = "cancelled"
+	ReservationExpired   ReservationStatus = "expired"
+)
+
+// Reservation rows are never deleted, cancelled and expired ones are kept for the audit trail,
+// so only an active reservation holds its seat
 type Reservation struct {
-	ID         uint `gorm:"primaryKey"`
-	ShowtimeID uint `gorm:"not null;index;uniqueIndex:idx_unique_ticket"`
-	SeatID     uint `gorm:"not null;index;uniqueIndex:idx_unique_ticket"`
-	UserID     uint `gorm:"not null;index"`
+	ID         uint  `gorm:"primaryKey"`
+	ShowtimeID uint  `gorm:"not null;index;uniqueIndex:idx_active_ticket,where:status = 'active'"`
+	SeatID     uint  `gorm:"not null;index;uniqueIndex:idx_active_ticket"`
+	UserID     uint  `gorm:"not null;index"`
+	OrderID    *uint `gorm:"index"`
+	// Price is snapshotted in cents at booking time, later price changes don't affect it
+	Price       int64             `gorm:"not null;default:0"`
+	Status      ReservationStatus `gorm:"type:varchar(16);not null;default:active;index"`
+	CancelledAt *time.Time
 
 	Showtime Showtime `gorm:"foreignKey:ShowtimeID"`
 	Seat     Seat     `gorm:"foreignKey:SeatID"`
 	User     User     `gorm:"foreignKey:UserID"`
 }
 
+type OrderStatus string
+
+const (
+	OrderPending OrderStatus = "pending"
+	OrderPaid    OrderStatus = "paid"
+	// OrderRefunding is a paid order whose refund was requested from the provider, it stays so until the
+	// provider confirms, so a second refund can't be paid out meanwhile
+	OrderRefunding OrderStatus = "refunding"
+	OrderRefunded  OrderStatus = "refunded"
+	OrderExpired   OrderStatus = "expired"
+	// OrderCancelled is a pending order whose reservations were all cancelled before paying
+	OrderCancelled OrderStatus = "cancelled"
+)
+
+// Order groups the reservations booked together and paid at once,
+// its seats stay locked while it is pending and become sold once it is paid
+type Order struct {
+	ID     uint        `gorm:"primaryKey" json:"id"`
+	UserID uint        `gorm:"not null;index" json:"user_id"`
+	Status OrderStatus `gorm:"type:varchar(16);not null;index" json:"status"`
+	// Amount is in cents
+	Amount int64 `gorm:"not null" json:"amount"`
+	// RefundedAmount is the part of Amount given back by cancellations, in cents
+	RefundedAmount int64      `gorm:"not null;default:0" json:"refunded_amount"`
+	PaymentRef     string     `gorm:"size:128;index" json:"payment_ref,omitempty"`
+	ExpiresAt      time.Time  `gorm:"not null;index" json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	PaidAt         *time.Time `json:"paid_at,omitempty"`
+
+	User         User          `gorm:"foreignKey:UserID" json:"-"`
+	Reservations []Reservation `gorm:"foreignKey:OrderID" json:"reservations,omitempty"`
+}
+
+type RefundStatus string
+
+const (
+	// RefundPending refunds are paid out by the refund worker after the cancellation commits
+	RefundPending RefundStatus = "pending"
+	// RefundProcessing refunds are being paid out, one left so by a crash is checked against the provider
+	// by hand rather than paid out twice
+	RefundProcessing RefundStatus = "processing"
+	RefundSucceeded  RefundStatus = "succeeded"
+)
+
+// Refund records the money given back for a cancelled reservation
+type Refund struct {
+	ID            uint  `gorm:"primaryKey" json:"id"`
+	ReservationID uint  `gorm:"not null;index" json:"reservation_id"`
+	OrderID       *uint `gorm:"index" json:"order_id,omitempty"`
+	UserID        uint  `gorm:"not null;index" json:"user_id"`
+	// Percent is the share of the reservation price the cancellation policy allowed
+	Percent int `gorm:"not null" json:"percent"`
+	// Amount is in cents, it is 0 when the order was never paid
+	Amount int64 `gorm:"not null" json:"amount"`
+	// the refunds made before the worker existed were paid out at once
+	Status RefundStatus `gorm:"type:varchar(16);not null;default:succeeded;index:idx_refund_due,priority:1" json:"status"`
+	// PaymentRef is the payment of the order the amount is given back from
+	PaymentRef    string    `gorm:"size:128" json:"-"`
+	NextAttemptAt time.Time `gorm:"index:idx_refund_due,priority:2" json:"-"`
+	Attempts      int       `gorm:"not null;default:0" json:"-"`
+	LastError     string    `gorm:"type:text" json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	Reservation Reservation `gorm:"foreignKey:ReservationID" json:"-"`
+}
+
+type WaitlistStatus string
+
+const (
+	WaitlistWaiting WaitlistStatus = "waiting"
+	// WaitlistOffered entries have seats held for them until OfferExpiresAt
+	WaitlistOffered WaitlistStatus = "offered"
+	// WaitlistAccepted entries paid the order of their offer
+	WaitlistAccepted WaitlistStatus = "accepted"
+	// WaitlistExpired entries let their offer lapse or their showtime started before any offer
+	WaitlistExpired WaitlistStatus = "expired"
+	WaitlistLeft    WaitlistStatus = "left"
+)
+
+// WaitlistEntry queues a user for seats of a sold-out showtime, entries are served first come first served
+type WaitlistEntry struct {
+	ID         uint `gorm:"primaryKey" json:"id"`
+	ShowtimeID uint `gorm:"not null;index;uniqueIndex:idx_open_waitlist_entry,where:status = 'waiting' OR status = 'offered'" json:"showtime_id"`
+	UserID     uint `gorm:"not null;index;uniqueIndex:idx_open_waitlist_entry" json:"user_id"`
+	// Seats is how many seats the user waits for, they are offered together
+	Seats  int            `gorm:"not null;check:seats > 0" json:"seats"`
+	Status WaitlistStatus `gorm:"type:varchar(16);not null;default:waiting;index" json:"status"`
+	// OrderID is the pending order holding the offered seats
+	OrderID        *uint      `gorm:"index" json:"order_id,omitempty"`
+	OfferExpiresAt *time.Time `json:"offer_expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+
+	Showtime Showtime `gorm:"foreignKey:ShowtimeID;constraint:OnDelete:CASCADE" json:"-"`
+	User     User     `gorm:"foreignKey:UserID" json:"-"`
+}
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	// OutboxFailed messages ran out of delivery attempts
+	OutboxFailed OutboxStatus = "failed"
+)
+
+// OutboxMessage is a notification waiting to be delivered through one channel, it is written in the
+// transaction of the change it reports, so it only exists once that change is committed
+type OutboxMessage struct {
+	ID      uint         `gorm:"primaryKey"`
+	Channel string       `gorm:"size:32;not null"`
+	UserID  uint         `gorm:"not null;index"`
+	Subject string       `gorm:"size:255;not null"`
+	Body    string       `gorm:"type:text;not null"`
+	Status  OutboxStatus `gorm:"type:varchar(16);not null;default:pending;index:idx_outbox_due,priority:1"`
+	// NextAttemptAt is when the worker delivers (or retries) the message
+	NextAttemptAt time.Time `gorm:"not null;index:idx_outbox_due,priority:2"`
+	Attempts      int       `gorm:"not null;default:0"`
+	LastError     string    `gorm:"type:text"`
+	SentAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// InboxMessage is a notification shown to the user in the app
+type InboxMessage struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	Subject   string     `gorm:"size:255;not null" json:"subject"`
+	Body      string     `gorm:"type:text;not null" json:"body"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// WebhookEndpoint is a partner URL subscribed to some event types, the payloads are signed with its Secret
+type WebhookEndpoint struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	URL    string `gorm:"size:2048;not null" json:"url"`
+	Secret string `gorm:"size:128;not null" json:"-"`
+	// EventTypes is the comma separated list of the subscribed event types, e.g. "reservation.created,showtime.rescheduled"
+	EventTypes string `gorm:"type:text;not null" json:"-"`
+	// Active endpoints receive deliveries, an endpoint failing persistently is disabled until an admin enables it again
+	Active bool `gorm:"not null;default:true" json:"active"`
+	// ConsecutiveFailures counts the failed attempts since the last successful one
+	ConsecutiveFailures int        `gorm:"not null;default:0" json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	// WebhookDeliveryFailed deliveries ran out of attempts, they can still be replayed
+	WebhookDeliveryFailed WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery is one event sent to one endpoint, the rows are kept as the delivery log
+type WebhookDelivery struct {
+	ID         uint `gorm:"primaryKey" json:"id"`
+	EndpointID uint `gorm:"not null;index" json:"endpoint_id"`
+	// EventID identifies the event across retries and replays
+	EventID   string                `gorm:"size:64;not null;index" json:"event_id"`
+	EventType string                `gorm:"size:64;not null" json:"event_type"`
+	Payload   string                `gorm:"type:text;not null" json:"payload"`
+	Status    WebhookDeliveryStatus `gorm:"type:varchar(16);not null;default:pending;index:idx_webhook_delivery_due,priority:1" json:"status"`
+	// NextAttemptAt is when the worker delivers (or retries) the event
+	NextAttemptAt time.Time `gorm:"not null;index:idx_webhook_delivery_due,priority:2" json:"next_attempt_at"`
+	Attempts      int       `gorm:"not null;default:0" json:"attempts"`
+	// ResponseStatus is the HTTP status of the last attempt, 0 when the endpoint didn't answer
+	ResponseStatus int        `gorm:"not null;default:0" json:"response_status"`
+	LastError      string     `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	// ReplayOf is the delivery this one was replayed from
+	ReplayOf  *uint     `json:"replay_of,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Endpoint WebhookEndpoint `gorm:"foreignKey:EndpointID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// APIKey is a long-lived personal token for scripts and apps acting as its user,
+// only the SHA-256 of the key is stored so a leaked table doesn't leak the keys
+type APIKey struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"not null;index" json:"user_id"`
+	Name   string `gorm:"size:64;not null" json:"name"`
+	// Prefix is the start of the key, shown so users can tell their keys apart
+	Prefix    string `gorm:"size:16;not null" json:"prefix"`
+	HashedKey string `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	// Scopes is the comma separated list of the granted scopes, e.g. "reservations:read,orders:read"
+	Scopes     string     `gorm:"type:text;not null" json:"-"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// SigningKey is a key pair signing the access tokens, identified in the tokens by its ID (the kid header).
+// The newest key whose ActivatesAt has passed signs, older keys only verify during the grace period after
+// their successor activates, so the tokens they signed stay valid until they expire.
+type SigningKey struct {
+	ID        string `gorm:"primaryKey;size:64"`
+	Algorithm string `gorm:"size:16;not null"`
+	// PrivateKey is PKCS #8 PEM, the database must be protected like any other secret store
+	PrivateKey  string    `gorm:"type:text;not null"`
+	ActivatesAt time.Time `gorm:"not null;index"`
+	CreatedAt   time.Time
+}
+
+// PaymentEvent records every processed payment webhook so redeliveries are ignored
+type PaymentEvent struct {
+	ID      string `gorm:"primaryKey;size:128"`
+	OrderID uint   `gorm:"not null;index"`
+	Type    string `gorm:"size:32;not null"`
+	// Mismatch is why the event left its order unchanged, e.g. a capture arriving after the order expired
+	Mismatch   string `gorm:"type:text"`
+	ReceivedAt time.Time
+}
+
 type Hall struct {
 	ID        uint   `gorm:"primaryKey"`
 	Name      string `gorm:"size:64;not null;uniqueIndex"`
 	SeatCount int    `gorm:"not null"`
 	Rows      int    `gorm:"not null;check:rows > 0"`
 	Cols      int    `gorm:"not null;check:cols > 0"`
+	// Layout is the layout document the seats were created from, empty for a plain Rows x Cols hall
+	Layout      string          `gorm:"type:text"`
+	LabelScheme SeatLabelScheme `gorm:"embedded;embeddedPrefix:label_"`
+	// PreventOrphanSeats rejects reservations that would leave a single available seat isolated in a row
+	PreventOrphanSeats bool `gorm:"not null;default:false"`
+}
+
+// SeatLabelScheme decides how the seats of a hall are labelled, e.g. "F7" is the 7th seat of row F
+type SeatLabelScheme struct {
+	// SkipIO leaves I and O out of the row letters, they are easily mistaken for 1 and 0
+	SkipIO bool `gorm:"not null;default:false" json:"skip_io"`
+	// RightToLeft numbers the seats of a row from the right
+	RightToLeft bool `gorm:"not null;default:false" json:"right_to_left"`
 }
 
 type Seat struct {
 	ID     uint `gorm:"primaryKey" json:"id"`
-	HallID uint `gorm:"not null;index;uniqueIndex:idx_hall_row_col" json:"hall_id"`
+	HallID uint `gorm:"not null;index;uniqueIndex:idx_hall_row_col;uniqueIndex:idx_hall_label" json:"hall_id"`
 	Row    int  `gorm:"not null;uniqueIndex:idx_hall_row_col;check:row>0" json:"row"`
 	Col    int  `gorm:"not null;uniqueIndex:idx_hall_row_col;check:col>0" json:"col"`
+	// Label is the name printed on the seat, e.g. "B12", unique in the hall
+	Label string    `gorm:"size:16;uniqueIndex:idx_hall_label" json:"label"`
+	Class SeatClass `gorm:"type:varchar(16);not null;default:standard" json:"class"`
+	// OutOfService seats are blocked in every showtime created while the flag is set
+	OutOfService bool `gorm:"not null;default:false" json:"out_of_service"`
+
+	Hall Hall `gorm:"foreignKey:HallID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+type SeatClass string
+
+const (
+	SeatClassStandard   SeatClass = "standard"
+	SeatClassPremium    SeatClass = "premium"
+	SeatClassAccessible SeatClass = "accessible"
+	SeatClassCouple     SeatClass = "couple"
+)
+
+var SeatClasses = []SeatClass{SeatClassStandard, SeatClassPremium, SeatClassAccessible, SeatClassCouple}
+
+func (c SeatClass) Valid() bool {
+	for _, class := range SeatClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// SeatClassPrice is the price multiplier of a seat class in a hall,
+// a class without SeatClassPrice costs exactly the showtime base price
+type SeatClassPrice struct {
+	HallID     uint      `gorm:"primaryKey" json:"hall_id"`
+	Class      SeatClass `gorm:"primaryKey;type:varchar(16)" json:"class"`
+	Multiplier float64   `gorm:"not null;check:multiplier > 0" json:"multiplier"`
 
 	Hall Hall `gorm:"foreignKey:HallID;constraint:OnDelete:CASCADE" json:"-"`
 }
@@ -68,6 +396,8 @@ const (
 	StatusAvailable ShowtimeSeatStatus = "available"
 	StatusLocked    ShowtimeSeatStatus = "locked"
 	StatusSold      ShowtimeSeatStatus = "sold"
+	// StatusBlocked is a seat taken out of sale, e.g. because it is broken
+	StatusBlocked ShowtimeSeatStatus = "blocked"
 )
 
 type ShowtimeSeat struct {
@@ -75,6 +405,9 @@ type ShowtimeSeat struct {
 	ShowtimeID uint               `gorm:"not null;index;uniqueIndex:idx_showtime_seat"`
 	SeatID     uint               `gorm:"not null;index;uniqueIndex:idx_showtime_seat"`
 	Status     ShowtimeSeatStatus `gorm:"type:varchar(16);not null"`
+	// LockedBy and LockedUntil are only set while the seat is held (StatusLocked)
+	LockedBy    *uint
+	LockedUntil *time.Time `gorm:"index"`
 
 	Showtime Showtime `gorm:"foreignKey:ShowtimeID;constraint:OnDelete:CASCADE"`
 	Seat     Seat     `gorm:"foreignKey:SeatID;constraint:OnDelete:CASCADE"`
@@ -0,0 +1,29 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// InboxNotifier stores notifications as in-app messages the user reads through the API
+type InboxNotifier struct {
+	inboxRepo repository.InboxRepo
+}
+
+var _ Notifier = (*InboxNotifier)(nil)
+
+func NewInboxNotifier(inboxRepo repository.InboxRepo) *InboxNotifier {
+	return &InboxNotifier{
+		inboxRepo: inboxRepo,
+	}
+}
+
+func (n *InboxNotifier) Notify(ctx context.Context, notification Notification) error {
+	return n.inboxRepo.Create(&model.InboxMessage{
+		UserID:  notification.UserID,
+		Subject: notification.Subject,
+		Body:    notification.Body,
+	})
+}
@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// LogNotifier writes notifications to the log instead of delivering them,
+// it stands in for the external channels when neither email nor webhook is configured
+type LogNotifier struct {
+	logger *zap.Logger
+}
+
+var _ Notifier = (*LogNotifier)(nil)
+
+func NewLogNotifier(logger *zap.Logger) *LogNotifier {
+	return &LogNotifier{
+		logger: logger,
+	}
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.logger.Info("notification",
+		zap.Uint("user_id", notification.UserID),
+		zap.String("subject", notification.Subject),
+		zap.String("body", notification.Body),
+	)
+	return nil
+}
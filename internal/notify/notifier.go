@@ -0,0 +1,17 @@
+package notify
+
+import (
+	"context"
+)
+
+// Notification is a message for one user
+type Notification struct {
+	UserID  uint
+	Subject string
+	Body    string
+}
+
+// Notifier delivers notifications to users
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// SMTPNotifier emails notifications to the address of the user, users without an email are skipped.
+// Any SMTP server works, e.g. a local fake server catching the mails during development.
+type SMTPNotifier struct {
+	addr  string
+	from  string
+	auth  smtp.Auth
+	users repository.UserRepo
+}
+
+var _ Notifier = (*SMTPNotifier)(nil)
+
+// NewSMTPNotifier sends through the server at addr ("host:port"), it only authenticates when username is set
+func NewSMTPNotifier(addr, from, username, password string, users repository.UserRepo) *SMTPNotifier {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPNotifier{
+		addr:  addr,
+		from:  from,
+		auth:  auth,
+		users: users,
+	}
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, notification Notification) error {
+	user, err := n.users.GetByID(notification.UserID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	// header values must stay on one line
+	headerValue := strings.NewReplacer("\r", " ", "\n", " ")
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.from, user.Email, headerValue.Replace(notification.Subject), notification.Body)
+	return n.sendMail(ctx, user.Email, []byte(message))
+}
+
+// sendMail does what smtp.SendMail does, but gives up once ctx is done instead of waiting on a stuck server
+func (n *SMTPNotifier) sendMail(ctx context.Context, to string, message []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// a cancelled ctx without a deadline unblocks the exchange by closing the connection
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(n.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if err := client.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// fakeUserRepo serves the users of a map, the other methods aren't used by the notifier
+type fakeUserRepo struct {
+	repository.UserRepo
+	users map[uint]*model.User
+}
+
+func (r *fakeUserRepo) GetByID(id uint) (*model.User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	return user, nil
+}
+
+// smtpMail is what the fake server received for one mail
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// startFakeSMTPServer accepts SMTP sessions on a local port and sends every received mail to the channel
+func startFakeSMTPServer(t *testing.T) (string, <-chan smtpMail) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	mails := make(chan smtpMail, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- smtpMail) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 fake ESMTP")
+	var mail smtpMail
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "MAIL":
+			mail.from = strings.TrimPrefix(command, "MAIL FROM:")
+			reply("250 OK")
+		case "RCPT":
+			mail.to = append(mail.to, strings.TrimPrefix(command, "RCPT TO:"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail.data = data.String()
+			mails <- mail
+			mail = smtpMail{}
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func TestSMTPNotifierSendsMail(t *testing.T) {
+	addr, mails := startFakeSMTPServer(t)
+	users := &fakeUserRepo{users: map[uint]*model.User{
+		1: {ID: 1, Email: "alice@example.com"},
+	}}
+	notifier := NewSMTPNotifier(addr, "cinema@example.com", "", "", users)
+
+	err := notifier.Notify(context.Background(), Notification{
+		UserID:  1,
+		Subject: "Seats held\r\nBcc: mallory@example.com",
+		Body:    "Your seats are held for 10 minutes",
+	})
+	if err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	select {
+	case mail := <-mails:
+		if mail.from != "<cinema@example.com>" {
+			t.Errorf("from = %q, want <cinema@example.com>", mail.from)
+		}
+		if len(mail.to) != 1 || mail.to[0] != "<alice@example.com>" {
+			t.Errorf("to = %q, want [<alice@example.com>]", mail.to)
+		}
+		if !strings.Contains(mail.data, "Subject: Seats held  Bcc: mallory@example.com\r\n") {
+			t.Errorf("the subject is not kept on one line:\n%s", mail.data)
+		}
+		if !strings.Contains(mail.data, "Your seats are held for 10 minutes") {
+			t.Errorf("the body is missing:\n%s", mail.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server received no mail")
+	}
+}
+
+func TestSMTPNotifierSkipsUsersWithoutEmail(t *testing.T) {
+	addr, mails := startFakeSMTPServer(t)
+	users := &fakeUserRepo{users: map[uint]*model.User{
+		1: {ID: 1},
+	}}
+	notifier := NewSMTPNotifier(addr, "cinema@example.com", "", "", users)
+
+	if err := notifier.Notify(context.Background(), Notification{UserID: 1, Subject: "Hi"}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	select {
+	case mail := <-mails:
+		t.Fatalf("the server received a mail to %q", mail.to)
+	default:
+	}
+}
+
+func TestSMTPNotifierGivesUpWhenTheContextIsDone(t *testing.T) {
+	// a server accepting connections but never greeting the client
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	users := &fakeUserRepo{users: map[uint]*model.User{
+		1: {ID: 1, Email: "alice@example.com"},
+	}}
+	notifier := NewSMTPNotifier(listener.Addr().String(), "cinema@example.com", "", "", users)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- notifier.Notify(ctx, Notification{UserID: 1, Subject: "Hi"})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Notify() succeeded against a silent server")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify() ignored the deadline of its context")
+	}
+}
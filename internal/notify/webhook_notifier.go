@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookNotifier posts every notification as JSON to a fixed URL, e.g. a push or chat gateway
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+var _ Notifier = (*WebhookNotifier)(nil)
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type webhookPayload struct {
+	UserID  uint   `json:"user_id"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	payload, err := json.Marshal(webhookPayload{
+		UserID:  notification.UserID,
+		Subject: notification.Subject,
+		Body:    notification.Body,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook answered %s", resp.Status)
+	}
+	return nil
+}
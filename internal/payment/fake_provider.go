@@ -0,0 +1,110 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// FakeProvider is an in-process PaymentProvider for development and tests,
+// it accepts every payment unless Decline is set
+type FakeProvider struct {
+	secret []byte
+
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	nextID   int
+	// Decline makes Authorize fail like a declined card
+	Decline bool
+}
+
+type fakePayment struct {
+	orderID  uint
+	amount   int64
+	captured bool
+	refunded int64
+}
+
+var _ PaymentProvider = (*FakeProvider)(nil)
+
+func NewFakeProvider(webhookSecret string) *FakeProvider {
+	return &FakeProvider{
+		secret:   []byte(webhookSecret),
+		payments: make(map[string]*fakePayment),
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, orderID uint, amount int64) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Decline {
+		return "", ErrPaymentDeclined
+	}
+	p.nextID++
+	reference := fmt.Sprintf("fake_%d", p.nextID)
+	p.payments[reference] = &fakePayment{
+		orderID: orderID,
+		amount:  amount,
+	}
+	return reference, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, reference string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[reference]
+	if !ok {
+		return ErrUnknownPayment
+	}
+	payment.captured = true
+	return nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, reference string, amount int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, ok := p.payments[reference]
+	if !ok {
+		return ErrUnknownPayment
+	}
+	if !payment.captured {
+		return errors.New("payment not captured")
+	}
+	if payment.refunded+amount > payment.amount {
+		return errors.New("refund exceeds the captured amount")
+	}
+	payment.refunded += amount
+	return nil
+}
+
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (*WebhookEvent, error) {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, p.sign(payload)) {
+		return nil, ErrInvalidSignature
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// SignWebhook returns the signature the provider would send along the payload
+func (p *FakeProvider) SignWebhook(payload []byte) string {
+	return hex.EncodeToString(p.sign(payload))
+}
+
+func (p *FakeProvider) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,43 @@
+package payment
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrPaymentDeclined  = errors.New("payment declined")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrUnknownPayment   = errors.New("unknown payment reference")
+)
+
+// PaymentProvider is implemented by every payment gateway, amounts are in cents
+type PaymentProvider interface {
+	Name() string
+	// Authorize reserves the amount on the customer's payment method and returns the payment reference
+	Authorize(ctx context.Context, orderID uint, amount int64) (reference string, err error)
+	// Capture collects a previously authorized payment
+	Capture(ctx context.Context, reference string) error
+	// Refund gives back part or all of a captured payment
+	Refund(ctx context.Context, reference string, amount int64) error
+	// VerifyWebhook checks the signature of a webhook payload and decodes it
+	VerifyWebhook(payload []byte, signature string) (*WebhookEvent, error)
+}
+
+type WebhookEventType string
+
+const (
+	EventPaymentCaptured WebhookEventType = "payment.captured"
+	EventPaymentFailed   WebhookEventType = "payment.failed"
+	EventPaymentRefunded WebhookEventType = "payment.refunded"
+)
+
+// WebhookEvent is sent by the provider when a payment changes asynchronously,
+// ID is unique per event so redelivered webhooks can be recognized
+type WebhookEvent struct {
+	ID        string           `json:"id"`
+	Type      WebhookEventType `json:"type"`
+	Reference string           `json:"reference"`
+	// Amount is the captured or refunded amount in cents
+	Amount int64 `json:"amount"`
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type APIKeyRepo interface {
+	WithTx(tx *gorm.DB) APIKeyRepo
+	Create(key *model.APIKey) error
+	GetByID(id uint) (*model.APIKey, error)
+	// GetByHashedKey returns the key with its User loaded
+	GetByHashedKey(hashedKey string) (*model.APIKey, error)
+	// GetByUserID returns the keys of the user, newest first
+	GetByUserID(userID uint) ([]model.APIKey, error)
+	UpdateRevokedAt(id uint, revokedAt time.Time) error
+	UpdateLastUsedAt(id uint, lastUsedAt time.Time) error
+}
+
+type apiKeyRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ APIKeyRepo = (*apiKeyRepoGorm)(nil)
+
+func NewAPIKeyRepoGorm(db *gorm.DB) *apiKeyRepoGorm {
+	return &apiKeyRepoGorm{
+		db: db,
+	}
+}
+
+func (r *apiKeyRepoGorm) WithTx(tx *gorm.DB) APIKeyRepo {
+	return &apiKeyRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *apiKeyRepoGorm) Create(key *model.APIKey) error {
+	ctx := context.Background()
+	if err := gorm.G[model.APIKey](r.db).Create(ctx, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *apiKeyRepoGorm) GetByID(id uint) (*model.APIKey, error) {
+	ctx := context.Background()
+	key, err := gorm.G[model.APIKey](r.db).Where(&model.APIKey{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *apiKeyRepoGorm) GetByHashedKey(hashedKey string) (*model.APIKey, error) {
+	ctx := context.Background()
+	key, err := gorm.G[model.APIKey](r.db).Preload("User", nil).Where(&model.APIKey{HashedKey: hashedKey}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *apiKeyRepoGorm) GetByUserID(userID uint) ([]model.APIKey, error) {
+	ctx := context.Background()
+	keys, err := gorm.G[model.APIKey](r.db).Where(&model.APIKey{UserID: userID}).Order("id DESC").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *apiKeyRepoGorm) UpdateRevokedAt(id uint, revokedAt time.Time) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.APIKey](r.db).Where(&model.APIKey{ID: id}).Update(ctx, "revoked_at", revokedAt); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *apiKeyRepoGorm) UpdateLastUsedAt(id uint, lastUsedAt time.Time) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.APIKey](r.db).Where(&model.APIKey{ID: id}).Update(ctx, "last_used_at", lastUsedAt); err != nil {
+		return err
+	}
+	return nil
+}
@@ -5,16 +5,20 @@ import (
 
 	"github.com/qs-lzh/movie-reservation/internal/model"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type HallRepo interface {
 	WithTx(tx *gorm.DB) HallRepo
 	Create(hall *model.Hall) error
 	GetByID(id uint) (*model.Hall, error)
+	// GetByIDForUpdate locks the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.Hall, error)
 	GetByName(name string) (*model.Hall, error)
 	DeleteByID(id uint) error
 	ListAll() ([]model.Hall, error)
 	Update(*model.Hall) error
+	UpdatePreventOrphanSeats(id uint, preventOrphanSeats bool) error
 }
 
 type hallRepoGorm struct {
@@ -53,6 +57,16 @@ func (r *hallRepoGorm) GetByID(id uint) (*model.Hall, error) {
 	return &hall, nil
 }
 
+func (r *hallRepoGorm) GetByIDForUpdate(id uint) (*model.Hall, error) {
+	ctx := context.Background()
+	hall, err := gorm.G[model.Hall](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.Hall{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &hall, nil
+}
+
 func (r *hallRepoGorm) GetByName(name string) (*model.Hall, error) {
 	ctx := context.Background()
 	hall, err := gorm.G[model.Hall](r.db).Where(&model.Hall{Name: name}).First(ctx)
@@ -83,7 +97,18 @@ func (r *hallRepoGorm) ListAll() ([]model.Hall, error) {
 // before use Update, please confirm the existance of the hall
 func (r *hallRepoGorm) Update(hall *model.Hall) error {
 	ctx := context.Background()
-	if _, err := gorm.G[model.Hall](r.db).Updates(ctx, *hall); err != nil {
+	if _, err := gorm.G[model.Hall](r.db).Where(&model.Hall{ID: hall.ID}).
+		Select("Name", "SeatCount", "Rows", "Cols", "Layout", "label_skip_io", "label_right_to_left",
+			"PreventOrphanSeats").Updates(ctx, *hall); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *hallRepoGorm) UpdatePreventOrphanSeats(id uint, preventOrphanSeats bool) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Hall](r.db).Where(&model.Hall{ID: id}).
+		Update(ctx, "prevent_orphan_seats", preventOrphanSeats); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type InboxRepo interface {
+	WithTx(tx *gorm.DB) InboxRepo
+	Create(message *model.InboxMessage) error
+	GetByID(id uint) (*model.InboxMessage, error)
+	// GetByUserID returns the messages of the user, newest first
+	GetByUserID(userID uint) ([]model.InboxMessage, error)
+	UpdateReadAt(id uint, readAt time.Time) error
+}
+
+type inboxRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ InboxRepo = (*inboxRepoGorm)(nil)
+
+func NewInboxRepoGorm(db *gorm.DB) *inboxRepoGorm {
+	return &inboxRepoGorm{
+		db: db,
+	}
+}
+
+func (r *inboxRepoGorm) WithTx(tx *gorm.DB) InboxRepo {
+	return &inboxRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *inboxRepoGorm) Create(message *model.InboxMessage) error {
+	ctx := context.Background()
+	if err := gorm.G[model.InboxMessage](r.db).Create(ctx, message); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *inboxRepoGorm) GetByID(id uint) (*model.InboxMessage, error) {
+	ctx := context.Background()
+	message, err := gorm.G[model.InboxMessage](r.db).Where(&model.InboxMessage{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (r *inboxRepoGorm) GetByUserID(userID uint) ([]model.InboxMessage, error) {
+	ctx := context.Background()
+	messages, err := gorm.G[model.InboxMessage](r.db).Where(&model.InboxMessage{UserID: userID}).Order("id DESC").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (r *inboxRepoGorm) UpdateReadAt(id uint, readAt time.Time) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.InboxMessage](r.db).Where(&model.InboxMessage{ID: id}).Update(ctx, "read_at", readAt); err != nil {
+		return err
+	}
+	return nil
+}
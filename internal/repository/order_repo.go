@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type OrderRepo interface {
+	WithTx(tx *gorm.DB) OrderRepo
+	Create(order *model.Order) error
+	// GetByID also loads the reservations of the order
+	GetByID(id uint) (*model.Order, error)
+	// GetByIDForUpdate locks the order row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.Order, error)
+	GetByPaymentRef(paymentRef string) (*model.Order, error)
+	GetByUserID(userID uint) ([]model.Order, error)
+	GetExpiredPending(now time.Time) ([]model.Order, error)
+	Update(order *model.Order) error
+	// UpdatePendingPaymentRef sets the payment reference of a pending order, it reports false
+	// when the order isn't pending anymore
+	UpdatePendingPaymentRef(id uint, paymentRef string) (bool, error)
+}
+
+type orderRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ OrderRepo = (*orderRepoGorm)(nil)
+
+func NewOrderRepoGorm(db *gorm.DB) *orderRepoGorm {
+	return &orderRepoGorm{
+		db: db,
+	}
+}
+
+func (r *orderRepoGorm) WithTx(tx *gorm.DB) OrderRepo {
+	return &orderRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *orderRepoGorm) Create(order *model.Order) error {
+	ctx := context.Background()
+	if err := gorm.G[model.Order](r.db).Create(ctx, order); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *orderRepoGorm) GetByID(id uint) (*model.Order, error) {
+	ctx := context.Background()
+	order, err := gorm.G[model.Order](r.db).Preload("Reservations.Seat", nil).Where(&model.Order{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *orderRepoGorm) GetByIDForUpdate(id uint) (*model.Order, error) {
+	ctx := context.Background()
+	order, err := gorm.G[model.Order](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.Order{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *orderRepoGorm) GetByPaymentRef(paymentRef string) (*model.Order, error) {
+	ctx := context.Background()
+	order, err := gorm.G[model.Order](r.db).Where(&model.Order{PaymentRef: paymentRef}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (r *orderRepoGorm) GetByUserID(userID uint) ([]model.Order, error) {
+	ctx := context.Background()
+	orders, err := gorm.G[model.Order](r.db).Preload("Reservations.Seat", nil).Where(&model.Order{UserID: userID}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (r *orderRepoGorm) GetExpiredPending(now time.Time) ([]model.Order, error) {
+	ctx := context.Background()
+	orders, err := gorm.G[model.Order](r.db).
+		Where("status = ? AND expires_at < ?", model.OrderPending, now).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// before use Update, please confirm the existance of the order
+func (r *orderRepoGorm) Update(order *model.Order) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Order](r.db).Where(&model.Order{ID: order.ID}).
+		Select("Status", "Amount", "RefundedAmount", "PaymentRef", "PaidAt").Updates(ctx, *order); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *orderRepoGorm) UpdatePendingPaymentRef(id uint, paymentRef string) (bool, error) {
+	ctx := context.Background()
+	rows, err := gorm.G[model.Order](r.db).Where("id = ? AND status = ?", id, model.OrderPending).
+		Update(ctx, "payment_ref", paymentRef)
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
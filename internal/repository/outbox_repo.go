@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type OutboxRepo interface {
+	WithTx(tx *gorm.DB) OutboxRepo
+	Create(message *model.OutboxMessage) error
+	// GetDueForUpdate returns at most limit pending messages due at now, oldest first, and locks them until
+	// the transaction ends. Rows locked by another worker are skipped, so workers never deliver the same message.
+	GetDueForUpdate(now time.Time, limit int) ([]model.OutboxMessage, error)
+	// Update writes the delivery state of the message
+	Update(message *model.OutboxMessage) error
+}
+
+type outboxRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ OutboxRepo = (*outboxRepoGorm)(nil)
+
+func NewOutboxRepoGorm(db *gorm.DB) *outboxRepoGorm {
+	return &outboxRepoGorm{
+		db: db,
+	}
+}
+
+func (r *outboxRepoGorm) WithTx(tx *gorm.DB) OutboxRepo {
+	return &outboxRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *outboxRepoGorm) Create(message *model.OutboxMessage) error {
+	ctx := context.Background()
+	if err := gorm.G[model.OutboxMessage](r.db).Create(ctx, message); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *outboxRepoGorm) GetDueForUpdate(now time.Time, limit int) ([]model.OutboxMessage, error) {
+	ctx := context.Background()
+	messages, err := gorm.G[model.OutboxMessage](r.db,
+		clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+		Where("status = ? AND next_attempt_at <= ?", model.OutboxPending, now).
+		Order("next_attempt_at, id").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (r *outboxRepoGorm) Update(message *model.OutboxMessage) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.OutboxMessage](r.db).Where(&model.OutboxMessage{ID: message.ID}).
+		Select("Status", "NextAttemptAt", "Attempts", "LastError", "SentAt").Updates(ctx, *message); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type PaymentEventRepo interface {
+	WithTx(tx *gorm.DB) PaymentEventRepo
+	Create(event *model.PaymentEvent) error
+	GetByID(id string) (*model.PaymentEvent, error)
+}
+
+type paymentEventRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ PaymentEventRepo = (*paymentEventRepoGorm)(nil)
+
+func NewPaymentEventRepoGorm(db *gorm.DB) *paymentEventRepoGorm {
+	return &paymentEventRepoGorm{
+		db: db,
+	}
+}
+
+func (r *paymentEventRepoGorm) WithTx(tx *gorm.DB) PaymentEventRepo {
+	return &paymentEventRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *paymentEventRepoGorm) Create(event *model.PaymentEvent) error {
+	ctx := context.Background()
+	if err := gorm.G[model.PaymentEvent](r.db).Create(ctx, event); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *paymentEventRepoGorm) GetByID(id string) (*model.PaymentEvent, error) {
+	ctx := context.Background()
+	event, err := gorm.G[model.PaymentEvent](r.db).Where(&model.PaymentEvent{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
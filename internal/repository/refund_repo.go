@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type RefundRepo interface {
+	WithTx(tx *gorm.DB) RefundRepo
+	Create(refund *model.Refund) error
+	// GetDueForUpdate returns at most limit pending refunds due at now, oldest first, and locks them until
+	// the transaction ends. Rows locked by another worker are skipped.
+	GetDueForUpdate(now time.Time, limit int) ([]model.Refund, error)
+	// Update writes the payout state of the refund
+	Update(refund *model.Refund) error
+}
+
+type refundRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ RefundRepo = (*refundRepoGorm)(nil)
+
+func NewRefundRepoGorm(db *gorm.DB) *refundRepoGorm {
+	return &refundRepoGorm{
+		db: db,
+	}
+}
+
+func (r *refundRepoGorm) WithTx(tx *gorm.DB) RefundRepo {
+	return &refundRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *refundRepoGorm) Create(refund *model.Refund) error {
+	ctx := context.Background()
+	if err := gorm.G[model.Refund](r.db).Create(ctx, refund); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *refundRepoGorm) GetDueForUpdate(now time.Time, limit int) ([]model.Refund, error) {
+	ctx := context.Background()
+	refunds, err := gorm.G[model.Refund](r.db,
+		clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+		Where("status = ? AND next_attempt_at <= ?", model.RefundPending, now).
+		Order("next_attempt_at, id").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+func (r *refundRepoGorm) Update(refund *model.Refund) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Refund](r.db).Where(&model.Refund{ID: refund.ID}).
+		Select("Status", "NextAttemptAt", "Attempts", "LastError").Updates(ctx, *refund); err != nil {
+		return err
+	}
+	return nil
+}
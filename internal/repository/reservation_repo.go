@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/qs-lzh/movie-reservation/internal/model"
 )
@@ -12,9 +13,19 @@ type ReservationRepo interface {
 	WithTx(tx *gorm.DB) ReservationRepo
 	Create(reservation *model.Reservation) error
 	GetByID(id uint) (*model.Reservation, error)
+	// GetByIDForUpdate locks the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.Reservation, error)
+	// Update writes the status and cancellation time of the reservation
+	Update(reservation *model.Reservation) error
+	// UpdateSeatID moves the reservation onto another seat of the same showtime
+	UpdateSeatID(id, seatID uint) error
 	DeleteByID(id uint) error
+	// GetByUserID also loads the Seat of each reservation
 	GetByUserID(userID uint) ([]model.Reservation, error)
 	GetByShowtimeID(showtimeID uint) ([]model.Reservation, error)
+	GetByOrderID(orderID uint) ([]model.Reservation, error)
+	GetActiveByShowtimeID(showtimeID uint) ([]model.Reservation, error)
+	GetActiveByShowtimeIDSeatID(showtimeID, seatID uint) (*model.Reservation, error)
 }
 
 type reservationRepoGorm struct {
@@ -52,6 +63,33 @@ func (r *reservationRepoGorm) GetByID(id uint) (*model.Reservation, error) {
 	return &reservation, nil
 }
 
+func (r *reservationRepoGorm) GetByIDForUpdate(id uint) (*model.Reservation, error) {
+	ctx := context.Background()
+	reservation, err := gorm.G[model.Reservation](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.Reservation{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+func (r *reservationRepoGorm) Update(reservation *model.Reservation) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Reservation](r.db).Where(&model.Reservation{ID: reservation.ID}).
+		Select("Status", "CancelledAt").Updates(ctx, *reservation); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *reservationRepoGorm) UpdateSeatID(id, seatID uint) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Reservation](r.db).Where(&model.Reservation{ID: id}).Update(ctx, "seat_id", seatID); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (r *reservationRepoGorm) DeleteByID(id uint) error {
 	ctx := context.Background()
 	_, err := gorm.G[model.Reservation](r.db).Where(&model.Reservation{ID: id}).Delete(ctx)
@@ -63,7 +101,7 @@ func (r *reservationRepoGorm) DeleteByID(id uint) error {
 
 func (r *reservationRepoGorm) GetByUserID(userID uint) ([]model.Reservation, error) {
 	ctx := context.Background()
-	reservations, err := gorm.G[model.Reservation](r.db).Where(&model.Reservation{UserID: userID}).Find(ctx)
+	reservations, err := gorm.G[model.Reservation](r.db).Preload("Seat", nil).Where(&model.Reservation{UserID: userID}).Find(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -78,3 +116,32 @@ func (r *reservationRepoGorm) GetByShowtimeID(showtimeID uint) ([]model.Reservat
 	}
 	return reservations, nil
 }
+
+func (r *reservationRepoGorm) GetByOrderID(orderID uint) ([]model.Reservation, error) {
+	ctx := context.Background()
+	reservations, err := gorm.G[model.Reservation](r.db).Where(&model.Reservation{OrderID: &orderID}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+func (r *reservationRepoGorm) GetActiveByShowtimeID(showtimeID uint) ([]model.Reservation, error) {
+	ctx := context.Background()
+	reservations, err := gorm.G[model.Reservation](r.db).
+		Where(&model.Reservation{ShowtimeID: showtimeID, Status: model.ReservationActive}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+func (r *reservationRepoGorm) GetActiveByShowtimeIDSeatID(showtimeID, seatID uint) (*model.Reservation, error) {
+	ctx := context.Background()
+	reservation, err := gorm.G[model.Reservation](r.db).
+		Where(&model.Reservation{ShowtimeID: showtimeID, SeatID: seatID, Status: model.ReservationActive}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
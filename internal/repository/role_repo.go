@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type RoleRepo interface {
+	WithTx(tx *gorm.DB) RoleRepo
+	Create(role *model.Role) error
+	GetByName(name model.UserRole) (*model.Role, error)
+	ListAll() ([]model.Role, error)
+	// Update writes the description and the permissions of the role
+	Update(role *model.Role) error
+	DeleteByName(name model.UserRole) error
+}
+
+type roleRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ RoleRepo = (*roleRepoGorm)(nil)
+
+func NewRoleRepoGorm(db *gorm.DB) *roleRepoGorm {
+	return &roleRepoGorm{
+		db: db,
+	}
+}
+
+func (r *roleRepoGorm) WithTx(tx *gorm.DB) RoleRepo {
+	return &roleRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *roleRepoGorm) Create(role *model.Role) error {
+	ctx := context.Background()
+	if err := gorm.G[model.Role](r.db).Create(ctx, role); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *roleRepoGorm) GetByName(name model.UserRole) (*model.Role, error) {
+	ctx := context.Background()
+	role, err := gorm.G[model.Role](r.db).Where(&model.Role{Name: name}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (r *roleRepoGorm) ListAll() ([]model.Role, error) {
+	ctx := context.Background()
+	roles, err := gorm.G[model.Role](r.db).Order("name").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (r *roleRepoGorm) Update(role *model.Role) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Role](r.db).Where(&model.Role{Name: role.Name}).
+		Select("Description", "Permissions").Updates(ctx, *role); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *roleRepoGorm) DeleteByName(name model.UserRole) error {
+	ctx := context.Background()
+	_, err := gorm.G[model.Role](r.db).Where(&model.Role{Name: name}).Delete(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
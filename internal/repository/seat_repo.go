@@ -14,7 +14,12 @@ type SeatRepo interface {
 	CreateBatch(seats []model.Seat) error
 	GetByID(id uint) (*model.Seat, error)
 	GetByHallID(hallID uint) ([]model.Seat, error)
+	GetByHallIDLabels(hallID uint, labels []string) ([]model.Seat, error)
+	UpdateClass(id uint, class model.SeatClass) error
+	UpdateLabel(id uint, label string) error
+	UpdateOutOfService(id uint, outOfService bool) error
 	DeleteByID(id uint) error
+	DeleteByHallID(hallID uint) error
 }
 
 type seatRepoGorm struct {
@@ -62,13 +67,29 @@ func (r *seatRepoGorm) GetByID(id uint) (*model.Seat, error) {
 
 func (r *seatRepoGorm) GetByHallID(hallID uint) ([]model.Seat, error) {
 	ctx := context.Background()
-	seats, err := gorm.G[model.Seat](r.db).Where(&model.Seat{}).Find(ctx)
+	seats, err := gorm.G[model.Seat](r.db).Where(&model.Seat{HallID: hallID}).Find(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return seats, nil
 }
 
+func (r *seatRepoGorm) UpdateClass(id uint, class model.SeatClass) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Seat](r.db).Where(&model.Seat{ID: id}).Update(ctx, "class", class); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *seatRepoGorm) UpdateLabel(id uint, label string) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Seat](r.db).Where(&model.Seat{ID: id}).Update(ctx, "label", label); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (r *seatRepoGorm) DeleteByID(id uint) error {
 	ctx := context.Background()
 	_, err := gorm.G[model.Seat](r.db).Where(&model.Seat{ID: id}).Delete(ctx)
@@ -77,3 +98,28 @@ func (r *seatRepoGorm) DeleteByID(id uint) error {
 	}
 	return nil
 }
+
+func (r *seatRepoGorm) DeleteByHallID(hallID uint) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Seat](r.db).Where(&model.Seat{HallID: hallID}).Delete(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *seatRepoGorm) GetByHallIDLabels(hallID uint, labels []string) ([]model.Seat, error) {
+	ctx := context.Background()
+	seats, err := gorm.G[model.Seat](r.db).Where("hall_id = ? AND label IN ?", hallID, labels).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return seats, nil
+}
+
+func (r *seatRepoGorm) UpdateOutOfService(id uint, outOfService bool) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Seat](r.db).Where(&model.Seat{ID: id}).Update(ctx, "out_of_service", outOfService); err != nil {
+		return err
+	}
+	return nil
+}
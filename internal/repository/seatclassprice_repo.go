@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type SeatClassPriceRepo interface {
+	WithTx(tx *gorm.DB) SeatClassPriceRepo
+	// Save creates the price of the hall's seat class or overwrites its multiplier
+	Save(price *model.SeatClassPrice) error
+	GetByHallID(hallID uint) ([]model.SeatClassPrice, error)
+	GetByHallIDClass(hallID uint, class model.SeatClass) (*model.SeatClassPrice, error)
+}
+
+type seatClassPriceRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ SeatClassPriceRepo = (*seatClassPriceRepoGorm)(nil)
+
+func NewSeatClassPriceRepoGorm(db *gorm.DB) *seatClassPriceRepoGorm {
+	return &seatClassPriceRepoGorm{
+		db: db,
+	}
+}
+
+func (r *seatClassPriceRepoGorm) WithTx(tx *gorm.DB) SeatClassPriceRepo {
+	return &seatClassPriceRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *seatClassPriceRepoGorm) Save(price *model.SeatClassPrice) error {
+	ctx := context.Background()
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hall_id"}, {Name: "class"}},
+		DoUpdates: clause.AssignmentColumns([]string{"multiplier"}),
+	}
+	if err := gorm.G[model.SeatClassPrice](r.db, upsert).Create(ctx, price); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *seatClassPriceRepoGorm) GetByHallID(hallID uint) ([]model.SeatClassPrice, error) {
+	ctx := context.Background()
+	prices, err := gorm.G[model.SeatClassPrice](r.db).Where(&model.SeatClassPrice{HallID: hallID}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func (r *seatClassPriceRepoGorm) GetByHallIDClass(hallID uint, class model.SeatClass) (*model.SeatClassPrice, error) {
+	ctx := context.Background()
+	price, err := gorm.G[model.SeatClassPrice](r.db).Where(&model.SeatClassPrice{HallID: hallID, Class: class}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
@@ -2,8 +2,10 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/qs-lzh/movie-reservation/internal/model"
 )
@@ -12,11 +14,21 @@ type ShowtimeRepo interface {
 	WithTx(tx *gorm.DB) ShowtimeRepo
 	Create(showtime *model.Showtime) error
 	GetByID(id uint) (*model.Showtime, error)
+	// GetByIDForUpdate locks the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.Showtime, error)
+	// Update writes the hall and the period of the showtime
+	Update(showtime *model.Showtime) error
 	DeleteByID(id uint) error
 	GetByMovieID(movieID uint) ([]model.Showtime, error)
 	GetByHallID(hallID uint) ([]model.Showtime, error)
+	// GetUpcomingByHallID returns the showtimes of the hall starting after now
+	GetUpcomingByHallID(hallID uint, now time.Time) ([]model.Showtime, error)
 	DeleteByMovieID(movieID uint) error
 	ListAll() ([]model.Showtime, error)
+	UpdateBasePrice(id uint, basePrice int64) error
+	// GetOverlappingInHall returns the showtimes of the hall whose [StartAt, EndAt) overlaps [startAt, endAt),
+	// excludeID is left out so a showtime doesn't clash with itself when it is rescheduled
+	GetOverlappingInHall(hallID uint, startAt, endAt time.Time, excludeID uint) ([]model.Showtime, error)
 }
 
 type showtimeRepoGorm struct {
@@ -54,6 +66,25 @@ func (r *showtimeRepoGorm) GetByID(id uint) (*model.Showtime, error) {
 	return &showtime, nil
 }
 
+func (r *showtimeRepoGorm) GetByIDForUpdate(id uint) (*model.Showtime, error) {
+	ctx := context.Background()
+	showtime, err := gorm.G[model.Showtime](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.Showtime{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &showtime, nil
+}
+
+func (r *showtimeRepoGorm) Update(showtime *model.Showtime) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Showtime](r.db).Where(&model.Showtime{ID: showtime.ID}).
+		Select("HallID", "StartAt", "EndAt").Updates(ctx, *showtime); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (r *showtimeRepoGorm) DeleteByID(id uint) error {
 	ctx := context.Background()
 	_, err := gorm.G[model.Showtime](r.db).Where(&model.Showtime{ID: id}).Delete(ctx)
@@ -98,3 +129,31 @@ func (r *showtimeRepoGorm) ListAll() ([]model.Showtime, error) {
 	}
 	return showtimes, nil
 }
+
+func (r *showtimeRepoGorm) UpdateBasePrice(id uint, basePrice int64) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.Showtime](r.db).Where(&model.Showtime{ID: id}).Update(ctx, "base_price", basePrice); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *showtimeRepoGorm) GetOverlappingInHall(hallID uint, startAt, endAt time.Time, excludeID uint) ([]model.Showtime, error) {
+	ctx := context.Background()
+	showtimes, err := gorm.G[model.Showtime](r.db).
+		Where("hall_id = ? AND start_at < ? AND end_at > ? AND id <> ?", hallID, endAt, startAt, excludeID).
+		Order("start_at").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimes, nil
+}
+
+func (r *showtimeRepoGorm) GetUpcomingByHallID(hallID uint, now time.Time) ([]model.Showtime, error) {
+	ctx := context.Background()
+	showtimes, err := gorm.G[model.Showtime](r.db).Where("hall_id = ? AND start_at > ?", hallID, now).Order("start_at").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimes, nil
+}
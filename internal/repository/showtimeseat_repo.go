@@ -2,8 +2,10 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/qs-lzh/movie-reservation/internal/model"
 )
@@ -14,10 +16,24 @@ type ShowtimeSeatRepo interface {
 	CreateBatch(showtimeSeats []model.ShowtimeSeat) error
 	GetByID(id uint) (*model.ShowtimeSeat, error)
 	GetByShowtimeID(showtimeID uint) ([]model.ShowtimeSeat, error)
+	// GetByShowtimeIDWithSeat also loads the Seat of each ShowtimeSeat
+	GetByShowtimeIDWithSeat(showtimeID uint) ([]model.ShowtimeSeat, error)
+	// GetByShowtimeIDWithSeatForUpdate is GetByShowtimeIDWithSeat locking the showtimeSeat rows until the transaction ends
+	GetByShowtimeIDWithSeatForUpdate(showtimeID uint) ([]model.ShowtimeSeat, error)
 	GetBySeatID(seatID uint) ([]model.ShowtimeSeat, error)
 	GetByShowIDSeatID(showtimeID, seatID uint) (*model.ShowtimeSeat, error)
+	// GetByIDForUpdate and GetByShowIDSeatIDForUpdate lock the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.ShowtimeSeat, error)
+	GetByShowIDSeatIDForUpdate(showtimeID, seatID uint) (*model.ShowtimeSeat, error)
 	GetByStatus(status model.ShowtimeSeatStatus) ([]model.ShowtimeSeat, error)
+	CountByShowtimeIDStatus(showtimeID uint, status model.ShowtimeSeatStatus) (int64, error)
+	GetExpiredLocked(now time.Time) ([]model.ShowtimeSeat, error)
 	Update(id uint, showtimeSeat *model.ShowtimeSeat) error
+	// UpdateIfStatus only updates the row while it is still in fromStatus,
+	// it reports false when another transaction changed the status first
+	UpdateIfStatus(id uint, fromStatus model.ShowtimeSeatStatus, showtimeSeat *model.ShowtimeSeat) (bool, error)
+	// UpdateSeatID moves the showtimeSeat onto another seat, keeping its status and lock
+	UpdateSeatID(id, seatID uint) error
 	DeleteByID(id uint) error
 }
 
@@ -73,6 +89,26 @@ func (r *showtimeSeatRepoGorm) GetByShowtimeID(showtimeID uint) ([]model.Showtim
 	return showtimeSeats, nil
 }
 
+func (r *showtimeSeatRepoGorm) GetByShowtimeIDWithSeat(showtimeID uint) ([]model.ShowtimeSeat, error) {
+	ctx := context.Background()
+	showtimeSeats, err := gorm.G[model.ShowtimeSeat](r.db).Preload("Seat", nil).
+		Where(&model.ShowtimeSeat{ShowtimeID: showtimeID}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimeSeats, nil
+}
+
+func (r *showtimeSeatRepoGorm) GetByShowtimeIDWithSeatForUpdate(showtimeID uint) ([]model.ShowtimeSeat, error) {
+	ctx := context.Background()
+	showtimeSeats, err := gorm.G[model.ShowtimeSeat](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.ShowtimeSeat{ShowtimeID: showtimeID}).Preload("Seat", nil).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimeSeats, nil
+}
+
 func (r *showtimeSeatRepoGorm) GetBySeatID(seatID uint) ([]model.ShowtimeSeat, error) {
 	ctx := context.Background()
 	showtimeSeats, err := gorm.G[model.ShowtimeSeat](r.db).Where(&model.ShowtimeSeat{SeatID: seatID}).Find(ctx)
@@ -91,6 +127,26 @@ func (r *showtimeSeatRepoGorm) GetByShowIDSeatID(showtimeID, seatID uint) (*mode
 	return &showtimeSeat, nil
 }
 
+func (r *showtimeSeatRepoGorm) GetByIDForUpdate(id uint) (*model.ShowtimeSeat, error) {
+	ctx := context.Background()
+	showtimeSeat, err := gorm.G[model.ShowtimeSeat](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.ShowtimeSeat{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &showtimeSeat, nil
+}
+
+func (r *showtimeSeatRepoGorm) GetByShowIDSeatIDForUpdate(showtimeID, seatID uint) (*model.ShowtimeSeat, error) {
+	ctx := context.Background()
+	showtimeSeat, err := gorm.G[model.ShowtimeSeat](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.ShowtimeSeat{ShowtimeID: showtimeID, SeatID: seatID}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &showtimeSeat, nil
+}
+
 func (r *showtimeSeatRepoGorm) GetByStatus(status model.ShowtimeSeatStatus) ([]model.ShowtimeSeat, error) {
 	ctx := context.Background()
 	showtimeSeats, err := gorm.G[model.ShowtimeSeat](r.db).Where(&model.ShowtimeSeat{Status: status}).Find(ctx)
@@ -100,9 +156,44 @@ func (r *showtimeSeatRepoGorm) GetByStatus(status model.ShowtimeSeatStatus) ([]m
 	return showtimeSeats, nil
 }
 
+func (r *showtimeSeatRepoGorm) CountByShowtimeIDStatus(showtimeID uint, status model.ShowtimeSeatStatus) (int64, error) {
+	ctx := context.Background()
+	return gorm.G[model.ShowtimeSeat](r.db).Where(&model.ShowtimeSeat{ShowtimeID: showtimeID, Status: status}).Count(ctx, "*")
+}
+
+func (r *showtimeSeatRepoGorm) GetExpiredLocked(now time.Time) ([]model.ShowtimeSeat, error) {
+	ctx := context.Background()
+	showtimeSeats, err := gorm.G[model.ShowtimeSeat](r.db).
+		Where("status = ? AND locked_until < ?", model.StatusLocked, now).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimeSeats, nil
+}
+
+// Update writes status and lock fields, including zero values so a lock can be cleared
 func (r *showtimeSeatRepoGorm) Update(id uint, showtimeSeat *model.ShowtimeSeat) error {
 	ctx := context.Background()
-	if _, err := gorm.G[model.ShowtimeSeat](r.db).Updates(ctx, model.ShowtimeSeat{ID: id}); err != nil {
+	if _, err := gorm.G[model.ShowtimeSeat](r.db).Where(&model.ShowtimeSeat{ID: id}).
+		Select("Status", "LockedBy", "LockedUntil").Updates(ctx, *showtimeSeat); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *showtimeSeatRepoGorm) UpdateIfStatus(id uint, fromStatus model.ShowtimeSeatStatus, showtimeSeat *model.ShowtimeSeat) (bool, error) {
+	ctx := context.Background()
+	rowsAffected, err := gorm.G[model.ShowtimeSeat](r.db).Where("id = ? AND status = ?", id, fromStatus).
+		Select("Status", "LockedBy", "LockedUntil").Updates(ctx, *showtimeSeat)
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+func (r *showtimeSeatRepoGorm) UpdateSeatID(id, seatID uint) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.ShowtimeSeat](r.db).Where(&model.ShowtimeSeat{ID: id}).Update(ctx, "seat_id", seatID); err != nil {
 		return err
 	}
 	return nil
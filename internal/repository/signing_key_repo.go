@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type SigningKeyRepo interface {
+	WithTx(tx *gorm.DB) SigningKeyRepo
+	Create(key *model.SigningKey) error
+	// ListAll returns the keys by activation, oldest first
+	ListAll() ([]model.SigningKey, error)
+	DeleteByIDs(ids []string) error
+	// LockRotation serializes the key rotations of every instance until the transaction ends
+	LockRotation() error
+}
+
+type signingKeyRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ SigningKeyRepo = (*signingKeyRepoGorm)(nil)
+
+func NewSigningKeyRepoGorm(db *gorm.DB) *signingKeyRepoGorm {
+	return &signingKeyRepoGorm{
+		db: db,
+	}
+}
+
+func (r *signingKeyRepoGorm) WithTx(tx *gorm.DB) SigningKeyRepo {
+	return &signingKeyRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *signingKeyRepoGorm) Create(key *model.SigningKey) error {
+	ctx := context.Background()
+	if err := gorm.G[model.SigningKey](r.db).Create(ctx, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *signingKeyRepoGorm) ListAll() ([]model.SigningKey, error) {
+	ctx := context.Background()
+	keys, err := gorm.G[model.SigningKey](r.db).Order("activates_at, created_at").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *signingKeyRepoGorm) DeleteByIDs(ids []string) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.SigningKey](r.db).Where("id IN ?", ids).Delete(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// signingKeyRotationLock is the id of the postgres advisory lock taken by LockRotation
+const signingKeyRotationLock = 7_100_221
+
+func (r *signingKeyRepoGorm) LockRotation() error {
+	return r.db.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyRotationLock).Error
+}
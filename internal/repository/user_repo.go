@@ -12,6 +12,9 @@ type UserRepo interface {
 	Create(user *model.User) error
 	DeleteByName(name string) error
 	GetByName(name string) (*model.User, error)
+	GetByID(id uint) (*model.User, error)
+	UpdateRole(id uint, role model.UserRole) error
+	CountByRole(role model.UserRole) (int64, error)
 }
 
 type userRepoGorm struct {
@@ -58,3 +61,23 @@ func (r *userRepoGorm) GetByName(name string) (*model.User, error) {
 	}
 	return &user, nil
 }
+
+func (r *userRepoGorm) GetByID(id uint) (*model.User, error) {
+	ctx := context.Background()
+	user, err := gorm.G[model.User](r.db).Where(&model.User{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *userRepoGorm) UpdateRole(id uint, role model.UserRole) error {
+	ctx := context.Background()
+	_, err := gorm.G[model.User](r.db).Where(&model.User{ID: id}).Update(ctx, "role", role)
+	return err
+}
+
+func (r *userRepoGorm) CountByRole(role model.UserRole) (int64, error) {
+	ctx := context.Background()
+	return gorm.G[model.User](r.db).Where(&model.User{Role: role}).Count(ctx, "*")
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type WaitlistRepo interface {
+	WithTx(tx *gorm.DB) WaitlistRepo
+	Create(entry *model.WaitlistEntry) error
+	// GetByIDForUpdate locks the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.WaitlistEntry, error)
+	// GetOpenByShowtimeIDUserID returns the waiting or offered entry of the user for the showtime
+	GetOpenByShowtimeIDUserID(showtimeID, userID uint) (*model.WaitlistEntry, error)
+	// GetFirstWaitingForUpdate returns the oldest waiting entry of the showtime and locks it until the transaction ends
+	GetFirstWaitingForUpdate(showtimeID uint) (*model.WaitlistEntry, error)
+	GetByUserID(userID uint) ([]model.WaitlistEntry, error)
+	GetByStatus(status model.WaitlistStatus) ([]model.WaitlistEntry, error)
+	// Update writes the status and the offer of the entry
+	Update(entry *model.WaitlistEntry) error
+}
+
+type waitlistRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ WaitlistRepo = (*waitlistRepoGorm)(nil)
+
+func NewWaitlistRepoGorm(db *gorm.DB) *waitlistRepoGorm {
+	return &waitlistRepoGorm{
+		db: db,
+	}
+}
+
+func (r *waitlistRepoGorm) WithTx(tx *gorm.DB) WaitlistRepo {
+	return &waitlistRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *waitlistRepoGorm) Create(entry *model.WaitlistEntry) error {
+	ctx := context.Background()
+	if err := gorm.G[model.WaitlistEntry](r.db).Create(ctx, entry); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *waitlistRepoGorm) GetByIDForUpdate(id uint) (*model.WaitlistEntry, error) {
+	ctx := context.Background()
+	entry, err := gorm.G[model.WaitlistEntry](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.WaitlistEntry{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *waitlistRepoGorm) GetOpenByShowtimeIDUserID(showtimeID, userID uint) (*model.WaitlistEntry, error) {
+	ctx := context.Background()
+	entry, err := gorm.G[model.WaitlistEntry](r.db).
+		Where("showtime_id = ? AND user_id = ? AND status IN ?", showtimeID, userID,
+			[]model.WaitlistStatus{model.WaitlistWaiting, model.WaitlistOffered}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *waitlistRepoGorm) GetFirstWaitingForUpdate(showtimeID uint) (*model.WaitlistEntry, error) {
+	ctx := context.Background()
+	entry, err := gorm.G[model.WaitlistEntry](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.WaitlistEntry{ShowtimeID: showtimeID, Status: model.WaitlistWaiting}).Order("id").First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *waitlistRepoGorm) GetByUserID(userID uint) ([]model.WaitlistEntry, error) {
+	ctx := context.Background()
+	entries, err := gorm.G[model.WaitlistEntry](r.db).Where(&model.WaitlistEntry{UserID: userID}).Order("id DESC").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *waitlistRepoGorm) GetByStatus(status model.WaitlistStatus) ([]model.WaitlistEntry, error) {
+	ctx := context.Background()
+	entries, err := gorm.G[model.WaitlistEntry](r.db).Where(&model.WaitlistEntry{Status: status}).Order("id").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *waitlistRepoGorm) Update(entry *model.WaitlistEntry) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.WaitlistEntry](r.db).Where(&model.WaitlistEntry{ID: entry.ID}).
+		Select("Status", "OrderID", "OfferExpiresAt").Updates(ctx, *entry); err != nil {
+		return err
+	}
+	return nil
+}
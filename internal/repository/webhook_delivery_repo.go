@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type WebhookDeliveryRepo interface {
+	WithTx(tx *gorm.DB) WebhookDeliveryRepo
+	Create(delivery *model.WebhookDelivery) error
+	GetByID(id uint) (*model.WebhookDelivery, error)
+	// GetByEndpointID returns at most limit deliveries of the endpoint, newest first
+	GetByEndpointID(endpointID uint, limit int) ([]model.WebhookDelivery, error)
+	// GetDueForUpdate returns at most limit pending deliveries of active endpoints due at now, oldest first,
+	// and locks them until the transaction ends. Rows locked by another worker are skipped.
+	GetDueForUpdate(now time.Time, limit int) ([]model.WebhookDelivery, error)
+	// Update writes the delivery state of the delivery
+	Update(delivery *model.WebhookDelivery) error
+}
+
+type webhookDeliveryRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ WebhookDeliveryRepo = (*webhookDeliveryRepoGorm)(nil)
+
+func NewWebhookDeliveryRepoGorm(db *gorm.DB) *webhookDeliveryRepoGorm {
+	return &webhookDeliveryRepoGorm{
+		db: db,
+	}
+}
+
+func (r *webhookDeliveryRepoGorm) WithTx(tx *gorm.DB) WebhookDeliveryRepo {
+	return &webhookDeliveryRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *webhookDeliveryRepoGorm) Create(delivery *model.WebhookDelivery) error {
+	ctx := context.Background()
+	if err := gorm.G[model.WebhookDelivery](r.db).Create(ctx, delivery); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *webhookDeliveryRepoGorm) GetByID(id uint) (*model.WebhookDelivery, error) {
+	ctx := context.Background()
+	delivery, err := gorm.G[model.WebhookDelivery](r.db).Where(&model.WebhookDelivery{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (r *webhookDeliveryRepoGorm) GetByEndpointID(endpointID uint, limit int) ([]model.WebhookDelivery, error) {
+	ctx := context.Background()
+	deliveries, err := gorm.G[model.WebhookDelivery](r.db).Where(&model.WebhookDelivery{EndpointID: endpointID}).
+		Order("id DESC").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *webhookDeliveryRepoGorm) GetDueForUpdate(now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	ctx := context.Background()
+	// the deliveries of a disabled endpoint wait for it to be enabled again
+	activeEndpoints := r.db.Model(&model.WebhookEndpoint{}).Select("id").Where("active = ?", true)
+	deliveries, err := gorm.G[model.WebhookDelivery](r.db,
+		clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+		Where("status = ? AND next_attempt_at <= ? AND endpoint_id IN (?)", model.WebhookDeliveryPending, now, activeEndpoints).
+		Order("next_attempt_at, id").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *webhookDeliveryRepoGorm) Update(delivery *model.WebhookDelivery) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.WebhookDelivery](r.db).Where(&model.WebhookDelivery{ID: delivery.ID}).
+		Select("Status", "NextAttemptAt", "Attempts", "ResponseStatus", "LastError", "DeliveredAt").
+		Updates(ctx, *delivery); err != nil {
+		return err
+	}
+	return nil
+}
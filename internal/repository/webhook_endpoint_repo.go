@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+type WebhookEndpointRepo interface {
+	WithTx(tx *gorm.DB) WebhookEndpointRepo
+	Create(endpoint *model.WebhookEndpoint) error
+	GetByID(id uint) (*model.WebhookEndpoint, error)
+	// GetByIDForUpdate locks the row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.WebhookEndpoint, error)
+	ListAll() ([]model.WebhookEndpoint, error)
+	ListActive() ([]model.WebhookEndpoint, error)
+	// Update writes the subscription and the health of the endpoint
+	Update(endpoint *model.WebhookEndpoint) error
+	DeleteByID(id uint) error
+}
+
+type webhookEndpointRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ WebhookEndpointRepo = (*webhookEndpointRepoGorm)(nil)
+
+func NewWebhookEndpointRepoGorm(db *gorm.DB) *webhookEndpointRepoGorm {
+	return &webhookEndpointRepoGorm{
+		db: db,
+	}
+}
+
+func (r *webhookEndpointRepoGorm) WithTx(tx *gorm.DB) WebhookEndpointRepo {
+	return &webhookEndpointRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *webhookEndpointRepoGorm) Create(endpoint *model.WebhookEndpoint) error {
+	ctx := context.Background()
+	if err := gorm.G[model.WebhookEndpoint](r.db).Create(ctx, endpoint); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *webhookEndpointRepoGorm) GetByID(id uint) (*model.WebhookEndpoint, error) {
+	ctx := context.Background()
+	endpoint, err := gorm.G[model.WebhookEndpoint](r.db).Where(&model.WebhookEndpoint{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+func (r *webhookEndpointRepoGorm) GetByIDForUpdate(id uint) (*model.WebhookEndpoint, error) {
+	ctx := context.Background()
+	endpoint, err := gorm.G[model.WebhookEndpoint](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.WebhookEndpoint{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+func (r *webhookEndpointRepoGorm) ListAll() ([]model.WebhookEndpoint, error) {
+	ctx := context.Background()
+	endpoints, err := gorm.G[model.WebhookEndpoint](r.db).Order("id").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (r *webhookEndpointRepoGorm) ListActive() ([]model.WebhookEndpoint, error) {
+	ctx := context.Background()
+	endpoints, err := gorm.G[model.WebhookEndpoint](r.db).Where("active = ?", true).Order("id").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (r *webhookEndpointRepoGorm) Update(endpoint *model.WebhookEndpoint) error {
+	ctx := context.Background()
+	if _, err := gorm.G[model.WebhookEndpoint](r.db).Where(&model.WebhookEndpoint{ID: endpoint.ID}).
+		Select("URL", "EventTypes", "Active", "ConsecutiveFailures", "DisabledAt").Updates(ctx, *endpoint); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *webhookEndpointRepoGorm) DeleteByID(id uint) error {
+	ctx := context.Background()
+	_, err := gorm.G[model.WebhookEndpoint](r.db).Where(&model.WebhookEndpoint{ID: id}).Delete(ctx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package security
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,36 +17,59 @@ var (
 	ErrInvalidClaim = errors.New("Invalid token claim")
 )
 
-var secretKey []byte
-
-func InitJWT(key string) {
-	secretKey = []byte(key)
-}
-
-func CreateToken(username string, userID uint, userRole model.UserRole) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
+// CreateToken issues an access token of the session valid for ttl, signed with the active key named in the kid header.
+// Its jti claim identifies it for revocation.
+func (m *KeyManager) CreateToken(username string, userID uint, userRole model.UserRole, sessionID string,
+	ttl time.Duration) (string, error) {
+	jti, err := NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	key, err := m.signingKey(now)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method,
 		jwt.MapClaims{
-			"exp":       time.Now().Add(time.Hour * 24).Unix(),
+			"exp":       now.Add(ttl).Unix(),
+			"iat":       now.Unix(),
+			"jti":       jti,
+			"sid":       sessionID,
 			"username":  username,
 			"user_id":   userID,
 			"user_role": userRole,
 		})
-	tokenString, err := token.SignedString(secretKey)
+	token.Header["kid"] = key.id
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-func VerifyToken(tokenStr string) (jwt.MapClaims, error) {
+// VerifyToken returns ErrInvalidToken for any token that is malformed, expired, signed by an unknown
+// or retired key, or signed with another algorithm than the one of its key
+func (m *KeyManager) VerifyToken(tokenStr string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(
 		tokenStr,
 		func(token *jwt.Token) (any, error) {
-			return secretKey, nil
+			kid, _ := token.Header["kid"].(string)
+			key, ok := m.verificationKey(kid, time.Now())
+			if !ok {
+				return nil, fmt.Errorf("unknown signing key %q", kid)
+			}
+			// pin the algorithm to the key, a token can't pick how it is verified
+			if token.Method.Alg() != key.alg {
+				return nil, fmt.Errorf("signing key %q doesn't use %s", kid, token.Method.Alg())
+			}
+			return key.private.Public(), nil
 		},
+		jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA}),
+		jwt.WithExpirationRequired(),
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
 	}
 	if !token.Valid {
 		return nil, ErrInvalidToken
@@ -54,3 +80,12 @@ func VerifyToken(tokenStr string) (jwt.MapClaims, error) {
 	}
 	return claims, nil
 }
+
+// NewTokenID returns a random ID for a token or a session
+func NewTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
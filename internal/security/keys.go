@@ -0,0 +1,213 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// the signing algorithms of the access tokens
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// rsaKeyBits is the size of the generated RSA keys
+const rsaKeyBits = 2048
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrNoSigningKey         = errors.New("no active signing key")
+)
+
+// GenerateSigningKey creates a key pair for alg, ID and ActivatesAt are left to the caller
+func GenerateSigningKey(alg string) (*model.SigningKey, error) {
+	var private any
+	var err error
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return &model.SigningKey{
+		Algorithm:  alg,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+// keyPair is a parsed SigningKey
+type keyPair struct {
+	id          string
+	alg         string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	activatesAt time.Time
+	// verifyUntil is when the key stops verifying, zero while no successor is active
+	verifyUntil time.Time
+}
+
+// KeyManager signs and verifies the access tokens with the loaded signing keys, it is safe for concurrent use
+type KeyManager struct {
+	mu   sync.RWMutex
+	keys []*keyPair
+}
+
+func NewKeyManager() *KeyManager {
+	return &KeyManager{}
+}
+
+// SetKeys replaces the loaded keys. A key keeps verifying for grace after its successor activates,
+// grace must outlast the access tokens.
+func (m *KeyManager) SetKeys(keys []model.SigningKey, grace time.Duration) error {
+	pairs := make([]*keyPair, 0, len(keys))
+	for _, key := range keys {
+		pair, err := parseSigningKey(key)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].activatesAt.Before(pairs[j].activatesAt)
+	})
+	for i := 0; i+1 < len(pairs); i++ {
+		pairs[i].verifyUntil = pairs[i+1].activatesAt.Add(grace)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = pairs
+	return nil
+}
+
+func parseSigningKey(key model.SigningKey) (*keyPair, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pair := &keyPair{
+		id:          key.ID,
+		alg:         key.Algorithm,
+		activatesAt: key.ActivatesAt,
+	}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm != AlgRS256 {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		pair.method, pair.private = jwt.SigningMethodRS256, private
+	case ed25519.PrivateKey:
+		if key.Algorithm != AlgEdDSA {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		pair.method, pair.private = jwt.SigningMethodEdDSA, private
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return pair, nil
+}
+
+// signingKey returns the newest active key
+func (m *KeyManager) signingKey(now time.Time) (*keyPair, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if !m.keys[i].activatesAt.After(now) {
+			return m.keys[i], nil
+		}
+	}
+	return nil, ErrNoSigningKey
+}
+
+// verificationKey returns the key of kid if it still verifies, upcoming keys verify already
+// so an instance that loaded a new key before the others doesn't get its tokens rejected
+func (m *KeyManager) verificationKey(kid string, now time.Time) (*keyPair, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.keys {
+		if key.id == kid {
+			if !key.verifyUntil.IsZero() && now.After(key.verifyUntil) {
+				return nil, false
+			}
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the key set served to the services verifying our tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that currently verify, upcoming keys included
+func (m *KeyManager) JWKS() JWKS {
+	now := time.Now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := JWKS{Keys: make([]JWK, 0, len(m.keys))}
+	for _, key := range m.keys {
+		if !key.verifyUntil.IsZero() && now.After(key.verifyUntil) {
+			continue
+		}
+		jwk := JWK{
+			KeyID:     key.id,
+			Use:       "sig",
+			Algorithm: key.alg,
+		}
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// APIKeyScopes are the scopes an API key can be granted, "<resource>:read" allows the GET requests
+// of the resource and "<resource>:write" the others
+var APIKeyScopes = []string{
+	"reservations:read", "reservations:write",
+	"orders:read", "orders:write",
+	"waitlist:read", "waitlist:write",
+	"inbox:read", "inbox:write",
+}
+
+// APIKeyPrefix starts every API key, it tells them apart from access tokens
+const APIKeyPrefix = "mrk_"
+
+const (
+	// apiKeyDisplayLength is how much of the key is kept as its Prefix
+	apiKeyDisplayLength = 12
+	// apiKeyUsageResolution is how stale LastUsedAt may be, so a busy key doesn't write on every request
+	apiKeyUsageResolution = time.Minute
+)
+
+type APIKeyService interface {
+	// CreateAPIKey returns the new key, the only time the key itself is readable
+	CreateAPIKey(userID uint, name string, scopes []string, expiresAt *time.Time) (*PersonalAPIKey, error)
+	GetAPIKeysByUserID(userID uint) ([]PersonalAPIKey, error)
+	// RevokeAPIKey stops the key of the user from working, revoking it again is a no-op
+	RevokeAPIKey(userID, keyID uint) error
+	// ValidateAPIKey returns the principal of a valid key, ErrInvalidAPIKey otherwise
+	ValidateAPIKey(key string) (*Principal, error)
+}
+
+// PersonalAPIKey is what users see of their API keys
+type PersonalAPIKey struct {
+	ID     uint     `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// Key is only set when the key is created
+	Key        string     `json:"key,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newPersonalAPIKey(key *model.APIKey) PersonalAPIKey {
+	return PersonalAPIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Split(key.Scopes, ","),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+type apiKeyService struct {
+	repo repository.APIKeyRepo
+}
+
+var _ APIKeyService = (*apiKeyService)(nil)
+
+func NewAPIKeyService(apiKeyRepo repository.APIKeyRepo) *apiKeyService {
+	return &apiKeyService{
+		repo: apiKeyRepo,
+	}
+}
+
+func (s *apiKeyService) CreateAPIKey(userID uint, name string, scopes []string, expiresAt *time.Time) (*PersonalAPIKey, error) {
+	if len(scopes) == 0 {
+		return nil, ErrInvalidAPIKeyScope
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			return nil, ErrInvalidAPIKeyScope
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, ErrInvalidAPIKeyExpiry
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	key := APIKeyPrefix + secret
+	apiKey := &model.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:apiKeyDisplayLength],
+		HashedKey: hashToken(key),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.repo.Create(apiKey); err != nil {
+		return nil, err
+	}
+	personalKey := newPersonalAPIKey(apiKey)
+	personalKey.Key = key
+	return &personalKey, nil
+}
+
+func (s *apiKeyService) GetAPIKeysByUserID(userID uint) ([]PersonalAPIKey, error) {
+	keys, err := s.repo.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	personalKeys := make([]PersonalAPIKey, 0, len(keys))
+	for i := range keys {
+		personalKeys = append(personalKeys, newPersonalAPIKey(&keys[i]))
+	}
+	return personalKeys, nil
+}
+
+func (s *apiKeyService) RevokeAPIKey(userID, keyID uint) error {
+	key, err := s.repo.GetByID(keyID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if key.UserID != userID {
+		return ErrNotFound
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+	return s.repo.UpdateRevokedAt(keyID, time.Now())
+}
+
+func (s *apiKeyService) ValidateAPIKey(key string) (*Principal, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	apiKey, err := s.repo.GetByHashedKey(hashToken(key))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyUsageResolution {
+		if err := s.repo.UpdateLastUsedAt(apiKey.ID, now); err != nil {
+			return nil, err
+		}
+	}
+	return &Principal{
+		UserID:   apiKey.UserID,
+		Role:     apiKey.User.Role,
+		APIKeyID: apiKey.ID,
+		Scopes:   strings.Split(apiKey.Scopes, ","),
+	}, nil
+}
@@ -1,49 +1,337 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/golang-jwt/jwt/v5"
 
+	"github.com/qs-lzh/movie-reservation/internal/cache"
+	"github.com/qs-lzh/movie-reservation/internal/model"
 	"github.com/qs-lzh/movie-reservation/internal/security"
 )
 
 type AuthService interface {
-	Login(username, password, key string) (token string, err error)
+	// Login opens a new session and returns its first token pair
+	Login(username, password, key string) (*TokenPair, error)
+	// Refresh rotates the refresh token of a session, the given refresh token can't be used again.
+	// Presenting a refresh token that was already rotated ends its session, since it was likely stolen.
+	Refresh(refreshToken string) (*TokenPair, error)
+	// ValidateToken verifies the access token and checks it was neither revoked nor issued by an ended session
 	ValidateToken(token string) (claims jwt.MapClaims, err error)
+	// Authenticate returns who the token acts for, the token is either an access token or an API key
+	Authenticate(token string) (*Principal, error)
+	// Logout revokes the access token and ends the session of the tokens, either token may be empty
+	Logout(accessToken, refreshToken string) error
+	// LogoutAll ends every session of the user, all of their tokens stop working at once
+	LogoutAll(userID uint) error
+}
+
+// TokenPair is a short-lived access token and the refresh token to get the next one
+type TokenPair struct {
+	AccessToken           string    `json:"access_token"`
+	AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+}
+
+// Principal is the user a request acts for
+type Principal struct {
+	UserID uint
+	Role   model.UserRole
+	// APIKeyID is the API key the request was authenticated with, 0 for an access token
+	APIKeyID uint
+	// Scopes limit what an API key can do, an access token can do everything its user can
+	Scopes []string
+}
+
+// authSession is one login of a user, it lives in Redis as long as its refresh token keeps being rotated
+type authSession struct {
+	ID       string         `json:"id"`
+	UserID   uint           `json:"user_id"`
+	UserName string         `json:"user_name"`
+	Role     model.UserRole `json:"role"`
+	// RefreshHash is the SHA-256 of the current refresh token, the token itself is never stored
+	RefreshHash string    `json:"refresh_hash"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 // jwtAuthService relies on UserService
 type jwtAuthService struct {
-	userService UserService
+	userService     UserService
+	cache           *cache.RedisCache
+	keyManager      *security.KeyManager
+	apiKeyService   APIKeyService
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
 }
 
 var _ AuthService = (*jwtAuthService)(nil)
 
-func NewJWTAuthService(userService UserService) *jwtAuthService {
+func NewJWTAuthService(userService UserService, cache *cache.RedisCache, keyManager *security.KeyManager,
+	apiKeyService APIKeyService, accessTokenTTL, refreshTokenTTL time.Duration) *jwtAuthService {
 	return &jwtAuthService{
-		userService: userService,
+		userService:     userService,
+		cache:           cache,
+		keyManager:      keyManager,
+		apiKeyService:   apiKeyService,
+		accessTokenTTL:  accessTokenTTL,
+		refreshTokenTTL: refreshTokenTTL,
 	}
 }
 
-func (s *jwtAuthService) Login(username, password, key string) (token string, err error) {
+// redis keys of the sessions
+func sessionKey(sessionID string) string {
+	return "auth:session:" + sessionID
+}
+
+func refreshTokenKey(refreshHash string) string {
+	return "auth:refresh:" + refreshHash
+}
+
+// usedRefreshTokenKey remembers the rotated refresh tokens to detect their reuse
+func usedRefreshTokenKey(refreshHash string) string {
+	return "auth:refresh_used:" + refreshHash
+}
+
+func userSessionsKey(userID uint) string {
+	return fmt.Sprintf("auth:user_sessions:%d", userID)
+}
+
+func revokedTokenKey(jti string) string {
+	return "auth:revoked_jti:" + jti
+}
+
+func (s *jwtAuthService) Login(username, password, key string) (*TokenPair, error) {
 
 	isValid, err := s.userService.ValidateUser(username, password)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if !isValid {
-		return "", ErrInvalidCredential
+		return nil, ErrInvalidCredential
 	}
 	userRole, err := s.userService.GetUserRoleByName(username)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	userID, err := s.userService.GetUserIDByName(username)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	sessionID, err := security.NewTokenID()
+	if err != nil {
+		return nil, err
+	}
+	return s.issueTokens(&authSession{
+		ID:        sessionID,
+		UserID:    userID,
+		UserName:  username,
+		Role:      userRole,
+		CreatedAt: time.Now(),
+	})
+}
+
+func (s *jwtAuthService) Refresh(refreshToken string) (*TokenPair, error) {
+	refreshHash := hashToken(refreshToken)
+	// consuming the token atomically lets only one of two concurrent refreshes win
+	var sessionID string
+	if err := s.cache.GetDel(refreshTokenKey(refreshHash), &sessionID); err != nil {
+		if !errors.Is(err, cache.ErrCacheMiss) {
+			return nil, err
+		}
+		if err := s.cache.Get(usedRefreshTokenKey(refreshHash), &sessionID); err != nil {
+			if errors.Is(err, cache.ErrCacheMiss) {
+				return nil, ErrInvalidRefreshToken
+			}
+			return nil, err
+		}
+		if err := s.endSession(sessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err := s.cache.Set(usedRefreshTokenKey(refreshHash), sessionID, s.refreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	var session authSession
+	if err := s.cache.Get(sessionKey(sessionID), &session); err != nil {
+		if errors.Is(err, cache.ErrCacheMiss) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	// pick up a role change, and end the session of a deleted user
+	role, err := s.userService.GetUserRoleByName(session.UserName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			if err := s.endSession(sessionID); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	session.Role = role
+	return s.issueTokens(&session)
+}
+
+// issueTokens gives the session a new refresh token and an access token, and saves it
+func (s *jwtAuthService) issueTokens(session *authSession) (*TokenPair, error) {
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session.RefreshHash = hashToken(refreshToken)
+	now := time.Now()
+	if err := s.cache.Set(sessionKey(session.ID), session, s.refreshTokenTTL); err != nil {
+		return nil, err
+	}
+	if err := s.cache.Set(refreshTokenKey(session.RefreshHash), session.ID, s.refreshTokenTTL); err != nil {
+		return nil, err
+	}
+	if err := s.cache.SetAdd(userSessionsKey(session.UserID), session.ID, s.refreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.keyManager.CreateToken(session.UserName, session.UserID, session.Role, session.ID, s.accessTokenTTL)
+	if err != nil {
+		return nil, err
 	}
-	return security.CreateToken(username, userID, userRole)
+	return &TokenPair{
+		AccessToken:           accessToken,
+		AccessTokenExpiresAt:  now.Add(s.accessTokenTTL),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: now.Add(s.refreshTokenTTL),
+	}, nil
 }
 
 func (s *jwtAuthService) ValidateToken(token string) (claims jwt.MapClaims, err error) {
-	return security.VerifyToken(token)
+	claims, err = s.keyManager.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	jti, _ := claims["jti"].(string)
+	sessionID, _ := claims["sid"].(string)
+	if jti == "" || sessionID == "" {
+		return nil, security.ErrInvalidClaim
+	}
+
+	revoked, err := s.cache.Exists(revokedTokenKey(jti))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, security.ErrInvalidToken
+	}
+	active, err := s.cache.Exists(sessionKey(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, security.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (s *jwtAuthService) Authenticate(token string) (*Principal, error) {
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		return s.apiKeyService.ValidateAPIKey(token)
+	}
+	claims, err := s.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, security.ErrInvalidClaim
+	}
+	role, _ := claims["user_role"].(string)
+	return &Principal{
+		UserID: uint(userID),
+		Role:   model.UserRole(role),
+	}, nil
+}
+
+// Logout ignores invalid tokens, there is nothing left to revoke for them
+func (s *jwtAuthService) Logout(accessToken, refreshToken string) error {
+	if accessToken != "" {
+		if claims, err := s.keyManager.VerifyToken(accessToken); err == nil {
+			if err := s.revokeToken(claims); err != nil {
+				return err
+			}
+			if sessionID, ok := claims["sid"].(string); ok {
+				if err := s.endSession(sessionID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if refreshToken != "" {
+		var sessionID string
+		if err := s.cache.GetDel(refreshTokenKey(hashToken(refreshToken)), &sessionID); err == nil {
+			return s.endSession(sessionID)
+		} else if !errors.Is(err, cache.ErrCacheMiss) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jwtAuthService) LogoutAll(userID uint) error {
+	sessionIDs, err := s.cache.SetMembers(userSessionsKey(userID))
+	if err != nil {
+		return err
+	}
+	for _, sessionID := range sessionIDs {
+		if err := s.endSession(sessionID); err != nil {
+			return err
+		}
+	}
+	return s.cache.Delete(userSessionsKey(userID))
+}
+
+// revokeToken lists the jti of the access token as revoked until the token expires anyway
+func (s *jwtAuthService) revokeToken(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return nil
+	}
+	ttl := time.Until(exp.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.cache.Set(revokedTokenKey(jti), true, ttl)
+}
+
+// endSession deletes the session and its refresh token, the access tokens of the session
+// are rejected by ValidateToken from then on
+func (s *jwtAuthService) endSession(sessionID string) error {
+	var session authSession
+	if err := s.cache.Get(sessionKey(sessionID), &session); err != nil {
+		if errors.Is(err, cache.ErrCacheMiss) {
+			return nil
+		}
+		return err
+	}
+	if err := s.cache.Delete(sessionKey(sessionID), refreshTokenKey(session.RefreshHash)); err != nil {
+		return err
+	}
+	return s.cache.SetRemove(userSessionsKey(session.UserID), sessionID)
+}
+
+func newRefreshToken() (string, error) {
+	return randomHex(32)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -12,7 +12,83 @@ var (
 
 // error for reservation service
 var (
-	ErrNoTicketsAvailable = errors.New("no tickets available")
-	ErrShowtimeNotExist   = errors.New("the showtime doesn't not exist")
-	ErrAlreadyReserved    = errors.New("the user have already have the same reservation")
+	ErrNoTicketsAvailable   = errors.New("no tickets available")
+	ErrShowtimeNotExist     = errors.New("the showtime doesn't not exist")
+	ErrInvalidSeatSelection = errors.New("the selected seats are not valid for the showtime")
+	ErrSeatUnavailable      = errors.New("the seat is not available")
+	ErrSeatLimitExceeded    = errors.New("too many seats reserved for the showtime")
+	ErrOrphanSeat           = errors.New("the selection would leave a single seat isolated")
+)
+
+// error for seat hold
+var (
+	ErrHoldExpired  = errors.New("the seat hold has expired")
+	ErrHoldNotOwned = errors.New("the seat is not held by the user")
+)
+
+// error for order service
+var (
+	ErrOrderNotOwned   = errors.New("the order does not belong to the user")
+	ErrOrderNotPending = errors.New("the order is not pending")
+	ErrOrderExpired    = errors.New("the order has expired")
+	ErrOrderNotPaid    = errors.New("the order is not paid")
+	// ErrOrderAmountChanged is returned when a reservation of the order was cancelled while it was being paid
+	ErrOrderAmountChanged = errors.New("the order amount changed during the payment")
+	// ErrOrderRefunding is returned when a reservation of an order being refunded as a whole is cancelled
+	ErrOrderRefunding = errors.New("the order is being refunded")
+)
+
+// error for payment webhooks
+var (
+	// ErrPaymentEventMismatch wraps the reason an event was recorded without changing its order,
+	// the provider must not send it again
+	ErrPaymentEventMismatch = errors.New("the payment event does not match the state of its order")
+	ErrUnknownPaymentEvent  = errors.New("the payment event type is unknown")
+)
+
+// error for reservation cancellation
+var (
+	ErrReservationNotActive = errors.New("the reservation is already cancelled or expired")
+	ErrShowtimeStarted      = errors.New("the showtime has already started")
+)
+
+// error for waitlist
+var (
+	ErrTicketsAvailable     = errors.New("tickets are still available for the showtime")
+	ErrAlreadyOnWaitlist    = errors.New("the user is already on the waitlist of the showtime")
+	ErrWaitlistEntryNotOpen = errors.New("the waitlist entry is no longer waiting")
+)
+
+// error for seat maintenance
+var (
+	ErrSeatNotBlocked = errors.New("the seat is not blocked")
+)
+
+// error for webhook endpoints
+var (
+	ErrInvalidWebhookURL       = errors.New("the webhook URL must be an absolute http or https URL")
+	ErrInvalidWebhookEventType = errors.New("the webhook event types are empty or unknown")
+)
+
+// error for auth sessions
+var (
+	ErrInvalidRefreshToken = errors.New("the refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("the refresh token was already used, its session is ended")
+)
+
+// error for API keys
+var (
+	ErrInvalidAPIKey       = errors.New("the API key is invalid, expired or revoked")
+	ErrInvalidAPIKeyScope  = errors.New("the API key scopes are empty or unknown")
+	ErrInvalidAPIKeyExpiry = errors.New("the API key expiry must be in the future")
+)
+
+// error for roles
+var (
+	ErrInvalidRoleName   = errors.New("the role name must be 1 to 16 lowercase letters or underscores")
+	ErrInvalidPermission = errors.New("the permissions contain an unknown permission")
+	ErrUnknownRole       = errors.New("the role does not exist")
+	ErrBuiltinRole       = errors.New("the built-in role can't be changed")
+	ErrRoleInUse         = errors.New("the role is still assigned to users")
+	ErrLastAdmin         = errors.New("the last admin can't lose the admin role")
 )
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeConnPool only supports beginning and ending transactions, the tests give the services fake repos
+// so no statement ever reaches it
+type fakeConnPool struct{}
+
+var errNoDatabase = errors.New("the fake connection pool runs no statement")
+
+func (fakeConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errNoDatabase
+}
+
+func (fakeConnPool) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return nil, errNoDatabase
+}
+
+func (fakeConnPool) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return nil, errNoDatabase
+}
+
+func (fakeConnPool) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return nil
+}
+
+func (fakeConnPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	return &fakeTx{}, nil
+}
+
+// fakeTx is a transaction of fakeConnPool
+type fakeTx struct {
+	fakeConnPool
+}
+
+func (*fakeTx) Commit() error {
+	return nil
+}
+
+func (*fakeTx) Rollback() error {
+	return nil
+}
+
+// newFakeDB returns a *gorm.DB whose transactions always begin and commit
+func newFakeDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: fakeConnPool{}}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
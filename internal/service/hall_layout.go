@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// maxLayoutSize caps the rows and cols of a hall layout
+const maxLayoutSize = 100
+
+// maxSeatLabelLength is the size of the label column of the seats
+const maxSeatLabelLength = 16
+
+var ErrInvalidLayout = errors.New("the hall layout is not valid")
+
+// HallLayout is the seats of a hall placed on its Rows x Cols grid, positions without seat are aisles or gaps
+type HallLayout struct {
+	Rows  int
+	Cols  int
+	Seats []LayoutSeat
+}
+
+// LayoutSeat is a seat at (Row, Col), both starting from 1
+type LayoutSeat struct {
+	Row   int
+	Col   int
+	Label string
+	Class model.SeatClass
+}
+
+// asciiSeatClasses maps the characters of an ASCII layout to seat classes,
+// '.', '_' and ' ' are gaps
+var asciiSeatClasses = map[rune]model.SeatClass{
+	'A': model.SeatClassStandard,
+	'P': model.SeatClassPremium,
+	'W': model.SeatClassAccessible,
+	'C': model.SeatClassCouple,
+}
+
+// ParseHallLayout parses a layout document, which is either
+//   - a JSON string holding an ASCII map, one line per row, e.g. "AA.AAAA.AA\n.AAAAAAAA.",
+//     see asciiSeatClasses for the characters
+//   - a JSON grid, one array per row whose cells are null for a gap, a seat class,
+//     or an object {"class": "premium", "label": "VIP1"}
+//
+// Seats without explicit label are labelled by row letter and seat number following the scheme, e.g. "B12",
+// aisles don't count.
+func ParseHallLayout(document []byte, scheme model.SeatLabelScheme) (*HallLayout, error) {
+	document = bytes.TrimSpace(document)
+	if len(document) == 0 {
+		return nil, fmt.Errorf("%w: empty document", ErrInvalidLayout)
+	}
+
+	var cells [][]*LayoutSeat
+	var err error
+	switch document[0] {
+	case '"':
+		var ascii string
+		if err := json.Unmarshal(document, &ascii); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidLayout, err)
+		}
+		cells, err = parseASCIILayout(ascii)
+	case '[':
+		cells, err = parseGridLayout(document)
+	default:
+		return nil, fmt.Errorf("%w: expected an ASCII map or a JSON grid", ErrInvalidLayout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newHallLayout(cells, scheme)
+}
+
+func parseASCIILayout(ascii string) ([][]*LayoutSeat, error) {
+	lines := strings.Split(strings.Trim(strings.ReplaceAll(ascii, "\r\n", "\n"), "\n"), "\n")
+	cells := make([][]*LayoutSeat, 0, len(lines))
+	for row, line := range lines {
+		var rowCells []*LayoutSeat
+		for col, char := range []rune(strings.TrimRight(line, " ")) {
+			if char == '.' || char == '_' || char == ' ' {
+				rowCells = append(rowCells, nil)
+				continue
+			}
+			class, ok := asciiSeatClasses[char]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown seat %q at row %d col %d", ErrInvalidLayout, char, row+1, col+1)
+			}
+			rowCells = append(rowCells, &LayoutSeat{Class: class})
+		}
+		cells = append(cells, rowCells)
+	}
+	return cells, nil
+}
+
+func parseGridLayout(document []byte) ([][]*LayoutSeat, error) {
+	var grid [][]json.RawMessage
+	if err := json.Unmarshal(document, &grid); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLayout, err)
+	}
+	cells := make([][]*LayoutSeat, 0, len(grid))
+	for row, gridRow := range grid {
+		rowCells := make([]*LayoutSeat, 0, len(gridRow))
+		for col, cell := range gridRow {
+			seat, err := parseGridCell(cell)
+			if err != nil {
+				return nil, fmt.Errorf("%w: row %d col %d: %v", ErrInvalidLayout, row+1, col+1, err)
+			}
+			rowCells = append(rowCells, seat)
+		}
+		cells = append(cells, rowCells)
+	}
+	return cells, nil
+}
+
+func parseGridCell(cell json.RawMessage) (*LayoutSeat, error) {
+	cell = bytes.TrimSpace(cell)
+	switch {
+	case bytes.Equal(cell, []byte("null")):
+		return nil, nil
+	case len(cell) > 0 && cell[0] == '"':
+		var class model.SeatClass
+		if err := json.Unmarshal(cell, &class); err != nil {
+			return nil, err
+		}
+		return &LayoutSeat{Class: class}, nil
+	default:
+		var seat struct {
+			Class model.SeatClass `json:"class"`
+			Label string          `json:"label"`
+		}
+		if err := json.Unmarshal(cell, &seat); err != nil {
+			return nil, err
+		}
+		if seat.Class == "" {
+			seat.Class = model.SeatClassStandard
+		}
+		return &LayoutSeat{Class: seat.Class, Label: seat.Label}, nil
+	}
+}
+
+// newHallLayout places the parsed cells on the grid, labels the seats and validates the result
+func newHallLayout(cells [][]*LayoutSeat, scheme model.SeatLabelScheme) (*HallLayout, error) {
+	layout := &HallLayout{Rows: len(cells)}
+	labels := make(map[string]bool)
+	for row, rowCells := range cells {
+		layout.Cols = max(layout.Cols, len(rowCells))
+		numbers := seatNumbers(rowCells, scheme)
+		for col, seat := range rowCells {
+			if seat == nil {
+				continue
+			}
+			if !seat.Class.Valid() {
+				return nil, fmt.Errorf("%w: unknown seat class %q at row %d col %d", ErrInvalidLayout, seat.Class, row+1, col+1)
+			}
+			seat.Row, seat.Col = row+1, col+1
+			if seat.Label == "" {
+				seat.Label = fmt.Sprintf("%s%d", rowLabel(row+1, scheme), numbers[col])
+			}
+			if strings.TrimSpace(seat.Label) == "" {
+				return nil, fmt.Errorf("%w: blank seat label at row %d col %d", ErrInvalidLayout, row+1, col+1)
+			}
+			if utf8.RuneCountInString(seat.Label) > maxSeatLabelLength {
+				return nil, fmt.Errorf("%w: seat label %q is longer than %d characters", ErrInvalidLayout, seat.Label,
+					maxSeatLabelLength)
+			}
+			if labels[seat.Label] {
+				return nil, fmt.Errorf("%w: duplicated seat label %q", ErrInvalidLayout, seat.Label)
+			}
+			labels[seat.Label] = true
+			layout.Seats = append(layout.Seats, *seat)
+		}
+	}
+	if layout.Rows > maxLayoutSize || layout.Cols > maxLayoutSize {
+		return nil, fmt.Errorf("%w: the hall is larger than %dx%d", ErrInvalidLayout, maxLayoutSize, maxLayoutSize)
+	}
+	if len(layout.Seats) == 0 {
+		return nil, fmt.Errorf("%w: no seat", ErrInvalidLayout)
+	}
+	return layout, nil
+}
+
+// RectangleLayout is a rows x cols hall where every position is a standard seat
+func RectangleLayout(rows, cols int, scheme model.SeatLabelScheme) (*HallLayout, error) {
+	if rows <= 0 || cols <= 0 {
+		return nil, fmt.Errorf("%w: rows and cols must be positive", ErrInvalidLayout)
+	}
+	cells := make([][]*LayoutSeat, rows)
+	for row := range cells {
+		cells[row] = make([]*LayoutSeat, cols)
+		for col := range cells[row] {
+			cells[row][col] = &LayoutSeat{Class: model.SeatClassStandard}
+		}
+	}
+	return newHallLayout(cells, scheme)
+}
+
+// HallSeatLayout rebuilds the layout the seats of the hall were created from, labelled following its LabelScheme
+func HallSeatLayout(hall *model.Hall) (*HallLayout, error) {
+	if hall.Layout != "" && hall.Layout != "null" {
+		return ParseHallLayout([]byte(hall.Layout), hall.LabelScheme)
+	}
+	return RectangleLayout(hall.Rows, hall.Cols, hall.LabelScheme)
+}
+
+// seatNumbers returns the number of the seat at each col of the row, aisles and gaps don't count
+func seatNumbers(rowCells []*LayoutSeat, scheme model.SeatLabelScheme) []int {
+	numbers := make([]int, len(rowCells))
+	number := 0
+	for i := range rowCells {
+		col := i
+		if scheme.RightToLeft {
+			col = len(rowCells) - 1 - i
+		}
+		if rowCells[col] != nil {
+			number++
+			numbers[col] = number
+		}
+	}
+	return numbers
+}
+
+const (
+	rowLetters       = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	rowLettersSkipIO = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+)
+
+// rowLabel names the rows A..Z, then AA, AB, ... like spreadsheet columns
+func rowLabel(row int, scheme model.SeatLabelScheme) string {
+	letters := rowLetters
+	if scheme.SkipIO {
+		letters = rowLettersSkipIO
+	}
+	var label []byte
+	for row > 0 {
+		row--
+		label = append([]byte{letters[row%len(letters)]}, label...)
+		row /= len(letters)
+	}
+	return string(label)
+}
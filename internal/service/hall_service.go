@@ -2,60 +2,76 @@ package service
 
 import (
 	"errors"
+	"time"
 
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
 	"github.com/qs-lzh/movie-reservation/internal/model"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
 	"gorm.io/gorm"
 )
 
 type HallService interface {
-	CreateHall(hall *model.Hall) error
-	UpdateHall(hall *model.Hall) error
+	// CreateHall creates the hall with the seats of the layout, Rows, Cols and SeatCount are taken from the layout
+	CreateHall(hall *model.Hall, layout *HallLayout) error
+	// UpdateHall replaces the seats of the hall when layout is not nil, which fails with ErrRelatedResourceExists
+	// once the hall has showtimes, otherwise a changed LabelScheme relabels the current seats
+	UpdateHall(hall *model.Hall, layout *HallLayout) error
 	DeleteHallByID(id uint) error
 	GetHallByID(id uint) (*model.Hall, error)
 	GetHallByName(name string) (*model.Hall, error)
 	GetAllHalls() ([]model.Hall, error)
+	// SetSeatOutOfService flags the seat of the hall and blocks (or unblocks) it in every upcoming showtime,
+	// the showtimes where the seat is booked are left as they are and reported
+	SetSeatOutOfService(hallID, seatID uint, outOfService bool) (*SeatServiceReport, error)
+	// SetPreventOrphanSeats turns the orphan seat rule of the hall on or off, it applies to later reservations
+	SetPreventOrphanSeats(hallID uint, preventOrphanSeats bool) error
 }
 
 type hallService struct {
-	db              *gorm.DB
-	repo            repository.HallRepo
-	seatService     SeatService
-	showtimeService ShowtimeService
+	db                  *gorm.DB
+	repo                repository.HallRepo
+	seatService         SeatService
+	showtimeService     ShowtimeService
+	showtimeSeatService ShowtimeSeatService
+	bus                 *event.Bus
 }
 
 var _ HallService = (*hallService)(nil)
 
 func NewHallService(db *gorm.DB, hallRepo repository.HallRepo, seatService SeatService,
-	showtimeService ShowtimeService) *hallService {
+	showtimeService ShowtimeService, showtimeSeatService ShowtimeSeatService, bus *event.Bus) *hallService {
 	return &hallService{
-		db:              db,
-		repo:            hallRepo,
-		seatService:     seatService,
-		showtimeService: showtimeService,
+		db:                  db,
+		repo:                hallRepo,
+		seatService:         seatService,
+		showtimeService:     showtimeService,
+		showtimeSeatService: showtimeSeatService,
+		bus:                 bus,
 	}
 }
 
-func (s *hallService) CreateHall(hall *model.Hall) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
+func (s *hallService) CreateHall(hall *model.Hall, layout *HallLayout) error {
+	applyLayout(hall, layout)
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		if err := s.repo.WithTx(tx).Create(hall); err != nil {
 			return err
 		}
-		return s.seatService.InitSeatsForHallTx(tx, hall)
+		return s.seatService.InitSeatsForHallTx(tx, hall, layout)
 	})
 }
 
-func (s *hallService) UpdateHall(hall *model.Hall) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		// verify no related Showtime
-		relatedShowtimes, err := s.showtimeService.GetShowtimesByHallIDTx(tx, hall.ID)
-		if err != nil {
-			return err
-		}
-		if len(relatedShowtimes) != 0 {
-			return ErrRelatedResourceExists
-		}
+// applyLayout derives the size of the hall from its layout, so they can't disagree
+func applyLayout(hall *model.Hall, layout *HallLayout) {
+	hall.Rows = layout.Rows
+	hall.Cols = layout.Cols
+	hall.SeatCount = len(layout.Seats)
+}
 
+func (s *hallService) UpdateHall(hall *model.Hall, layout *HallLayout) error {
+	if layout != nil {
+		applyLayout(hall, layout)
+	}
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		// verify that the hall with this ID exists
 		existinghall, err := s.repo.WithTx(tx).GetByID(uint(hall.ID))
 		if err != nil {
@@ -77,12 +93,31 @@ func (s *hallService) UpdateHall(hall *model.Hall) error {
 			}
 		}
 
-		return s.repo.WithTx(tx).Update(hall)
+		if err := s.repo.WithTx(tx).Update(hall); err != nil {
+			return err
+		}
+		if layout == nil {
+			if hall.LabelScheme == existinghall.LabelScheme {
+				return nil
+			}
+			// replacing the seats would change their IDs and lose their class and out of service flag
+			return s.seatService.RelabelSeatsForHallTx(tx, hall)
+		}
+
+		// the showtime seats point at the seats being replaced, renaming or relabelling keeps them valid
+		relatedShowtimes, err := s.showtimeService.GetShowtimesByHallIDTx(tx, hall.ID)
+		if err != nil {
+			return err
+		}
+		if len(relatedShowtimes) != 0 {
+			return ErrRelatedResourceExists
+		}
+		return s.seatService.ReplaceSeatsForHallTx(tx, hall, layout)
 	})
 }
 
 func (s *hallService) DeleteHallByID(id uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		// verify no related showtime exists
 		relatedShowtimes, err := s.showtimeService.GetShowtimesByHallIDTx(tx, id)
 		if err != nil {
@@ -125,3 +160,65 @@ func (s *hallService) GetAllHalls() ([]model.Hall, error) {
 	}
 	return halls, nil
 }
+
+// SeatServiceReport lists the upcoming showtimes affected by taking a seat out of service or back
+type SeatServiceReport struct {
+	// ShowtimeIDs are the showtimes where the seat was blocked or unblocked
+	ShowtimeIDs []uint `json:"showtime_ids"`
+	// BookedShowtimeIDs are the showtimes where the seat is reserved, so it couldn't be blocked
+	BookedShowtimeIDs []uint `json:"booked_showtime_ids,omitempty"`
+}
+
+func (s *hallService) SetSeatOutOfService(hallID, seatID uint, outOfService bool) (*SeatServiceReport, error) {
+	report := &SeatServiceReport{ShowtimeIDs: []uint{}}
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		if err := s.seatService.SetSeatOutOfServiceTx(tx, hallID, seatID, outOfService); err != nil {
+			return err
+		}
+		showtimes, err := s.showtimeService.GetUpcomingShowtimesByHallIDTx(tx, hallID, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, showtime := range showtimes {
+			showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDTx(tx, showtime.ID, seatID)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				}
+				return err
+			}
+			if outOfService {
+				err = s.showtimeSeatService.BlockShowtimeSeatTx(tx, showtimeSeat.ID)
+			} else {
+				err = s.showtimeSeatService.UnblockShowtimeSeatTx(tx, showtimeSeat.ID)
+			}
+			switch {
+			case err == nil:
+				report.ShowtimeIDs = append(report.ShowtimeIDs, showtime.ID)
+			case outOfService && errors.Is(err, ErrSeatUnavailable):
+				report.BookedShowtimeIDs = append(report.BookedShowtimeIDs, showtime.ID)
+			case errors.Is(err, ErrShowtimeSeatStatusNotChange), errors.Is(err, ErrSeatNotBlocked):
+				// already in the wanted state
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *hallService) SetPreventOrphanSeats(hallID uint, preventOrphanSeats bool) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByID(hallID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		return s.repo.WithTx(tx).UpdatePreventOrphanSeats(hallID, preventOrphanSeats)
+	})
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+	"github.com/qs-lzh/movie-reservation/internal/security"
+)
+
+type KeyService interface {
+	// RotateKeys creates the first signing key or the successor of a key older than the rotation interval,
+	// deletes the keys past their grace period, and reloads the keys of the KeyManager.
+	// Every instance calls it periodically, which is also how they learn about the keys created by the others.
+	RotateKeys() error
+	JWKS() security.JWKS
+}
+
+type keyService struct {
+	db         *gorm.DB
+	repo       repository.SigningKeyRepo
+	keyManager *security.KeyManager
+	algorithm  string
+	// rotationInterval is how long a key signs before its successor is created
+	rotationInterval time.Duration
+	// gracePeriod is how long a key keeps verifying after its successor activates
+	gracePeriod time.Duration
+	// publishDelay is how long a new key is only published before it signs,
+	// so every instance and JWKS client has loaded it by then
+	publishDelay time.Duration
+}
+
+var _ KeyService = (*keyService)(nil)
+
+func NewKeyService(db *gorm.DB, signingKeyRepo repository.SigningKeyRepo, keyManager *security.KeyManager,
+	algorithm string, rotationInterval, gracePeriod, publishDelay time.Duration) *keyService {
+	return &keyService{
+		db:               db,
+		repo:             signingKeyRepo,
+		keyManager:       keyManager,
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		gracePeriod:      gracePeriod,
+		publishDelay:     publishDelay,
+	}
+}
+
+func (s *keyService) RotateKeys() error {
+	var keys []model.SigningKey
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.repo.WithTx(tx).LockRotation(); err != nil {
+			return err
+		}
+		var err error
+		keys, err = s.repo.WithTx(tx).ListAll()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		// a key is expired once its successor has been active for the grace period
+		var expired []string
+		for i := 0; i+1 < len(keys); i++ {
+			if now.After(keys[i+1].ActivatesAt.Add(s.gracePeriod)) {
+				expired = append(expired, keys[i].ID)
+			}
+		}
+		if len(expired) > 0 {
+			if err := s.repo.WithTx(tx).DeleteByIDs(expired); err != nil {
+				return err
+			}
+			keys = keys[len(expired):]
+		}
+
+		switch {
+		case len(keys) == 0:
+			// nothing can sign yet, the first key is active at once
+			key, err := s.createKeyTx(tx, now)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, *key)
+		case !now.Before(keys[len(keys)-1].ActivatesAt.Add(s.rotationInterval)):
+			key, err := s.createKeyTx(tx, now.Add(s.publishDelay))
+			if err != nil {
+				return err
+			}
+			keys = append(keys, *key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.keyManager.SetKeys(keys, s.gracePeriod)
+}
+
+func (s *keyService) createKeyTx(tx *gorm.DB, activatesAt time.Time) (*model.SigningKey, error) {
+	key, err := security.GenerateSigningKey(s.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if key.ID, err = security.NewTokenID(); err != nil {
+		return nil, err
+	}
+	key.ActivatesAt = activatesAt
+	if err := s.repo.WithTx(tx).Create(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *keyService) JWKS() security.JWKS {
+	return s.keyManager.JWKS()
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/notify"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+type NotificationService interface {
+	// EnqueueTx writes the notification to the outbox in tx, once per channel,
+	// it is only delivered if tx commits
+	EnqueueTx(tx *gorm.DB, notification notify.Notification) error
+	// DeliverDue delivers the due outbox messages and returns how many were sent,
+	// failed deliveries are retried with an exponential backoff until the attempts run out
+	DeliverDue() (int, error)
+	GetInbox(userID uint) ([]model.InboxMessage, error)
+	MarkInboxMessageRead(userID, messageID uint) error
+}
+
+type notificationService struct {
+	db         *gorm.DB
+	outboxRepo repository.OutboxRepo
+	inboxRepo  repository.InboxRepo
+	// channels maps the channel names stored in the outbox to their notifier
+	channels     map[string]notify.Notifier
+	maxAttempts  int
+	retryBackoff time.Duration
+}
+
+var _ NotificationService = (*notificationService)(nil)
+
+func NewNotificationService(db *gorm.DB, outboxRepo repository.OutboxRepo, inboxRepo repository.InboxRepo,
+	channels map[string]notify.Notifier, maxAttempts int, retryBackoff time.Duration) *notificationService {
+	return &notificationService{
+		db:           db,
+		outboxRepo:   outboxRepo,
+		inboxRepo:    inboxRepo,
+		channels:     channels,
+		maxAttempts:  maxAttempts,
+		retryBackoff: retryBackoff,
+	}
+}
+
+const (
+	// outboxBatchSize caps how many messages one DeliverDue call sends
+	outboxBatchSize = 100
+	// maxRetryBackoff caps the delay between two attempts of a message or a webhook delivery
+	maxRetryBackoff = time.Hour
+	// deliveryTimeout bounds a single delivery attempt
+	deliveryTimeout = 30 * time.Second
+	// outboxClaimLease is how long a claimed message is left to the worker sending its batch
+	// before another run may deliver it again
+	outboxClaimLease = outboxBatchSize * deliveryTimeout
+)
+
+func (s *notificationService) EnqueueTx(tx *gorm.DB, notification notify.Notification) error {
+	// every channel is its own message, so a channel failing doesn't resend through the others
+	channels := make([]string, 0, len(s.channels))
+	for channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	now := time.Now()
+	for _, channel := range channels {
+		if err := s.outboxRepo.WithTx(tx).Create(&model.OutboxMessage{
+			Channel:       channel,
+			UserID:        notification.UserID,
+			Subject:       notification.Subject,
+			Body:          notification.Body,
+			Status:        model.OutboxPending,
+			NextAttemptAt: now,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeliverDue claims the due messages in a short transaction by pushing their next attempt past
+// outboxClaimLease, then sends them without holding any lock and records every result on its own.
+// A message can be sent twice if the process dies between sending and recording, but it is never lost:
+// its claim runs out and another run delivers it again.
+func (s *notificationService) DeliverDue() (int, error) {
+	var messages []model.OutboxMessage
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var err error
+		messages, err = s.outboxRepo.WithTx(tx).GetDueForUpdate(now, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			messages[i].Attempts++
+			messages[i].NextAttemptAt = now.Add(outboxClaimLease)
+			if err := s.outboxRepo.WithTx(tx).Update(&messages[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int
+	var errs []error
+	for i := range messages {
+		message := &messages[i]
+		err := s.deliver(message)
+		now := time.Now()
+		if err != nil {
+			message.LastError = err.Error()
+			if message.Attempts >= s.maxAttempts {
+				message.Status = model.OutboxFailed
+			} else {
+				message.NextAttemptAt = now.Add(retryDelay(s.retryBackoff, message.Attempts))
+			}
+		} else {
+			message.Status = model.OutboxSent
+			message.SentAt = &now
+			message.LastError = ""
+			sent++
+		}
+		if err := s.outboxRepo.Update(message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return sent, errors.Join(errs...)
+}
+
+func (s *notificationService) deliver(message *model.OutboxMessage) error {
+	notifier, ok := s.channels[message.Channel]
+	if !ok {
+		return fmt.Errorf("notification channel %q is not configured", message.Channel)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	return notifier.Notify(ctx, notify.Notification{
+		UserID:  message.UserID,
+		Subject: message.Subject,
+		Body:    message.Body,
+	})
+}
+
+// retryDelay starts at base and doubles after every failed attempt, up to maxRetryBackoff
+func retryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+func (s *notificationService) GetInbox(userID uint) ([]model.InboxMessage, error) {
+	return s.inboxRepo.GetByUserID(userID)
+}
+
+func (s *notificationService) MarkInboxMessageRead(userID, messageID uint) error {
+	message, err := s.inboxRepo.GetByID(messageID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if message.UserID != userID {
+		return ErrNotFound
+	}
+	if message.ReadAt != nil {
+		return nil
+	}
+	return s.inboxRepo.UpdateReadAt(messageID, time.Now())
+}
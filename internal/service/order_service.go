@@ -0,0 +1,528 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/payment"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+/*
+* Order state machine:
+* pending -> paid -> refunding -> refunded
+* pending -> expired
+* pending -> cancelled
+* The seats of a pending order are locked, paying sells them,
+* expiring or refunding makes them available again.
+* Cancelling reservations one by one closes the order (cancelled or refunded)
+* once none of its reservations is active.
+ */
+
+type OrderService interface {
+	GetOrderByID(orderID uint) (*model.Order, error)
+	GetOrdersByUserID(userID uint) ([]model.Order, error)
+	// Pay charges the order through the payment provider and sells its seats
+	Pay(orderID, userID uint) (*model.Order, error)
+	// Refund gives the rest of the amount back and releases the seats of a paid order
+	Refund(orderID uint) (*model.Order, error)
+	// RefundReservationTx settles a reservation cancelled in tx, percent of its price is given back
+	// when its order is paid. The money is paid out by ProcessRefunds once tx commits.
+	// It fails with ErrOrderRefunding while the whole order is being refunded.
+	RefundReservationTx(tx *gorm.DB, reservation *model.Reservation, percent int) (*model.Refund, error)
+	// ProcessRefunds pays out the due pending refunds through the provider and returns how many succeeded,
+	// failed ones are retried with an exponential backoff
+	ProcessRefunds() (int, error)
+	// HandleWebhook applies a signature-verified provider webhook, redelivered events are ignored.
+	// An event the order can't take anymore, e.g. a capture of an expired order, is recorded
+	// and reported with ErrPaymentEventMismatch so it isn't sent again.
+	HandleWebhook(payload []byte, signature string) error
+	// ExpirePendingOrders expires the unpaid orders whose hold is over and frees their seats
+	ExpirePendingOrders() (int, error)
+}
+
+type orderService struct {
+	db                  *gorm.DB
+	repo                repository.OrderRepo
+	reservationRepo     repository.ReservationRepo
+	paymentEventRepo    repository.PaymentEventRepo
+	refundRepo          repository.RefundRepo
+	showtimeSeatService ShowtimeSeatService
+	provider            payment.PaymentProvider
+	bus                 *event.Bus
+}
+
+var _ OrderService = (*orderService)(nil)
+
+func NewOrderService(db *gorm.DB, orderRepo repository.OrderRepo, reservationRepo repository.ReservationRepo,
+	paymentEventRepo repository.PaymentEventRepo, refundRepo repository.RefundRepo, showtimeSeatService ShowtimeSeatService,
+	provider payment.PaymentProvider, bus *event.Bus) *orderService {
+	return &orderService{
+		db:                  db,
+		repo:                orderRepo,
+		reservationRepo:     reservationRepo,
+		paymentEventRepo:    paymentEventRepo,
+		refundRepo:          refundRepo,
+		showtimeSeatService: showtimeSeatService,
+		provider:            provider,
+		bus:                 bus,
+	}
+}
+
+func (s *orderService) GetOrderByID(orderID uint) (*model.Order, error) {
+	order, err := s.repo.GetByID(orderID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *orderService) GetOrdersByUserID(userID uint) ([]model.Order, error) {
+	return s.repo.GetByUserID(userID)
+}
+
+func (s *orderService) Pay(orderID, userID uint) (*model.Order, error) {
+	ctx := context.Background()
+
+	// validate before calling the provider, the provider is not called inside a transaction
+	order, err := s.GetOrderByID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, ErrOrderNotOwned
+	}
+	if err := checkPayable(order); err != nil {
+		return nil, err
+	}
+
+	reference, err := s.provider.Authorize(ctx, order.ID, order.Amount)
+	if err != nil {
+		return nil, err
+	}
+	// the reference is saved before capturing, so the webhook of the capture finds the order
+	// even when this call dies before the order is marked paid
+	pending, err := s.repo.UpdatePendingPaymentRef(order.ID, reference)
+	if err != nil {
+		return nil, err
+	}
+	if !pending {
+		return nil, ErrOrderNotPending
+	}
+	if err := s.provider.Capture(ctx, reference); err != nil {
+		return nil, err
+	}
+
+	err = s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		return s.markPaidTx(tx, order.ID, reference, order.Amount)
+	})
+	if err != nil {
+		// the seats weren't sold (the order expired or got cheaper, a hold was lost, the database failed...),
+		// give the money back
+		if refundErr := s.provider.Refund(ctx, reference, order.Amount); refundErr != nil {
+			return nil, errors.Join(err, refundErr)
+		}
+		return nil, err
+	}
+	return s.GetOrderByID(order.ID)
+}
+
+func checkPayable(order *model.Order) error {
+	if order.Status != model.OrderPending {
+		return ErrOrderNotPending
+	}
+	if order.ExpiresAt.Before(time.Now()) {
+		return ErrOrderExpired
+	}
+	return nil
+}
+
+// markPaidTx sells the seats of a pending order whose amount is still the captured amount,
+// paying an already paid order is a no-op
+func (s *orderService) markPaidTx(tx *gorm.DB, orderID uint, reference string, amount int64) error {
+	order, err := s.repo.WithTx(tx).GetByIDForUpdate(orderID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if order.Status == model.OrderPaid && order.PaymentRef == reference {
+		return nil
+	}
+	if err := checkPayable(order); err != nil {
+		return err
+	}
+	// a reservation cancelled since the amount was read made the order cheaper than what was charged
+	if order.Amount != amount {
+		return ErrOrderAmountChanged
+	}
+
+	reservations, err := s.reservationRepo.WithTx(tx).GetByOrderID(order.ID)
+	if err != nil {
+		return err
+	}
+	for _, reservation := range reservations {
+		// reservations cancelled before paying are not part of the order anymore
+		if reservation.Status != model.ReservationActive {
+			continue
+		}
+		showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDTx(tx, reservation.ShowtimeID, reservation.SeatID)
+		if err != nil {
+			return err
+		}
+		if err := s.showtimeSeatService.ConfirmShowtimeSeatTx(tx, showtimeSeat.ID, order.UserID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	order.Status = model.OrderPaid
+	order.PaymentRef = reference
+	order.PaidAt = &now
+	return s.repo.WithTx(tx).Update(order)
+}
+
+func (s *orderService) Refund(orderID uint) (*model.Order, error) {
+	ctx := context.Background()
+
+	// moving the order to refunding under the row lock lets only one of two concurrent refunds pay out
+	var order *model.Order
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = s.repo.WithTx(tx).GetByIDForUpdate(orderID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if order.Status != model.OrderPaid {
+			return ErrOrderNotPaid
+		}
+		order.Status = model.OrderRefunding
+		return s.repo.WithTx(tx).Update(order)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.provider.Refund(ctx, order.PaymentRef, order.Amount-order.RefundedAmount); err != nil {
+		// nothing was paid out, the refund can be tried again
+		restoreErr := s.db.Transaction(func(tx *gorm.DB) error {
+			order, err := s.repo.WithTx(tx).GetByIDForUpdate(orderID)
+			if err != nil {
+				return err
+			}
+			if order.Status != model.OrderRefunding {
+				return nil
+			}
+			order.Status = model.OrderPaid
+			return s.repo.WithTx(tx).Update(order)
+		})
+		return nil, errors.Join(err, restoreErr)
+	}
+	// when this fails, the payment.refunded webhook of the provider finishes the refund
+	err = s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		return s.markRefundedTx(tx, order.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetOrderByID(order.ID)
+}
+
+// markRefundedTx frees the seats of a paid or refunding order, refunding an already refunded order is a no-op
+func (s *orderService) markRefundedTx(tx *gorm.DB, orderID uint) error {
+	order, err := s.repo.WithTx(tx).GetByIDForUpdate(orderID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if order.Status == model.OrderRefunded {
+		return nil
+	}
+	if order.Status != model.OrderPaid && order.Status != model.OrderRefunding {
+		return ErrOrderNotPaid
+	}
+	released, err := s.releaseOrderSeatsTx(tx, order, model.ReservationCancelled)
+	if err != nil {
+		return err
+	}
+	for _, reservation := range released {
+		// the whole order was given back in one provider refund already
+		if err := s.refundRepo.WithTx(tx).Create(&model.Refund{
+			ReservationID: reservation.ID,
+			OrderID:       &order.ID,
+			UserID:        reservation.UserID,
+			Percent:       100,
+			Amount:        reservation.Price,
+			Status:        model.RefundSucceeded,
+			PaymentRef:    order.PaymentRef,
+		}); err != nil {
+			return err
+		}
+	}
+	order.Status = model.OrderRefunded
+	order.RefundedAmount = order.Amount
+	return s.repo.WithTx(tx).Update(order)
+}
+
+// releaseOrderSeatsTx makes the seats of the active reservations of the order available
+// and moves those reservations to status, it returns the released reservations
+func (s *orderService) releaseOrderSeatsTx(tx *gorm.DB, order *model.Order, status model.ReservationStatus) ([]model.Reservation, error) {
+	reservations, err := s.reservationRepo.WithTx(tx).GetByOrderID(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	var released []model.Reservation
+	now := time.Now()
+	for _, reservation := range reservations {
+		if reservation.Status != model.ReservationActive {
+			continue
+		}
+		showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDTx(tx, reservation.ShowtimeID, reservation.SeatID)
+		if err != nil {
+			return nil, err
+		}
+		err = s.showtimeSeatService.UpdateShowtimeSeatStatusToAvailableTx(tx, showtimeSeat.ID)
+		if err != nil && !errors.Is(err, ErrShowtimeSeatStatusNotChange) {
+			return nil, err
+		}
+		reservation.Status = status
+		if status == model.ReservationCancelled {
+			reservation.CancelledAt = &now
+		}
+		if err := s.reservationRepo.WithTx(tx).Update(&reservation); err != nil {
+			return nil, err
+		}
+		released = append(released, reservation)
+	}
+	return released, nil
+}
+
+func (s *orderService) RefundReservationTx(tx *gorm.DB, reservation *model.Reservation, percent int) (*model.Refund, error) {
+	refund := &model.Refund{
+		ReservationID: reservation.ID,
+		OrderID:       reservation.OrderID,
+		UserID:        reservation.UserID,
+		Percent:       percent,
+		Status:        model.RefundSucceeded,
+	}
+	// reservations booked before orders existed have nothing to refund
+	var order *model.Order
+	if reservation.OrderID != nil {
+		var err error
+		order, err = s.repo.WithTx(tx).GetByIDForUpdate(*reservation.OrderID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+		reservations, err := s.reservationRepo.WithTx(tx).GetByOrderID(order.ID)
+		if err != nil {
+			return nil, err
+		}
+		active := slices.ContainsFunc(reservations, func(r model.Reservation) bool {
+			return r.ID != reservation.ID && r.Status == model.ReservationActive
+		})
+
+		switch order.Status {
+		case model.OrderPending:
+			// nothing was charged yet, the order just gets cheaper
+			order.Amount -= reservation.Price
+			if !active {
+				order.Status = model.OrderCancelled
+			}
+		case model.OrderPaid:
+			refund.Amount = reservation.Price * int64(percent) / 100
+			refund.PaymentRef = order.PaymentRef
+			order.RefundedAmount += refund.Amount
+			// a fully cancelled order is closed even if the policy kept part of the money
+			if !active {
+				order.Status = model.OrderRefunded
+			}
+		case model.OrderRefunding:
+			// the refund of the whole order settles the reservation once the provider answers
+			return nil, ErrOrderRefunding
+		}
+		if err := s.repo.WithTx(tx).Update(order); err != nil {
+			return nil, err
+		}
+	}
+	// the provider isn't called in tx, a commit failing after the payout would lose the money
+	if refund.Amount > 0 {
+		refund.Status = model.RefundPending
+		refund.NextAttemptAt = time.Now()
+	}
+	if err := s.refundRepo.WithTx(tx).Create(refund); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+const (
+	// refundBatchSize caps how many refunds one ProcessRefunds call pays out
+	refundBatchSize = 100
+	// refundRetryBackoff is the delay before the first retry of a refund, it doubles after every failure
+	refundRetryBackoff = time.Minute
+)
+
+// ProcessRefunds claims the refunds in a short transaction before calling the provider, so a refund is
+// never paid out twice. One whose result can't be recorded stays processing.
+func (s *orderService) ProcessRefunds() (int, error) {
+	var refunds []model.Refund
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		refunds, err = s.refundRepo.WithTx(tx).GetDueForUpdate(time.Now(), refundBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range refunds {
+			refunds[i].Status = model.RefundProcessing
+			refunds[i].Attempts++
+			if err := s.refundRepo.WithTx(tx).Update(&refunds[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var succeeded int
+	var errs []error
+	for i := range refunds {
+		refund := &refunds[i]
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		err := s.provider.Refund(ctx, refund.PaymentRef, refund.Amount)
+		cancel()
+		if err != nil {
+			refund.Status = model.RefundPending
+			refund.LastError = err.Error()
+			refund.NextAttemptAt = time.Now().Add(retryDelay(refundRetryBackoff, refund.Attempts))
+		} else {
+			refund.Status = model.RefundSucceeded
+			refund.LastError = ""
+			succeeded++
+		}
+		if err := s.refundRepo.Update(refund); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return succeeded, errors.Join(errs...)
+}
+
+func (s *orderService) HandleWebhook(payload []byte, signature string) error {
+	event, err := s.provider.VerifyWebhook(payload, signature)
+	if err != nil {
+		return err
+	}
+	var mismatch error
+	err = s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		// the provider may deliver the same event several times
+		_, err := s.paymentEventRepo.WithTx(tx).GetByID(event.ID)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		order, err := s.repo.WithTx(tx).GetByPaymentRef(event.Reference)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		switch event.Type {
+		case payment.EventPaymentCaptured:
+			err = s.markPaidTx(tx, order.ID, event.Reference, event.Amount)
+		case payment.EventPaymentRefunded:
+			// the partial refunds of cancelled reservations are already applied
+			if event.Amount >= order.Amount-order.RefundedAmount {
+				err = s.markRefundedTx(tx, order.ID)
+			}
+		case payment.EventPaymentFailed:
+			// the order stays pending, the user can pay again until it expires
+		default:
+			return ErrUnknownPaymentEvent
+		}
+		// the order moved on (expired, cancelled, refunded...) and retrying the event can't change that,
+		// Pay already refunded a capture it couldn't apply
+		if errors.Is(err, ErrOrderNotPending) || errors.Is(err, ErrOrderExpired) || errors.Is(err, ErrOrderNotPaid) ||
+			errors.Is(err, ErrOrderAmountChanged) {
+			mismatch = err
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		paymentEvent := &model.PaymentEvent{
+			ID:         event.ID,
+			OrderID:    order.ID,
+			Type:       string(event.Type),
+			ReceivedAt: time.Now(),
+		}
+		if mismatch != nil {
+			paymentEvent.Mismatch = mismatch.Error()
+		}
+		// a duplicate delivery racing with this one fails on the primary key and is retried by the provider
+		return s.paymentEventRepo.WithTx(tx).Create(paymentEvent)
+	})
+	if err != nil {
+		return err
+	}
+	if mismatch != nil {
+		return fmt.Errorf("%w: %s %s of order with reference %s: %w", ErrPaymentEventMismatch, event.Type, event.ID,
+			event.Reference, mismatch)
+	}
+	return nil
+}
+
+func (s *orderService) ExpirePendingOrders() (int, error) {
+	var expired int
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		orders, err := s.repo.WithTx(tx).GetExpiredPending(time.Now())
+		if err != nil {
+			return err
+		}
+		for i := range orders {
+			order, err := s.repo.WithTx(tx).GetByIDForUpdate(orders[i].ID)
+			if err != nil {
+				return err
+			}
+			// it may have been paid in the meantime
+			if order.Status != model.OrderPending {
+				continue
+			}
+			if _, err := s.releaseOrderSeatsTx(tx, order, model.ReservationExpired); err != nil {
+				return err
+			}
+			order.Status = model.OrderExpired
+			if err := s.repo.WithTx(tx).Update(order); err != nil {
+				return err
+			}
+			expired++
+		}
+		return nil
+	})
+	return expired, err
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"math"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// All prices are in cents
+type PricingService interface {
+	SetShowtimeBasePrice(showtimeID uint, basePrice int64) error
+	SetSeatClass(hallID, seatID uint, class model.SeatClass) error
+	// SetClassMultipliers only overwrites the multipliers of the given classes
+	SetClassMultipliers(hallID uint, multipliers map[model.SeatClass]float64) error
+	// GetClassMultipliers returns the multiplier of every seat class of the hall, 1 if it was never set
+	GetClassMultipliers(hallID uint) (map[model.SeatClass]float64, error)
+	// PriceSeatTx computes the current price of the seat for the showtime
+	PriceSeatTx(tx *gorm.DB, showtime *model.Showtime, seatID uint) (int64, error)
+}
+
+type pricingService struct {
+	db                 *gorm.DB
+	seatClassPriceRepo repository.SeatClassPriceRepo
+	seatRepo           repository.SeatRepo
+	showtimeRepo       repository.ShowtimeRepo
+	hallRepo           repository.HallRepo
+}
+
+var _ PricingService = (*pricingService)(nil)
+
+func NewPricingService(db *gorm.DB, seatClassPriceRepo repository.SeatClassPriceRepo, seatRepo repository.SeatRepo,
+	showtimeRepo repository.ShowtimeRepo, hallRepo repository.HallRepo) *pricingService {
+	return &pricingService{
+		db:                 db,
+		seatClassPriceRepo: seatClassPriceRepo,
+		seatRepo:           seatRepo,
+		showtimeRepo:       showtimeRepo,
+		hallRepo:           hallRepo,
+	}
+}
+
+var (
+	ErrInvalidPrice      = errors.New("price must not be negative")
+	ErrInvalidSeatClass  = errors.New("unknown seat class")
+	ErrInvalidMultiplier = errors.New("price multiplier must be positive")
+)
+
+func (s *pricingService) SetShowtimeBasePrice(showtimeID uint, basePrice int64) error {
+	if basePrice < 0 {
+		return ErrInvalidPrice
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.showtimeRepo.WithTx(tx).GetByID(showtimeID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		return s.showtimeRepo.WithTx(tx).UpdateBasePrice(showtimeID, basePrice)
+	})
+}
+
+func (s *pricingService) SetSeatClass(hallID, seatID uint, class model.SeatClass) error {
+	if !class.Valid() {
+		return ErrInvalidSeatClass
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		seat, err := s.seatRepo.WithTx(tx).GetByID(seatID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		// the seat must belong to the hall of the route
+		if seat.HallID != hallID {
+			return ErrNotFound
+		}
+		return s.seatRepo.WithTx(tx).UpdateClass(seatID, class)
+	})
+}
+
+func (s *pricingService) SetClassMultipliers(hallID uint, multipliers map[model.SeatClass]float64) error {
+	for class, multiplier := range multipliers {
+		if !class.Valid() {
+			return ErrInvalidSeatClass
+		}
+		if multiplier <= 0 {
+			return ErrInvalidMultiplier
+		}
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.hallRepo.WithTx(tx).GetByID(hallID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		for class, multiplier := range multipliers {
+			if err := s.seatClassPriceRepo.WithTx(tx).Save(&model.SeatClassPrice{
+				HallID:     hallID,
+				Class:      class,
+				Multiplier: multiplier,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *pricingService) GetClassMultipliers(hallID uint) (map[model.SeatClass]float64, error) {
+	if _, err := s.hallRepo.GetByID(hallID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	prices, err := s.seatClassPriceRepo.GetByHallID(hallID)
+	if err != nil {
+		return nil, err
+	}
+	multipliers := make(map[model.SeatClass]float64, len(model.SeatClasses))
+	for _, class := range model.SeatClasses {
+		multipliers[class] = 1
+	}
+	for _, price := range prices {
+		multipliers[price.Class] = price.Multiplier
+	}
+	return multipliers, nil
+}
+
+func (s *pricingService) PriceSeatTx(tx *gorm.DB, showtime *model.Showtime, seatID uint) (int64, error) {
+	seat, err := s.seatRepo.WithTx(tx).GetByID(seatID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	multiplier := 1.0
+	price, err := s.seatClassPriceRepo.WithTx(tx).GetByHallIDClass(seat.HallID, seat.Class)
+	if err == nil {
+		multiplier = price.Multiplier
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	return int64(math.Round(float64(showtime.BasePrice) * multiplier)), nil
+}
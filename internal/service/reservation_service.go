@@ -2,16 +2,44 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"time"
 
 	"gorm.io/gorm"
 
+	"github.com/qs-lzh/movie-reservation/config"
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
 	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/notify"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
 )
 
 type ReservationService interface {
-	Reserve(userID, showtimeID, seatID uint) error
-	CancelReservation(reservationID uint) error
+	// Reserve creates a pending order with one reservation per seat and holds the seats until the hold expires,
+	// the seats are given by ID, by label (e.g. "F7") or both.
+	// In a hall preventing orphan seats, it returns an *OrphanSeatError for a selection isolating a seat.
+	Reserve(userID, showtimeID uint, seatIDs []uint, seatLabels []string) (*Hold, error)
+	// ReserveBestAvailable holds the best count available seats of the showtime, see recommendSeats
+	ReserveBestAvailable(userID, showtimeID uint, count int) (*SeatRecommendation, *Hold, error)
+	// CancelReservation keeps the reservation as a cancelled row, frees its seat
+	// and refunds it following the cancellation policy
+	CancelReservation(reservationID uint) (*model.Refund, error)
+	// ReleaseExpiredHolds expires unpaid reservations whose hold expired and frees their seats
+	ReleaseExpiredHolds() (int, error)
+	// JoinWaitlist queues the user for seats of a sold-out showtime,
+	// freed seats are then held for the first waiting user for the offer TTL
+	JoinWaitlist(userID, showtimeID uint, seats int) (*model.WaitlistEntry, error)
+	// LeaveWaitlist drops a waiting entry of the user
+	LeaveWaitlist(userID, entryID uint) error
+	GetWaitlistByUserID(userID uint) ([]model.WaitlistEntry, error)
+	// ProcessWaitlists settles the lapsed and paid offers and offers the free seats to the waiting users,
+	// it returns how many offers were made
+	ProcessWaitlists() (int, error)
+	// OfferWaitlist offers the free seats of the showtime to its waiting users and returns how many offers were made,
+	// it subscribes to the cancellations so a freed seat goes to the waitlist before the next sweep
+	OfferWaitlist(showtimeID uint) (int, error)
+	GetRemainingTickets(showtimeID uint) (int, error)
 	GetRemainingTicketsTx(tx *gorm.DB, showtime *model.Showtime) (int, error)
 	GetReservationsByUserID(userID uint) ([]model.Reservation, error)
 	GetReservationsByUserIDTx(tx *gorm.DB, userID uint) ([]model.Reservation, error)
@@ -21,26 +49,66 @@ type ReservationService interface {
 type reservationService struct {
 	db                  *gorm.DB
 	repo                repository.ReservationRepo
+	orderRepo           repository.OrderRepo
 	showtimeRepo        repository.ShowtimeRepo
 	hallRepo            repository.HallRepo
+	seatRepo            repository.SeatRepo
 	showtimeSeatService ShowtimeSeatService
+	pricingService      PricingService
+	orderService        OrderService
+	waitlistRepo        repository.WaitlistRepo
+	notificationService NotificationService
+	holdTTL             time.Duration
+	offerTTL            time.Duration
+	maxSeatsPerUser     int
+	cancellationPolicy  []config.RefundTier
+	bus                 *event.Bus
 }
 
 var _ ReservationService = (*reservationService)(nil)
 
-func NewReservationService(db *gorm.DB, reservationRepo repository.ReservationRepo,
-	showtimeRepo repository.ShowtimeRepo, hallRepo repository.HallRepo, showtimeSeatService ShowtimeSeatService) *reservationService {
+func NewReservationService(db *gorm.DB, reservationRepo repository.ReservationRepo, orderRepo repository.OrderRepo,
+	showtimeRepo repository.ShowtimeRepo, hallRepo repository.HallRepo, seatRepo repository.SeatRepo,
+	showtimeSeatService ShowtimeSeatService, pricingService PricingService, orderService OrderService,
+	waitlistRepo repository.WaitlistRepo, notificationService NotificationService, holdTTL, offerTTL time.Duration,
+	maxSeatsPerUser int, cancellationPolicy []config.RefundTier, bus *event.Bus) *reservationService {
 	return &reservationService{
 		db:                  db,
 		repo:                reservationRepo,
+		orderRepo:           orderRepo,
 		showtimeRepo:        showtimeRepo,
 		hallRepo:            hallRepo,
+		seatRepo:            seatRepo,
 		showtimeSeatService: showtimeSeatService,
+		pricingService:      pricingService,
+		orderService:        orderService,
+		waitlistRepo:        waitlistRepo,
+		notificationService: notificationService,
+		holdTTL:             holdTTL,
+		offerTTL:            offerTTL,
+		maxSeatsPerUser:     maxSeatsPerUser,
+		cancellationPolicy:  cancellationPolicy,
+		bus:                 bus,
 	}
 }
 
-func (s *reservationService) Reserve(userID, showtimeID, seatID uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
+// Hold is a group of reservations whose seats stay locked until ExpiresAt unless their order is paid
+type Hold struct {
+	OrderID      uint                `json:"order_id"`
+	Reservations []model.Reservation `json:"reservations"`
+	// TotalPrice is the sum of the reservation prices, in cents
+	TotalPrice int64     `json:"total_price"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Reserve is all-or-nothing: if any of the seats can't be held, nothing is reserved
+func (s *reservationService) Reserve(userID, showtimeID uint, seatIDs []uint, seatLabels []string) (*Hold, error) {
+	if len(seatIDs)+len(seatLabels) == 0 {
+		return nil, ErrInvalidSeatSelection
+	}
+
+	var hold *Hold
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		// check if showtime exists
 		showtime, err := s.showtimeRepo.WithTx(tx).GetByID(showtimeID)
 		if err != nil {
@@ -50,50 +118,264 @@ func (s *reservationService) Reserve(userID, showtimeID, seatID uint) error {
 			return err
 		}
 
-		// check if there's tickets available
-		if _, err := s.GetRemainingTicketsTx(tx, showtime); err != nil {
+		labelledSeatIDs, err := s.seatIDsByLabelsTx(tx, showtime.HallID, seatLabels)
+		if err != nil {
+			return err
+		}
+		seatIDs, err := normalizeSeatIDs(append(slices.Clone(seatIDs), labelledSeatIDs...))
+		if err != nil {
 			return err
 		}
 
-		// check if the user already have the same reservation
-		reservations, err := s.repo.WithTx(tx).GetByUserID(userID)
+		hold, err = s.holdSeatsTx(tx, userID, showtime, seatIDs, s.holdTTL)
 		if err != nil {
 			return err
 		}
-		for _, reservation := range reservations {
-			if reservation.ShowtimeID == showtimeID {
-				return ErrAlreadyReserved
+		return s.notificationService.EnqueueTx(tx, holdNotification(userID, showtime, hold))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (s *reservationService) ReserveBestAvailable(userID, showtimeID uint, count int) (*SeatRecommendation, *Hold, error) {
+	if count < 1 {
+		return nil, nil, ErrInvalidSeatSelection
+	}
+	if count > s.maxSeatsPerUser {
+		return nil, nil, ErrSeatLimitExceeded
+	}
+
+	var recommendation *SeatRecommendation
+	var hold *Hold
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		showtime, err := s.showtimeRepo.WithTx(tx).GetByID(showtimeID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrShowtimeNotExist
+			}
+			return err
+		}
+		hall, err := s.hallRepo.WithTx(tx).GetByID(showtime.HallID)
+		if err != nil {
+			return err
+		}
+		// lock the seats of the showtime so the recommended seats stay available until they are held
+		showtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx(tx, showtimeID)
+		if err != nil {
+			return err
+		}
+		recommendation = recommendSeats(showtime, hall, showtimeSeats, count)
+		if recommendation == nil {
+			return ErrNoTicketsAvailable
+		}
+		hold, err = s.holdSeatsTx(tx, userID, showtime, recommendation.seatIDs(), s.holdTTL)
+		if err != nil {
+			return err
+		}
+		return s.notificationService.EnqueueTx(tx, holdNotification(userID, showtime, hold))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return recommendation, hold, nil
+}
+
+func holdNotification(userID uint, showtime *model.Showtime, hold *Hold) notify.Notification {
+	return notify.Notification{
+		UserID:  userID,
+		Subject: "Your seats are held",
+		Body: fmt.Sprintf("%d seats of showtime %d are held for you until %s, pay order %d to keep them.",
+			len(hold.Reservations), showtime.ID, hold.ExpiresAt.Format(time.RFC1123), hold.OrderID),
+	}
+}
+
+// holdSeatsTx creates the pending order of the user and holds every seat for it during ttl
+func (s *reservationService) holdSeatsTx(tx *gorm.DB, userID uint, showtime *model.Showtime, seatIDs []uint,
+	ttl time.Duration) (*Hold, error) {
+	showtimeID := showtime.ID
+
+	// check if there's enough tickets available
+	remainingTickets, err := s.GetRemainingTicketsTx(tx, showtime)
+	if err != nil {
+		return nil, err
+	}
+	if remainingTickets < len(seatIDs) {
+		return nil, ErrNoTicketsAvailable
+	}
+
+	// check the user stays within the per-showtime seat limit
+	reservations, err := s.repo.WithTx(tx).GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	reservedSeats := 0
+	for _, reservation := range reservations {
+		if reservation.ShowtimeID == showtimeID && reservation.Status == model.ReservationActive {
+			reservedSeats++
+		}
+	}
+	if reservedSeats+len(seatIDs) > s.maxSeatsPerUser {
+		return nil, ErrSeatLimitExceeded
+	}
+
+	// check the selection leaves no isolated seat when the hall asks for it
+	hall, err := s.hallRepo.WithTx(tx).GetByID(showtime.HallID)
+	if err != nil {
+		return nil, err
+	}
+	if hall.PreventOrphanSeats {
+		// lock the seats of the showtime so no concurrent reservation changes the row under us
+		showtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx(tx, showtimeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkOrphanSeats(hall, showtimeSeats, seatIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	// reserve and hold every seat until the order is paid or the hold expires
+	expiresAt := time.Now().Add(ttl)
+	order := &model.Order{
+		UserID:    userID,
+		Status:    model.OrderPending,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.orderRepo.WithTx(tx).Create(order); err != nil {
+		return nil, err
+	}
+	hold := &Hold{OrderID: order.ID, ExpiresAt: expiresAt}
+	for _, seatID := range seatIDs {
+		// lock the row so concurrent reservations of this seat wait for us
+		showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDForUpdateTx(tx, showtimeID, seatID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrInvalidSeatSelection
 			}
+			return nil, err
+		}
+		if showtimeSeat.Status != model.StatusAvailable {
+			return nil, ErrSeatUnavailable
+		}
+		// only an available seat can be held, so at most one transaction wins the seat
+		if err := s.showtimeSeatService.HoldShowtimeSeatTx(tx, showtimeSeat.ID, userID, expiresAt); err != nil {
+			return nil, err
 		}
 
-		// reserve
-		if err = s.repo.WithTx(tx).Create(&model.Reservation{
+		// snapshot the price so later price changes don't rewrite the reservation
+		price, err := s.pricingService.PriceSeatTx(tx, showtime, seatID)
+		if err != nil {
+			return nil, err
+		}
+		reservation := model.Reservation{
 			ShowtimeID: showtimeID,
 			SeatID:     seatID,
 			UserID:     userID,
-		}); err != nil {
-			return err
+			OrderID:    &order.ID,
+			Price:      price,
+			Status:     model.ReservationActive,
 		}
-
-		// change showtimeSeat status
-		showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDTx(tx, showtimeID, seatID)
+		if err = s.repo.WithTx(tx).Create(&reservation); err != nil {
+			return nil, err
+		}
+		seat, err := s.seatRepo.WithTx(tx).GetByID(seatID)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return s.showtimeSeatService.UpdateShowtimeSeatStatusToLockedTx(tx, showtimeSeat.ID)
-	})
+		reservation.Seat = *seat
+		hold.Reservations = append(hold.Reservations, reservation)
+		hold.TotalPrice += price
+	}
+
+	order.Amount = hold.TotalPrice
+	if err := s.orderRepo.WithTx(tx).Update(order); err != nil {
+		return nil, err
+	}
+
+	created := event.ReservationCreated{
+		OrderID:    order.ID,
+		UserID:     userID,
+		ShowtimeID: showtimeID,
+		SeatIDs:    seatIDs,
+		ExpiresAt:  expiresAt,
+	}
+	for _, reservation := range hold.Reservations {
+		created.ReservationIDs = append(created.ReservationIDs, reservation.ID)
+	}
+	s.bus.Record(tx, created)
+	return hold, nil
 }
 
-func (s *reservationService) CancelReservation(reservationID uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		reservation, err := s.repo.WithTx(tx).GetByID(reservationID)
+// seatIDsByLabelsTx resolves seat labels of the hall to seat IDs, any unknown label is an invalid selection
+func (s *reservationService) seatIDsByLabelsTx(tx *gorm.DB, hallID uint, labels []string) ([]uint, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	seats, err := s.seatRepo.WithTx(tx).GetByHallIDLabels(hallID, labels)
+	if err != nil {
+		return nil, err
+	}
+	seatIDByLabel := make(map[string]uint, len(seats))
+	for _, seat := range seats {
+		seatIDByLabel[seat.Label] = seat.ID
+	}
+	seatIDs := make([]uint, 0, len(labels))
+	for _, label := range labels {
+		seatID, ok := seatIDByLabel[label]
+		if !ok {
+			return nil, ErrInvalidSeatSelection
+		}
+		seatIDs = append(seatIDs, seatID)
+	}
+	return seatIDs, nil
+}
+
+// normalizeSeatIDs rejects empty or duplicated selections and sorts the seat IDs,
+// so concurrent group bookings always touch the seats in the same order
+func normalizeSeatIDs(seatIDs []uint) ([]uint, error) {
+	if len(seatIDs) == 0 {
+		return nil, ErrInvalidSeatSelection
+	}
+	sorted := slices.Clone(seatIDs)
+	slices.Sort(sorted)
+	if len(slices.Compact(slices.Clone(sorted))) != len(sorted) {
+		return nil, ErrInvalidSeatSelection
+	}
+	return sorted, nil
+}
+
+func (s *reservationService) CancelReservation(reservationID uint) (*model.Refund, error) {
+	var refund *model.Refund
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		// lock the row so the same reservation can't be cancelled and refunded twice
+		reservation, err := s.repo.WithTx(tx).GetByIDForUpdate(reservationID)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				return ErrNotFound
 			}
 			return err
 		}
-		if err := s.repo.WithTx(tx).DeleteByID(reservationID); err != nil {
+		if reservation.Status != model.ReservationActive {
+			return ErrReservationNotActive
+		}
+
+		showtime, err := s.showtimeRepo.WithTx(tx).GetByID(reservation.ShowtimeID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrShowtimeNotExist
+			}
+			return err
+		}
+		now := time.Now()
+		if !now.Before(showtime.StartAt) {
+			return ErrShowtimeStarted
+		}
+
+		reservation.Status = model.ReservationCancelled
+		reservation.CancelledAt = &now
+		if err := s.repo.WithTx(tx).Update(reservation); err != nil {
 			return err
 		}
 
@@ -102,34 +384,114 @@ func (s *reservationService) CancelReservation(reservationID uint) error {
 		if err != nil {
 			return err
 		}
-		return s.showtimeSeatService.UpdateShowtimeSeatStatusToAvailableTx(tx, showtimeSeat.ID)
-	})
-}
+		if err := s.showtimeSeatService.UpdateShowtimeSeatStatusToAvailableTx(tx, showtimeSeat.ID); err != nil {
+			return err
+		}
 
-func (s *reservationService) GetRemainingTicketsTx(tx *gorm.DB, showtime *model.Showtime) (int, error) {
-	var remainingTickets int
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		reservations, err := s.repo.WithTx(tx).GetByShowtimeID(showtime.ID)
+		percent := refundPercent(s.cancellationPolicy, showtime.StartAt.Sub(now))
+		refund, err = s.orderService.RefundReservationTx(tx, reservation, percent)
 		if err != nil {
 			return err
 		}
-		hall, err := s.hallRepo.WithTx(tx).GetByID(showtime.HallID)
+		if err := s.notificationService.EnqueueTx(tx, notify.Notification{
+			UserID:  reservation.UserID,
+			Subject: "Your reservation was cancelled",
+			Body: fmt.Sprintf("Reservation %d of showtime %d was cancelled, %d%% of its price is refunded.",
+				reservation.ID, showtime.ID, percent),
+		}); err != nil {
+			return err
+		}
+		s.bus.Record(tx, event.ReservationCancelled{
+			ReservationID: reservation.ID,
+			UserID:        reservation.UserID,
+			ShowtimeID:    reservation.ShowtimeID,
+			SeatID:        reservation.SeatID,
+			RefundPercent: percent,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// refundPercent returns the percent of the first tier the cancellation is early enough for, 0 if none
+func refundPercent(policy []config.RefundTier, untilStart time.Duration) int {
+	for _, tier := range policy {
+		if untilStart >= tier.Before {
+			return tier.Percent
+		}
+	}
+	return 0
+}
+
+func (s *reservationService) ReleaseExpiredHolds() (int, error) {
+	var released int
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		expiredHolds, err := s.showtimeSeatService.GetExpiredHoldsTx(tx, time.Now())
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return ErrNotFound
-			}
 			return err
 		}
-		remainingTickets = hall.SeatCount - len(reservations)
-		if remainingTickets <= 0 {
-			return ErrNoTicketsAvailable
+		for _, showtimeSeat := range expiredHolds {
+			reservation, err := s.repo.WithTx(tx).GetActiveByShowtimeIDSeatID(showtimeSeat.ShowtimeID, showtimeSeat.SeatID)
+			if err == nil {
+				reservation.Status = model.ReservationExpired
+				if err := s.repo.WithTx(tx).Update(reservation); err != nil {
+					return err
+				}
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err := s.showtimeSeatService.UpdateShowtimeSeatStatusToAvailableTx(tx, showtimeSeat.ID); err != nil {
+				return err
+			}
 		}
+		released = len(expiredHolds)
 		return nil
 	})
+	return released, err
+}
 
+func (s *reservationService) GetRemainingTickets(showtimeID uint) (int, error) {
+	showtime, err := s.showtimeRepo.GetByID(showtimeID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	remainingTickets, err := s.GetRemainingTicketsTx(s.db, showtime)
+	if errors.Is(err, ErrNoTicketsAvailable) {
+		return 0, nil
+	}
 	return remainingTickets, err
 }
 
+func (s *reservationService) GetRemainingTicketsTx(tx *gorm.DB, showtime *model.Showtime) (int, error) {
+	reservations, err := s.repo.WithTx(tx).GetActiveByShowtimeID(showtime.ID)
+	if err != nil {
+		return 0, err
+	}
+	hall, err := s.hallRepo.WithTx(tx).GetByID(showtime.HallID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	// blocked seats can't be sold
+	blockedSeats, err := s.showtimeSeatService.CountShowtimeSeatsByStatusTx(tx, showtime.ID, model.StatusBlocked)
+	if err != nil {
+		return 0, err
+	}
+	remainingTickets := hall.SeatCount - len(reservations) - blockedSeats
+	if remainingTickets <= 0 {
+		return 0, ErrNoTicketsAvailable
+	}
+	return remainingTickets, nil
+}
+
 func (s *reservationService) GetReservationsByUserID(userID uint) ([]model.Reservation, error) {
 	return s.GetReservationsByUserIDTx(s.db, userID)
 }
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/notify"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// openTestDB connects to the Postgres database of TEST_DATABASE_DSN and migrates the tables a reservation
+// touches, the test is skipped without it. The rows are named after the test run, so the database can be reused.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard, TranslateError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB.Close()
+	})
+	if err := db.AutoMigrate(
+		&model.User{},
+		&model.Movie{},
+		&model.Hall{},
+		&model.Seat{},
+		&model.Showtime{},
+		&model.ShowtimeSeat{},
+		&model.SeatClassPrice{},
+		&model.Order{},
+		&model.Reservation{},
+		&model.OutboxMessage{},
+	); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReserveConcurrentlyHasOneWinner(t *testing.T) {
+	db := openTestDB(t)
+	const contenders = 20
+	run := time.Now().UnixNano()
+
+	var users []model.User
+	for i := range contenders {
+		users = append(users, model.User{Name: fmt.Sprintf("reserve-%d-%d", run, i), HashedPassword: "-", Role: model.RoleUser})
+	}
+	if err := db.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	movie := model.Movie{Title: fmt.Sprintf("reserve-%d", run), RuntimeMinutes: 90}
+	if err := db.Create(&movie).Error; err != nil {
+		t.Fatal(err)
+	}
+	hall := model.Hall{Name: fmt.Sprintf("reserve-%d", run), SeatCount: 3, Rows: 1, Cols: 3}
+	if err := db.Create(&hall).Error; err != nil {
+		t.Fatal(err)
+	}
+	seats := []model.Seat{
+		{HallID: hall.ID, Row: 1, Col: 1, Label: "A1", Class: model.SeatClassStandard},
+		{HallID: hall.ID, Row: 1, Col: 2, Label: "A2", Class: model.SeatClassStandard},
+		{HallID: hall.ID, Row: 1, Col: 3, Label: "A3", Class: model.SeatClassStandard},
+	}
+	if err := db.Create(&seats).Error; err != nil {
+		t.Fatal(err)
+	}
+	startAt := time.Now().Add(24 * time.Hour)
+	showtime := model.Showtime{MovieID: movie.ID, HallID: hall.ID, StartAt: startAt, EndAt: startAt.Add(2 * time.Hour),
+		BasePrice: 1000}
+	if err := db.Create(&showtime).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	bus := event.NewBus(zap.NewNop())
+	reservationRepo := repository.NewReservationRepoGorm(db)
+	seatRepo := repository.NewSeatRepoGorm(db)
+	showtimeRepo := repository.NewShowtimeRepoGorm(db)
+	hallRepo := repository.NewHallRepoGorm(db)
+	seatService := NewseatService(db, seatRepo)
+	showtimeSeatService := NewShowtimeSeatService(db, repository.NewShowtimeSeatRepoGorm(db), seatService, nil, bus)
+	pricingService := NewPricingService(db, repository.NewSeatClassPriceRepoGorm(db), seatRepo, showtimeRepo, hallRepo)
+	notificationService := NewNotificationService(db, repository.NewOutboxRepoGorm(db), nil,
+		map[string]notify.Notifier{"log": notify.NewLogNotifier(zap.NewNop())}, 3, time.Minute)
+	s := NewReservationService(db, reservationRepo, repository.NewOrderRepoGorm(db), showtimeRepo, hallRepo, seatRepo,
+		showtimeSeatService, pricingService, nil, nil, notificationService, 10*time.Minute, 10*time.Minute, 4, nil, bus)
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return showtimeSeatService.InitShowtimeSeatsForShowtimeTx(tx, &showtime)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every contender asks for the same two seats, listed in different orders
+	holds := make([]*Hold, contenders)
+	errs := make([]error, contenders)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range contenders {
+		seatIDs := []uint{seats[0].ID, seats[1].ID}
+		if i%2 == 1 {
+			seatIDs = []uint{seats[1].ID, seats[0].ID}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			holds[i], errs[i] = s.Reserve(users[i].ID, showtime.ID, seatIDs, nil)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if winner != -1 {
+				t.Fatalf("users %d and %d both reserved the seats", users[winner].ID, users[i].ID)
+			}
+			winner = i
+		case !errors.Is(err, ErrSeatUnavailable) && !errors.Is(err, ErrNoTicketsAvailable):
+			t.Errorf("user %d: Reserve() error = %v, want ErrSeatUnavailable or ErrNoTicketsAvailable", users[i].ID, err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("nobody reserved the seats")
+	}
+	winnerID := users[winner].ID
+	hold := holds[winner]
+	if len(hold.Reservations) != 2 || hold.TotalPrice != 2000 {
+		t.Errorf("the hold has %d reservations for %d cents, want 2 for 2000", len(hold.Reservations), hold.TotalPrice)
+	}
+
+	// the losers rolled back their orders and reservations
+	var reservations []model.Reservation
+	if err := db.Where("showtime_id = ?", showtime.ID).Find(&reservations).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 2 {
+		t.Fatalf("the showtime has %d reservations, want 2", len(reservations))
+	}
+	for _, reservation := range reservations {
+		if reservation.UserID != winnerID || reservation.Status != model.ReservationActive ||
+			reservation.OrderID == nil || *reservation.OrderID != hold.OrderID {
+			t.Errorf("reservation %d is %s for user %d, want active for user %d in order %d", reservation.ID,
+				reservation.Status, reservation.UserID, winnerID, hold.OrderID)
+		}
+	}
+	var orders int64
+	if err := db.Model(&model.Order{}).Where("user_id IN (?)", db.Model(&model.User{}).Select("id").
+		Where("name LIKE ?", fmt.Sprintf("reserve-%d-%%", run))).Count(&orders).Error; err != nil {
+		t.Fatal(err)
+	}
+	if orders != 1 {
+		t.Errorf("the contenders have %d orders, want 1", orders)
+	}
+	var showtimeSeats []model.ShowtimeSeat
+	if err := db.Where("showtime_id = ?", showtime.ID).Order("seat_id").Find(&showtimeSeats).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, showtimeSeat := range showtimeSeats {
+		held := showtimeSeat.SeatID == seats[0].ID || showtimeSeat.SeatID == seats[1].ID
+		switch {
+		case held && (showtimeSeat.Status != model.StatusLocked || showtimeSeat.LockedBy == nil ||
+			*showtimeSeat.LockedBy != winnerID):
+			t.Errorf("seat %d is %s by %v, want locked by user %d", showtimeSeat.SeatID, showtimeSeat.Status,
+				showtimeSeat.LockedBy, winnerID)
+		case !held && showtimeSeat.Status != model.StatusAvailable:
+			t.Errorf("seat %d is %s, want available", showtimeSeat.SeatID, showtimeSeat.Status)
+		}
+	}
+
+	// idx_active_ticket only lets one active reservation hold a seat, cancelled ones are kept beside it
+	cancelled := model.Reservation{ShowtimeID: showtime.ID, SeatID: seats[0].ID, UserID: users[0].ID,
+		Status: model.ReservationCancelled}
+	if err := reservationRepo.Create(&cancelled); err != nil {
+		t.Errorf("creating a cancelled reservation of a reserved seat: %v", err)
+	}
+	active := model.Reservation{ShowtimeID: showtime.ID, SeatID: seats[0].ID, UserID: users[0].ID,
+		Status: model.ReservationActive}
+	if err := reservationRepo.Create(&active); !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("creating a second active reservation of a seat: error = %v, want gorm.ErrDuplicatedKey", err)
+	}
+}
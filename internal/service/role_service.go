@@ -0,0 +1,263 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// builtinRoles always exist, user is given at registration and admin has every permission
+var builtinRoles = []model.UserRole{model.RoleUser, model.RoleAdmin}
+
+// defaultStaffRoles are created on the first start only, so admins can change or delete them afterwards
+var defaultStaffRoles = []model.Role{
+	{
+		Name:        model.RoleBoxOffice,
+		Description: "Sells and refunds tickets at the counter",
+		Permissions: model.PermReservationRefund,
+	},
+	{
+		Name:        model.RoleScheduler,
+		Description: "Plans the movies, showtimes and halls",
+		Permissions: strings.Join([]string{model.PermMovieWrite, model.PermShowtimeWrite, model.PermHallWrite}, ","),
+	},
+	{
+		Name:        model.RoleFinance,
+		Description: "Reads the reports and handles the refunds",
+		Permissions: strings.Join([]string{model.PermReportRead, model.PermReservationRefund}, ","),
+	},
+	{
+		Name:        model.RoleSupport,
+		Description: "Helps customers with their reservations",
+		Permissions: model.PermReservationRefund,
+	},
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z_]{0,15}$`)
+
+type RoleService interface {
+	// SeedRoles creates the missing built-in roles and grants the admin role every permission,
+	// the default staff roles are only created when there is no role yet
+	SeedRoles() error
+	GetRoles() ([]RoleView, error)
+	// SaveRole creates the role or replaces its description and permissions, the admin role can't be changed
+	SaveRole(name model.UserRole, description string, permissions []string) (*RoleView, error)
+	// DeleteRole fails with ErrRoleInUse while a user has the role, the built-in roles can't be deleted
+	DeleteRole(name model.UserRole) error
+	// AssignRole gives the user the role, it takes effect on the next request of the user
+	AssignRole(userID uint, role model.UserRole) error
+	// HasPermission reports whether the current role of the user grants every one of the permissions
+	HasPermission(userID uint, permissions ...string) (bool, error)
+}
+
+// RoleView is what admins see of a role
+type RoleView struct {
+	Name        model.UserRole `json:"name"`
+	Description string         `json:"description"`
+	Permissions []string       `json:"permissions"`
+	Builtin     bool           `json:"builtin"`
+}
+
+func newRoleView(role *model.Role) RoleView {
+	return RoleView{
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: rolePermissions(role),
+		Builtin:     slices.Contains(builtinRoles, role.Name),
+	}
+}
+
+func rolePermissions(role *model.Role) []string {
+	if role.Permissions == "" {
+		return []string{}
+	}
+	return strings.Split(role.Permissions, ",")
+}
+
+type roleService struct {
+	db       *gorm.DB
+	repo     repository.RoleRepo
+	userRepo repository.UserRepo
+}
+
+var _ RoleService = (*roleService)(nil)
+
+func NewRoleService(db *gorm.DB, roleRepo repository.RoleRepo, userRepo repository.UserRepo) *roleService {
+	return &roleService{
+		db:       db,
+		repo:     roleRepo,
+		userRepo: userRepo,
+	}
+}
+
+func (s *roleService) SeedRoles() error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		roles, err := s.repo.WithTx(tx).ListAll()
+		if err != nil {
+			return err
+		}
+		if len(roles) == 0 {
+			for _, role := range defaultStaffRoles {
+				if err := s.repo.WithTx(tx).Create(&role); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := s.repo.WithTx(tx).GetByName(model.RoleUser); err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err := s.repo.WithTx(tx).Create(&model.Role{
+				Name:        model.RoleUser,
+				Description: "Reserves and pays for seats",
+			}); err != nil {
+				return err
+			}
+		}
+
+		// a permission added since the last start is granted to the admins too
+		admin := &model.Role{
+			Name:        model.RoleAdmin,
+			Description: "Has every permission",
+			Permissions: strings.Join(model.Permissions, ","),
+		}
+		if _, err := s.repo.WithTx(tx).GetByName(model.RoleAdmin); err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			return s.repo.WithTx(tx).Create(admin)
+		}
+		return s.repo.WithTx(tx).Update(admin)
+	})
+}
+
+func (s *roleService) GetRoles() ([]RoleView, error) {
+	roles, err := s.repo.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	views := make([]RoleView, 0, len(roles))
+	for i := range roles {
+		views = append(views, newRoleView(&roles[i]))
+	}
+	return views, nil
+}
+
+func (s *roleService) SaveRole(name model.UserRole, description string, permissions []string) (*RoleView, error) {
+	if !roleNamePattern.MatchString(string(name)) {
+		return nil, ErrInvalidRoleName
+	}
+	if name == model.RoleAdmin {
+		return nil, ErrBuiltinRole
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(model.Permissions, permission) {
+			return nil, ErrInvalidPermission
+		}
+	}
+
+	role := &model.Role{
+		Name:        name,
+		Description: description,
+		Permissions: strings.Join(permissions, ","),
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByName(name); err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			return s.repo.WithTx(tx).Create(role)
+		}
+		return s.repo.WithTx(tx).Update(role)
+	})
+	if err != nil {
+		return nil, err
+	}
+	view := newRoleView(role)
+	return &view, nil
+}
+
+func (s *roleService) DeleteRole(name model.UserRole) error {
+	if slices.Contains(builtinRoles, name) {
+		return ErrBuiltinRole
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByName(name); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		count, err := s.userRepo.WithTx(tx).CountByRole(name)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRoleInUse
+		}
+		return s.repo.WithTx(tx).DeleteByName(name)
+	})
+}
+
+func (s *roleService) AssignRole(userID uint, role model.UserRole) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByName(role); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUnknownRole
+			}
+			return err
+		}
+		user, err := s.userRepo.WithTx(tx).GetByID(userID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if user.Role == role {
+			return nil
+		}
+		// nobody could assign the roles anymore without an admin
+		if user.Role == model.RoleAdmin {
+			count, err := s.userRepo.WithTx(tx).CountByRole(model.RoleAdmin)
+			if err != nil {
+				return err
+			}
+			if count <= 1 {
+				return ErrLastAdmin
+			}
+		}
+		return s.userRepo.WithTx(tx).UpdateRole(userID, role)
+	})
+}
+
+func (s *roleService) HasPermission(userID uint, permissions ...string) (bool, error) {
+	user, err := s.userRepo.GetByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	role, err := s.repo.GetByName(user.Role)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	granted := rolePermissions(role)
+	for _, permission := range permissions {
+		if !slices.Contains(granted, permission) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// SeatMap is the seat grid of a showtime, shaped like its hall
+type SeatMap struct {
+	ShowtimeID uint `json:"showtime_id"`
+	HallID     uint `json:"hall_id"`
+	Rows       int  `json:"rows"`
+	Cols       int  `json:"cols"`
+	// Seats[row-1][col-1] is the seat at (row, col), or nil where the hall has no seat
+	Seats [][]*SeatMapCell `json:"seats"`
+}
+
+type SeatMapCell struct {
+	SeatID         uint                     `json:"seat_id"`
+	ShowtimeSeatID uint                     `json:"showtime_seat_id"`
+	Row            int                      `json:"row"`
+	Col            int                      `json:"col"`
+	Label          string                   `json:"label"`
+	Class          model.SeatClass          `json:"class"`
+	Status         model.ShowtimeSeatStatus `json:"status"`
+}
+
+// buildSeatMap places every showtimeSeat (with its Seat loaded) into the hall grid
+func buildSeatMap(showtime *model.Showtime, hall *model.Hall, showtimeSeats []model.ShowtimeSeat) *SeatMap {
+	seats := make([][]*SeatMapCell, hall.Rows)
+	for row := range seats {
+		seats[row] = make([]*SeatMapCell, hall.Cols)
+	}
+	for _, showtimeSeat := range showtimeSeats {
+		row, col := showtimeSeat.Seat.Row, showtimeSeat.Seat.Col
+		// skip seats lying outside of the hall dimensions
+		if row < 1 || row > hall.Rows || col < 1 || col > hall.Cols {
+			continue
+		}
+		seats[row-1][col-1] = &SeatMapCell{
+			SeatID:         showtimeSeat.SeatID,
+			ShowtimeSeatID: showtimeSeat.ID,
+			Row:            row,
+			Col:            col,
+			Label:          showtimeSeat.Seat.Label,
+			Class:          showtimeSeat.Seat.Class,
+			Status:         showtimeSeat.Status,
+		}
+	}
+	return &SeatMap{
+		ShowtimeID: showtime.ID,
+		HallID:     hall.ID,
+		Rows:       hall.Rows,
+		Cols:       hall.Cols,
+		Seats:      seats,
+	}
+}
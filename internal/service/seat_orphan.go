@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// OrphanSeatError lists the seats a selection would leave isolated in their row
+// and the selections of the same size that would not, errors.Is(err, ErrOrphanSeat) reports true for it
+type OrphanSeatError struct {
+	OrphanSeats []SeatMapCell
+	// Alternatives are runs of adjacent seats closest to the selection first, at most maxOrphanAlternatives
+	Alternatives [][]SeatMapCell
+}
+
+func (e *OrphanSeatError) Error() string {
+	return fmt.Sprintf("%s: %d isolated seats", ErrOrphanSeat, len(e.OrphanSeats))
+}
+
+func (e *OrphanSeatError) Is(target error) bool {
+	return target == ErrOrphanSeat
+}
+
+// maxOrphanAlternatives caps the alternatives suggested by an OrphanSeatError
+const maxOrphanAlternatives = 3
+
+// checkOrphanSeats returns an *OrphanSeatError when taking the seats of seatIDs leaves an available seat
+// with no available neighbour in its row, seats already isolated before the selection don't count.
+// Seats of the selection that aren't available are left for the caller to report.
+func checkOrphanSeats(hall *model.Hall, showtimeSeats []model.ShowtimeSeat, seatIDs []uint) error {
+	rows := availableSeatRows(showtimeSeats)
+	bySeatID := make(map[uint]*model.ShowtimeSeat)
+	for _, cols := range rows {
+		for _, showtimeSeat := range cols {
+			bySeatID[showtimeSeat.SeatID] = showtimeSeat
+		}
+	}
+	selection := make([]*model.ShowtimeSeat, 0, len(seatIDs))
+	for _, seatID := range seatIDs {
+		showtimeSeat, ok := bySeatID[seatID]
+		if !ok {
+			return nil
+		}
+		selection = append(selection, showtimeSeat)
+	}
+
+	orphans := orphanedSeats(rows, selection)
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	return &OrphanSeatError{
+		OrphanSeats:  seatMapCells(orphans),
+		Alternatives: orphanFreeAlternatives(hall, rows, selection),
+	}
+}
+
+// orphanedSeats returns the available seats of rows left with no available neighbour in their row
+// once the selection is taken, from the front row to the back, seats already isolated before don't count
+func orphanedSeats(rows seatRows, selection []*model.ShowtimeSeat) []*model.ShowtimeSeat {
+	taken := make(map[*model.ShowtimeSeat]bool, len(selection))
+	for _, showtimeSeat := range selection {
+		taken[showtimeSeat] = true
+	}
+	var orphans []*model.ShowtimeSeat
+	checkedRows := make(map[int]bool)
+	for _, showtimeSeat := range selection {
+		row := showtimeSeat.Seat.Row
+		if checkedRows[row] {
+			continue
+		}
+		checkedRows[row] = true
+		cols := rows[row]
+		before := func(col int) bool {
+			return cols[col] != nil
+		}
+		after := func(col int) bool {
+			return cols[col] != nil && !taken[cols[col]]
+		}
+		for col, seat := range cols {
+			if after(col) && !after(col-1) && !after(col+1) && (before(col-1) || before(col+1)) {
+				orphans = append(orphans, seat)
+			}
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return seatBefore(orphans[i], orphans[j])
+	})
+	return orphans
+}
+
+// orphanFreeAlternatives returns the runs of len(selection) adjacent seats leaving no isolated seat,
+// the closest to the selection first
+func orphanFreeAlternatives(hall *model.Hall, rows seatRows, selection []*model.ShowtimeSeat) [][]SeatMapCell {
+	centerRow, centerCol := seatsCenter(selection)
+	distance := func(block seatBlock) float64 {
+		row, col := seatsCenter(block.seats)
+		return math.Hypot(row-centerRow, col-centerCol)
+	}
+
+	var blocks []seatBlock
+	for _, block := range seatBlocks(hall, rows, len(selection)) {
+		if !block.orphan {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		distanceI, distanceJ := distance(blocks[i]), distance(blocks[j])
+		if distanceI != distanceJ {
+			return distanceI < distanceJ
+		}
+		if blocks[i].score != blocks[j].score {
+			return blocks[i].score > blocks[j].score
+		}
+		return seatBefore(blocks[i].seats[0], blocks[j].seats[0])
+	})
+
+	alternatives := make([][]SeatMapCell, 0, maxOrphanAlternatives)
+	for _, block := range blocks {
+		if len(alternatives) == maxOrphanAlternatives {
+			break
+		}
+		alternatives = append(alternatives, seatMapCells(block.seats))
+	}
+	return alternatives
+}
+
+// seatsCenter returns the mean row and col of the seats
+func seatsCenter(showtimeSeats []*model.ShowtimeSeat) (float64, float64) {
+	var row, col float64
+	for _, showtimeSeat := range showtimeSeats {
+		row += float64(showtimeSeat.Seat.Row)
+		col += float64(showtimeSeat.Seat.Col)
+	}
+	n := float64(len(showtimeSeats))
+	return row / n, col / n
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// SeatRecommendation is the best group of available seats found for a showtime
+type SeatRecommendation struct {
+	ShowtimeID uint          `json:"showtime_id"`
+	Seats      []SeatMapCell `json:"seats"`
+	// Contiguous is false when no row has enough adjacent available seats and the group is spread out
+	Contiguous bool `json:"contiguous"`
+	// Score goes from 0 (worst) to 1 (the center of the ideal row)
+	Score float64 `json:"score"`
+}
+
+// weights of the seat score, they add up to 1
+const (
+	centralityWeight = 0.6
+	distanceWeight   = 0.4
+)
+
+// penalty of a block that would leave a single available seat stranded next to it,
+// such blocks are never recommended in a hall with PreventOrphanSeats
+const orphanSeatPenalty = 0.5
+
+// idealRowRatio is where the best row sits from the screen (row 1) to the back of the hall
+const idealRowRatio = 2.0 / 3.0
+
+// seatScore rates a seat by how central it is and how close its row is to the ideal distance to the screen
+func seatScore(hall *model.Hall, row, col int) float64 {
+	centralityScore := 1.0
+	if hall.Cols > 1 {
+		center := float64(hall.Cols+1) / 2
+		centralityScore = 1 - math.Abs(float64(col)-center)/(center-1)
+	}
+	distanceScore := 1.0
+	if hall.Rows > 1 {
+		idealRow := 1 + idealRowRatio*float64(hall.Rows-1)
+		distanceScore = 1 - math.Abs(float64(row)-idealRow)/float64(hall.Rows-1)
+	}
+	return centralityWeight*centralityScore + distanceWeight*distanceScore
+}
+
+// seatRows indexes the available showtimeSeats (with their Seat loaded) by row then col
+type seatRows map[int]map[int]*model.ShowtimeSeat
+
+func availableSeatRows(showtimeSeats []model.ShowtimeSeat) seatRows {
+	rows := make(seatRows)
+	for i := range showtimeSeats {
+		showtimeSeat := &showtimeSeats[i]
+		if showtimeSeat.Status != model.StatusAvailable {
+			continue
+		}
+		row, col := showtimeSeat.Seat.Row, showtimeSeat.Seat.Col
+		if rows[row] == nil {
+			rows[row] = make(map[int]*model.ShowtimeSeat)
+		}
+		rows[row][col] = showtimeSeat
+	}
+	return rows
+}
+
+// leavesOrphanSeat reports whether taking the seats from col first to col last of a row
+// leaves a single available seat between the block and a taken seat, an aisle or the wall
+func leavesOrphanSeat(available func(col int) bool, first, last int) bool {
+	if available(first-1) && !available(first-2) {
+		return true
+	}
+	return available(last+1) && !available(last+2)
+}
+
+// seatBlock is a run of adjacent available seats in one row
+type seatBlock struct {
+	seats []*model.ShowtimeSeat
+	// score is the mean seat score of the block
+	score float64
+	// orphan is set when taking the block leaves a single available seat stranded next to it
+	orphan bool
+}
+
+// seatBlocks returns every run of count adjacent available seats of the hall
+func seatBlocks(hall *model.Hall, rows seatRows, count int) []seatBlock {
+	var blocks []seatBlock
+	for row, cols := range rows {
+		isAvailable := func(col int) bool {
+			return cols[col] != nil
+		}
+		for first := range cols {
+			block := seatBlock{seats: make([]*model.ShowtimeSeat, 0, count)}
+			for col := first; col < first+count && isAvailable(col); col++ {
+				block.seats = append(block.seats, cols[col])
+				block.score += seatScore(hall, row, col)
+			}
+			if len(block.seats) < count {
+				continue
+			}
+			block.score /= float64(count)
+			block.orphan = leavesOrphanSeat(isAvailable, first, first+count-1)
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// recommendSeats picks count available seats of the showtimeSeats (with their Seat loaded),
+// it prefers the best scored block of adjacent seats in one row that doesn't strand a single seat,
+// and falls back to the best scored seats of the hall when no row has such a block.
+// A hall with PreventOrphanSeats never gets seats stranding one, it returns nil when fewer than count
+// seats are available or when the hall prevents orphan seats and no such seats are found.
+func recommendSeats(showtime *model.Showtime, hall *model.Hall, showtimeSeats []model.ShowtimeSeat, count int) *SeatRecommendation {
+	rows := availableSeatRows(showtimeSeats)
+	var candidates []*model.ShowtimeSeat
+	for _, cols := range rows {
+		for _, showtimeSeat := range cols {
+			candidates = append(candidates, showtimeSeat)
+		}
+	}
+	if count < 1 || len(candidates) < count {
+		return nil
+	}
+
+	var best []*model.ShowtimeSeat
+	bestScore := math.Inf(-1)
+	for _, block := range seatBlocks(hall, rows, count) {
+		score := block.score
+		if block.orphan {
+			if hall.PreventOrphanSeats {
+				continue
+			}
+			score -= orphanSeatPenalty
+		}
+		// break ties toward the front rows and the left so the result is stable
+		if score > bestScore || (score == bestScore && seatBefore(block.seats[0], best[0])) {
+			best, bestScore = block.seats, score
+		}
+	}
+
+	contiguous := best != nil
+	if !contiguous {
+		sort.Slice(candidates, func(i, j int) bool {
+			scoreI := seatScore(hall, candidates[i].Seat.Row, candidates[i].Seat.Col)
+			scoreJ := seatScore(hall, candidates[j].Seat.Row, candidates[j].Seat.Col)
+			if scoreI != scoreJ {
+				return scoreI > scoreJ
+			}
+			return seatBefore(candidates[i], candidates[j])
+		})
+		best = candidates[:count]
+		if hall.PreventOrphanSeats {
+			best = orphanFreeSeats(rows, candidates, count)
+			if best == nil {
+				return nil
+			}
+		}
+		bestScore = 0
+		for _, showtimeSeat := range best {
+			bestScore += seatScore(hall, showtimeSeat.Seat.Row, showtimeSeat.Seat.Col)
+		}
+		bestScore /= float64(count)
+		sort.Slice(best, func(i, j int) bool {
+			return seatBefore(best[i], best[j])
+		})
+	}
+
+	return &SeatRecommendation{
+		ShowtimeID: showtime.ID,
+		Seats:      seatMapCells(best),
+		Contiguous: contiguous,
+		Score:      math.Max(bestScore, 0),
+	}
+}
+
+// orphanFreeSeats picks count of the candidates best first without stranding a single seat in a row,
+// a candidate stranding its neighbour is taken along with it when there is room left and skipped otherwise.
+// It returns nil when no such seats are found.
+func orphanFreeSeats(rows seatRows, candidates []*model.ShowtimeSeat, count int) []*model.ShowtimeSeat {
+	selection := make([]*model.ShowtimeSeat, 0, count)
+	for _, candidate := range candidates {
+		if len(selection) == count {
+			break
+		}
+		if slices.Contains(selection, candidate) {
+			continue
+		}
+		picked := append(slices.Clone(selection), candidate)
+		if orphans := orphanedSeats(rows, picked); len(orphans) > 0 {
+			picked = append(picked, orphans...)
+			if len(picked) > count || len(orphanedSeats(rows, picked)) > 0 {
+				continue
+			}
+		}
+		selection = picked
+	}
+	if len(selection) < count {
+		return nil
+	}
+	return selection
+}
+
+// seatBefore orders seats from the front row to the back, then from left to right
+func seatBefore(a, b *model.ShowtimeSeat) bool {
+	if a.Seat.Row != b.Seat.Row {
+		return a.Seat.Row < b.Seat.Row
+	}
+	return a.Seat.Col < b.Seat.Col
+}
+
+func seatMapCells(showtimeSeats []*model.ShowtimeSeat) []SeatMapCell {
+	cells := make([]SeatMapCell, 0, len(showtimeSeats))
+	for _, showtimeSeat := range showtimeSeats {
+		cells = append(cells, SeatMapCell{
+			SeatID:         showtimeSeat.SeatID,
+			ShowtimeSeatID: showtimeSeat.ID,
+			Row:            showtimeSeat.Seat.Row,
+			Col:            showtimeSeat.Seat.Col,
+			Label:          showtimeSeat.Seat.Label,
+			Class:          showtimeSeat.Seat.Class,
+			Status:         showtimeSeat.Status,
+		})
+	}
+	return cells
+}
+
+// seatIDs returns the seat IDs of the recommended seats
+func (r *SeatRecommendation) seatIDs() []uint {
+	ids := make([]uint, 0, len(r.Seats))
+	for _, seat := range r.Seats {
+		ids = append(ids, seat.SeatID)
+	}
+	return ids
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"fmt"
 
 	"gorm.io/gorm"
 
@@ -16,11 +17,18 @@ import (
 
 type SeatService interface {
 	CreateSeat(seat *model.Seat) error
-	InitSeatsForHall(hall *model.Hall) error
-	InitSeatsForHallTx(tx *gorm.DB, hall *model.Hall) error
+	InitSeatsForHall(hall *model.Hall, layout *HallLayout) error
+	InitSeatsForHallTx(tx *gorm.DB, hall *model.Hall, layout *HallLayout) error
+	// ReplaceSeatsForHallTx drops the seats of the hall and creates the ones of the layout
+	ReplaceSeatsForHallTx(tx *gorm.DB, hall *model.Hall, layout *HallLayout) error
+	// RelabelSeatsForHallTx labels the seats of the hall following its layout and LabelScheme,
+	// the seats keep their ID, class and out of service flag
+	RelabelSeatsForHallTx(tx *gorm.DB, hall *model.Hall) error
 	GetSeatByID(id uint) (*model.Seat, error)
 	GetSeatsByHallID(hallID uint) ([]model.Seat, error)
 	GetSeatsByHallIDTx(tx *gorm.DB, hallID uint) ([]model.Seat, error)
+	// SetSeatOutOfServiceTx sets the out of service flag of a seat of the hall
+	SetSeatOutOfServiceTx(tx *gorm.DB, hallID, seatID uint, outOfService bool) error
 	// DeleteSeatByID do not examine if it is allowed to delete,
 	DeleteSeatByID(id uint) error
 }
@@ -43,29 +51,67 @@ func (s *seatService) CreateSeat(seat *model.Seat) error {
 	return s.repo.Create(seat)
 }
 
-func (s *seatService) InitSeatsForHall(hall *model.Hall) error {
+func (s *seatService) InitSeatsForHall(hall *model.Hall, layout *HallLayout) error {
 	return s.db.Transaction(func(tx *gorm.DB) error {
-		return s.InitSeatsForHallTx(s.db, hall)
+		return s.InitSeatsForHallTx(tx, hall, layout)
 	})
 }
 
-func (s *seatService) InitSeatsForHallTx(tx *gorm.DB, hall *model.Hall) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		hallID := hall.ID
-		rows, cols := hall.Rows, hall.Cols
-		var seats []model.Seat
-		for row := range rows {
-			for col := range cols {
-				seats = append(seats, model.Seat{
-					HallID: hallID,
-					Row:    row,
-					Col:    col,
-				})
-			}
-		}
+// rows and cols of seats start from 1
+func (s *seatService) InitSeatsForHallTx(tx *gorm.DB, hall *model.Hall, layout *HallLayout) error {
+	seats := make([]model.Seat, 0, len(layout.Seats))
+	for _, seat := range layout.Seats {
+		seats = append(seats, model.Seat{
+			HallID: hall.ID,
+			Row:    seat.Row,
+			Col:    seat.Col,
+			Label:  seat.Label,
+			Class:  seat.Class,
+		})
+	}
+	return s.repo.WithTx(tx).CreateBatch(seats)
+}
 
-		return s.repo.WithTx(tx).CreateBatch(seats)
-	})
+func (s *seatService) ReplaceSeatsForHallTx(tx *gorm.DB, hall *model.Hall, layout *HallLayout) error {
+	if err := s.repo.WithTx(tx).DeleteByHallID(hall.ID); err != nil {
+		return err
+	}
+	return s.InitSeatsForHallTx(tx, hall, layout)
+}
+
+func (s *seatService) RelabelSeatsForHallTx(tx *gorm.DB, hall *model.Hall) error {
+	layout, err := HallSeatLayout(hall)
+	if err != nil {
+		return err
+	}
+	labels := make(map[[2]int]string, len(layout.Seats))
+	for _, seat := range layout.Seats {
+		labels[[2]int{seat.Row, seat.Col}] = seat.Label
+	}
+	seats, err := s.repo.WithTx(tx).GetByHallID(hall.ID)
+	if err != nil {
+		return err
+	}
+
+	var relabelled []model.Seat
+	for _, seat := range seats {
+		if label, ok := labels[[2]int{seat.Row, seat.Col}]; ok && label != seat.Label {
+			seat.Label = label
+			relabelled = append(relabelled, seat)
+		}
+	}
+	// the labels are unique in the hall, moving them aside first lets two seats swap their labels
+	for _, seat := range relabelled {
+		if err := s.repo.WithTx(tx).UpdateLabel(seat.ID, fmt.Sprintf("~%d", seat.ID)); err != nil {
+			return err
+		}
+	}
+	for _, seat := range relabelled {
+		if err := s.repo.WithTx(tx).UpdateLabel(seat.ID, seat.Label); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *seatService) GetSeatByID(id uint) (*model.Seat, error) {
@@ -87,6 +133,21 @@ func (s *seatService) GetSeatsByHallIDTx(tx *gorm.DB, hallID uint) ([]model.Seat
 	return s.repo.WithTx(tx).GetByHallID(hallID)
 }
 
+func (s *seatService) SetSeatOutOfServiceTx(tx *gorm.DB, hallID, seatID uint, outOfService bool) error {
+	seat, err := s.repo.WithTx(tx).GetByID(seatID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	// the seat must belong to the hall of the route
+	if seat.HallID != hallID {
+		return ErrNotFound
+	}
+	return s.repo.WithTx(tx).UpdateOutOfService(seatID, outOfService)
+}
+
 func (s *seatService) DeleteSeatByID(id uint) error {
 	if err := s.repo.DeleteByID(id); err != nil {
 		return err
@@ -1,8 +1,14 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/cache"
 	"github.com/qs-lzh/movie-reservation/internal/model"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
 	"gorm.io/gorm"
@@ -18,27 +24,56 @@ type ShowtimeSeatService interface {
 	GetShowtimeSeatByID(id uint) (*model.ShowtimeSeat, error)
 	GetShowtimeSeatByShowtimeIDSeatID(showtimeID, seatID uint) (*model.ShowtimeSeat, error)
 	GetShowtimeSeatByShowtimeIDSeatIDTx(tx *gorm.DB, showtimeID, seatID uint) (*model.ShowtimeSeat, error)
+	// GetShowtimeSeatByShowtimeIDSeatIDForUpdateTx locks the showtimeSeat row until tx ends
+	GetShowtimeSeatByShowtimeIDSeatIDForUpdateTx(tx *gorm.DB, showtimeID, seatID uint) (*model.ShowtimeSeat, error)
 	GetShowtimeSeatsByShowtimeID(showtimeID uint) ([]model.ShowtimeSeat, error)
 	GetShowtimeSeatsByShowtimeIDTx(tx *gorm.DB, showtimeID uint) ([]model.ShowtimeSeat, error)
+	GetShowtimeSeatsWithSeatByShowtimeIDTx(tx *gorm.DB, showtimeID uint) ([]model.ShowtimeSeat, error)
+	// GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx locks the showtimeSeats until the transaction ends
+	GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx(tx *gorm.DB, showtimeID uint) ([]model.ShowtimeSeat, error)
 	GetShowtimeSeatsByStatus(status model.ShowtimeSeatStatus) ([]model.ShowtimeSeat, error)
-	updateShowtimeSeatStatusTx(tx *gorm.DB, id uint, targetStatus model.ShowtimeSeatStatus) error
+	GetExpiredHoldsTx(tx *gorm.DB, now time.Time) ([]model.ShowtimeSeat, error)
+	CountShowtimeSeatsByStatusTx(tx *gorm.DB, showtimeID uint, status model.ShowtimeSeatStatus) (int, error)
+	updateShowtimeSeatStatusTx(tx *gorm.DB, id uint, targetStatus model.ShowtimeSeatStatus, lock *seatLock) error
 	UpdateShowtimeSeatStatusToAvailableTx(tx *gorm.DB, id uint) error
 	UpdateShowtimeSeatStatusToLockedTx(tx *gorm.DB, id uint) error
 	UpdateShowtimeSeatStatusToSoldTx(tx *gorm.DB, id uint) error
+	// HoldShowtimeSeatTx locks an available seat for the user until the given time,
+	// it returns ErrSeatUnavailable if the seat is not available anymore
+	HoldShowtimeSeatTx(tx *gorm.DB, id uint, userID uint, until time.Time) error
+	// ConfirmShowtimeSeatTx turns an unexpired hold of the user into a sold seat
+	ConfirmShowtimeSeatTx(tx *gorm.DB, id uint, userID uint) error
+	// BlockShowtimeSeatTx takes an available seat out of sale, it returns ErrSeatUnavailable if the seat is booked
+	BlockShowtimeSeatTx(tx *gorm.DB, id uint) error
+	// UnblockShowtimeSeatTx makes a blocked seat available again, it returns ErrSeatNotBlocked for any other seat
+	UnblockShowtimeSeatTx(tx *gorm.DB, id uint) error
 	DeleteShowtimeSeatByID(id uint) error
+	// RemapShowtimeSeatsTx moves the seats of the showtime onto the seats of the new hall at the same row and col,
+	// see SeatRemap for what happens to the seats
+	RemapShowtimeSeatsTx(tx *gorm.DB, showtimeID, newHallID uint) ([]SeatRemap, error)
+	// SubscribeSeatStatus streams the status changes of the showtime's seats until ctx is done
+	SubscribeSeatStatus(ctx context.Context, showtimeID uint) (<-chan SeatStatusEvent, error)
+	// BroadcastSeatStatus forwards a committed seat status change to the SubscribeSeatStatus streams
+	// of every API instance, it subscribes to the event bus
+	BroadcastSeatStatus(ctx context.Context, changed event.SeatStatusChanged) error
 }
 
 type showtimeSeatService struct {
 	db          *gorm.DB
 	repo        repository.ShowtimeSeatRepo
 	seatService SeatService
+	cache       *cache.RedisCache
+	bus         *event.Bus
 }
 
-func NewShowtimeSeatService(db *gorm.DB, showtimeSeatRepo repository.ShowtimeSeatRepo, seatService SeatService) *showtimeSeatService {
+func NewShowtimeSeatService(db *gorm.DB, showtimeSeatRepo repository.ShowtimeSeatRepo, seatService SeatService,
+	cache *cache.RedisCache, bus *event.Bus) *showtimeSeatService {
 	return &showtimeSeatService{
 		db:          db,
 		repo:        showtimeSeatRepo,
 		seatService: seatService,
+		cache:       cache,
+		bus:         bus,
 	}
 }
 
@@ -62,12 +97,20 @@ func (s *showtimeSeatService) InitShowtimeSeatsForShowtimeTx(tx *gorm.DB, showti
 		showtimeSeats = append(showtimeSeats, model.ShowtimeSeat{
 			ShowtimeID: showtime.ID,
 			SeatID:     seat.ID,
-			Status:     model.StatusAvailable,
+			Status:     initialSeatStatus(&seat),
 		})
 	}
 	return s.repo.WithTx(tx).CreateBatch(showtimeSeats)
 }
 
+// initialSeatStatus is the status of the seat in a showtime created now
+func initialSeatStatus(seat *model.Seat) model.ShowtimeSeatStatus {
+	if seat.OutOfService {
+		return model.StatusBlocked
+	}
+	return model.StatusAvailable
+}
+
 func (s *showtimeSeatService) GetShowtimeSeatByID(id uint) (*model.ShowtimeSeat, error) {
 	showtimeSeat, err := s.repo.GetByID(id)
 	if err != nil {
@@ -87,6 +130,10 @@ func (s *showtimeSeatService) GetShowtimeSeatByShowtimeIDSeatIDTx(tx *gorm.DB, s
 	return s.repo.WithTx(tx).GetByShowIDSeatID(showtimeID, seatID)
 }
 
+func (s *showtimeSeatService) GetShowtimeSeatByShowtimeIDSeatIDForUpdateTx(tx *gorm.DB, showtimeID, seatID uint) (*model.ShowtimeSeat, error) {
+	return s.repo.WithTx(tx).GetByShowIDSeatIDForUpdate(showtimeID, seatID)
+}
+
 func (s *showtimeSeatService) GetShowtimeSeatsByShowtimeID(showtimeID uint) ([]model.ShowtimeSeat, error) {
 	return s.GetShowtimeSeatsByShowtimeIDTx(s.db, showtimeID)
 }
@@ -95,15 +142,43 @@ func (s *showtimeSeatService) GetShowtimeSeatsByShowtimeIDTx(tx *gorm.DB, showti
 	return s.repo.WithTx(tx).GetByShowtimeID(showtimeID)
 }
 
+func (s *showtimeSeatService) GetShowtimeSeatsWithSeatByShowtimeIDTx(tx *gorm.DB, showtimeID uint) ([]model.ShowtimeSeat, error) {
+	return s.repo.WithTx(tx).GetByShowtimeIDWithSeat(showtimeID)
+}
+
+func (s *showtimeSeatService) GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx(tx *gorm.DB, showtimeID uint) ([]model.ShowtimeSeat, error) {
+	return s.repo.WithTx(tx).GetByShowtimeIDWithSeatForUpdate(showtimeID)
+}
+
 func (s *showtimeSeatService) GetShowtimeSeatsByStatus(status model.ShowtimeSeatStatus) ([]model.ShowtimeSeat, error) {
 	return s.repo.GetByStatus(status)
 }
 
+func (s *showtimeSeatService) GetExpiredHoldsTx(tx *gorm.DB, now time.Time) ([]model.ShowtimeSeat, error) {
+	return s.repo.WithTx(tx).GetExpiredLocked(now)
+}
+
+func (s *showtimeSeatService) CountShowtimeSeatsByStatusTx(tx *gorm.DB, showtimeID uint, status model.ShowtimeSeatStatus) (int, error) {
+	count, err := s.repo.WithTx(tx).CountByShowtimeIDStatus(showtimeID, status)
+	return int(count), err
+}
+
 var ErrShowtimeSeatNotExist = errors.New("The ShowtimeSeat does not exist")
 var ErrShowtimeSeatStatusNotChange = errors.New("The target status of showtimeSeat is the same as the origin")
+var ErrShowtimeSeatStatusChanged = errors.New("The status of showtimeSeat was changed concurrently")
 
-func (s *showtimeSeatService) updateShowtimeSeatStatusTx(tx *gorm.DB, id uint, targetStatus model.ShowtimeSeatStatus) error {
-	existingShowtimeSeat, err := s.repo.WithTx(tx).GetByID(id)
+// seatLock records who holds a locked showtimeSeat and until when
+type seatLock struct {
+	userID uint
+	until  time.Time
+}
+
+// updateShowtimeSeatStatusTx moves the showtimeSeat to targetStatus,
+// lock is only kept for StatusLocked and cleared for any other status.
+// The row is locked while reading and only written if its status is still the one read,
+// so two transactions can never both move the same seat out of the same status.
+func (s *showtimeSeatService) updateShowtimeSeatStatusTx(tx *gorm.DB, id uint, targetStatus model.ShowtimeSeatStatus, lock *seatLock) error {
+	existingShowtimeSeat, err := s.repo.WithTx(tx).GetByIDForUpdate(id)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return ErrShowtimeSeatNotExist
@@ -114,20 +189,222 @@ func (s *showtimeSeatService) updateShowtimeSeatStatusTx(tx *gorm.DB, id uint, t
 	if targetStatus == existingShowtimeSeat.Status {
 		return ErrShowtimeSeatStatusNotChange
 	}
+	// a seat can only be locked or blocked while it is available
+	if (targetStatus == model.StatusLocked || targetStatus == model.StatusBlocked) &&
+		existingShowtimeSeat.Status != model.StatusAvailable {
+		return ErrSeatUnavailable
+	}
 
+	fromStatus := existingShowtimeSeat.Status
 	existingShowtimeSeat.Status = targetStatus
-	return s.repo.WithTx(tx).Update(id, existingShowtimeSeat)
+	existingShowtimeSeat.LockedBy = nil
+	existingShowtimeSeat.LockedUntil = nil
+	if targetStatus == model.StatusLocked && lock != nil {
+		existingShowtimeSeat.LockedBy = &lock.userID
+		existingShowtimeSeat.LockedUntil = &lock.until
+	}
+	updated, err := s.repo.WithTx(tx).UpdateIfStatus(id, fromStatus, existingShowtimeSeat)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		if targetStatus == model.StatusLocked || targetStatus == model.StatusBlocked {
+			return ErrSeatUnavailable
+		}
+		return ErrShowtimeSeatStatusChanged
+	}
+
+	s.bus.Record(tx, event.SeatStatusChanged{
+		ShowtimeID:     existingShowtimeSeat.ShowtimeID,
+		ShowtimeSeatID: existingShowtimeSeat.ID,
+		SeatID:         existingShowtimeSeat.SeatID,
+		From:           fromStatus,
+		To:             targetStatus,
+		At:             time.Now(),
+	})
+	return nil
 }
 func (s *showtimeSeatService) UpdateShowtimeSeatStatusToAvailableTx(tx *gorm.DB, id uint) error {
-	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusAvailable)
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusAvailable, nil)
 }
 func (s *showtimeSeatService) UpdateShowtimeSeatStatusToLockedTx(tx *gorm.DB, id uint) error {
-	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusLocked)
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusLocked, nil)
 }
 func (s *showtimeSeatService) UpdateShowtimeSeatStatusToSoldTx(tx *gorm.DB, id uint) error {
-	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusSold)
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusSold, nil)
+}
+
+func (s *showtimeSeatService) HoldShowtimeSeatTx(tx *gorm.DB, id uint, userID uint, until time.Time) error {
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusLocked, &seatLock{userID: userID, until: until})
+}
+
+func (s *showtimeSeatService) ConfirmShowtimeSeatTx(tx *gorm.DB, id uint, userID uint) error {
+	showtimeSeat, err := s.repo.WithTx(tx).GetByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrShowtimeSeatNotExist
+		}
+		return err
+	}
+	if showtimeSeat.Status != model.StatusLocked || showtimeSeat.LockedBy == nil || *showtimeSeat.LockedBy != userID {
+		return ErrHoldNotOwned
+	}
+	if showtimeSeat.LockedUntil != nil && showtimeSeat.LockedUntil.Before(time.Now()) {
+		return ErrHoldExpired
+	}
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusSold, nil)
+}
+
+func (s *showtimeSeatService) BlockShowtimeSeatTx(tx *gorm.DB, id uint) error {
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusBlocked, nil)
+}
+
+func (s *showtimeSeatService) UnblockShowtimeSeatTx(tx *gorm.DB, id uint) error {
+	showtimeSeat, err := s.repo.WithTx(tx).GetByIDForUpdate(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrShowtimeSeatNotExist
+		}
+		return err
+	}
+	if showtimeSeat.Status != model.StatusBlocked {
+		return ErrSeatNotBlocked
+	}
+	return s.updateShowtimeSeatStatusTx(tx, id, model.StatusAvailable, nil)
 }
 
 func (s *showtimeSeatService) DeleteShowtimeSeatByID(id uint) error {
 	return s.repo.DeleteByID(id)
 }
+
+// SeatRemap tells where a booked (locked or sold) seat went when its showtime changed hall.
+// ToSeatID is 0 when the new hall has no seat at the same row and col, such a showtimeSeat is dropped
+// and cancelling its reservation is left to the caller.
+// Unmatched unbooked seats are dropped silently, the unbooked seats follow the out of service flag
+// of their new seat like the seats of a new showtime do.
+type SeatRemap struct {
+	ShowtimeSeatID uint
+	FromSeatID     uint
+	ToSeatID       uint
+	Row            int
+	Col            int
+	Status         model.ShowtimeSeatStatus
+}
+
+func (s *showtimeSeatService) RemapShowtimeSeatsTx(tx *gorm.DB, showtimeID, newHallID uint) ([]SeatRemap, error) {
+	type position struct{ row, col int }
+
+	// lock the seats so nobody books them while they are moved
+	showtimeSeats, err := s.repo.WithTx(tx).GetByShowtimeIDWithSeatForUpdate(showtimeID)
+	if err != nil {
+		return nil, err
+	}
+	newSeats, err := s.seatService.GetSeatsByHallIDTx(tx, newHallID)
+	if err != nil {
+		return nil, err
+	}
+	newSeatAt := make(map[position]model.Seat, len(newSeats))
+	for _, seat := range newSeats {
+		newSeatAt[position{seat.Row, seat.Col}] = seat
+	}
+
+	var remaps []SeatRemap
+	for _, showtimeSeat := range showtimeSeats {
+		pos := position{showtimeSeat.Seat.Row, showtimeSeat.Seat.Col}
+		newSeat, ok := newSeatAt[pos]
+		delete(newSeatAt, pos)
+		if ok {
+			if err := s.repo.WithTx(tx).UpdateSeatID(showtimeSeat.ID, newSeat.ID); err != nil {
+				return nil, err
+			}
+			if status := initialSeatStatus(&newSeat); isUnbooked(showtimeSeat.Status) && status != showtimeSeat.Status {
+				if err := s.repo.WithTx(tx).Update(showtimeSeat.ID, &model.ShowtimeSeat{Status: status}); err != nil {
+					return nil, err
+				}
+			}
+		} else if err := s.repo.WithTx(tx).DeleteByID(showtimeSeat.ID); err != nil {
+			return nil, err
+		}
+		if isUnbooked(showtimeSeat.Status) {
+			continue
+		}
+		remaps = append(remaps, SeatRemap{
+			ShowtimeSeatID: showtimeSeat.ID,
+			FromSeatID:     showtimeSeat.SeatID,
+			ToSeatID:       newSeat.ID,
+			Row:            pos.row,
+			Col:            pos.col,
+			Status:         showtimeSeat.Status,
+		})
+	}
+
+	// the seats of the new hall nobody was moved onto
+	var extraSeats []model.ShowtimeSeat
+	for _, seat := range newSeatAt {
+		extraSeats = append(extraSeats, model.ShowtimeSeat{
+			ShowtimeID: showtimeID,
+			SeatID:     seat.ID,
+			Status:     initialSeatStatus(&seat),
+		})
+	}
+	if len(extraSeats) != 0 {
+		if err := s.repo.WithTx(tx).CreateBatch(extraSeats); err != nil {
+			return nil, err
+		}
+	}
+	return remaps, nil
+}
+
+// SeatStatusEvent is pushed to the subscribers of a showtime whenever one of its seats changes status
+type SeatStatusEvent struct {
+	ShowtimeID     uint                     `json:"showtime_id"`
+	ShowtimeSeatID uint                     `json:"showtime_seat_id"`
+	SeatID         uint                     `json:"seat_id"`
+	Status         model.ShowtimeSeatStatus `json:"status"`
+	At             time.Time                `json:"at"`
+}
+
+// seat status events go through redis pub/sub so every API instance receives them
+func seatStatusChannel(showtimeID uint) string {
+	return fmt.Sprintf("showtime:%d:seats", showtimeID)
+}
+
+// BroadcastSeatStatus is best effort: the stream only hints clients to refresh,
+// the change itself is already committed when it runs
+func (s *showtimeSeatService) BroadcastSeatStatus(ctx context.Context, changed event.SeatStatusChanged) error {
+	return s.cache.Publish(seatStatusChannel(changed.ShowtimeID), SeatStatusEvent{
+		ShowtimeID:     changed.ShowtimeID,
+		ShowtimeSeatID: changed.ShowtimeSeatID,
+		SeatID:         changed.SeatID,
+		Status:         changed.To,
+		At:             changed.At,
+	})
+}
+
+func (s *showtimeSeatService) SubscribeSeatStatus(ctx context.Context, showtimeID uint) (<-chan SeatStatusEvent, error) {
+	payloads, err := s.cache.Subscribe(ctx, seatStatusChannel(showtimeID))
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan SeatStatusEvent)
+	go func() {
+		defer close(events)
+		for payload := range payloads {
+			var seatEvent SeatStatusEvent
+			if err := json.Unmarshal(payload, &seatEvent); err != nil {
+				continue
+			}
+			select {
+			case events <- seatEvent:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// isUnbooked reports whether no reservation holds a seat in this status
+func isUnbooked(status model.ShowtimeSeatStatus) bool {
+	return status == model.StatusAvailable || status == model.StatusBlocked
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+)
+
+// casShowtimeSeatRepo holds one showtimeSeat. Its reads don't lock, so only the compare-and-set
+// of UpdateIfStatus keeps concurrent writers apart, like the status check of the real UPDATE.
+type casShowtimeSeatRepo struct {
+	repository.ShowtimeSeatRepo
+	mu   sync.Mutex
+	seat model.ShowtimeSeat
+	// read is released once every contender has read the seat
+	read *sync.WaitGroup
+}
+
+func (r *casShowtimeSeatRepo) WithTx(tx *gorm.DB) repository.ShowtimeSeatRepo {
+	return r
+}
+
+func (r *casShowtimeSeatRepo) GetByIDForUpdate(id uint) (*model.ShowtimeSeat, error) {
+	r.mu.Lock()
+	seat := r.seat
+	r.mu.Unlock()
+	r.read.Done()
+	r.read.Wait()
+	return &seat, nil
+}
+
+func (r *casShowtimeSeatRepo) UpdateIfStatus(id uint, fromStatus model.ShowtimeSeatStatus, showtimeSeat *model.ShowtimeSeat) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seat.Status != fromStatus {
+		return false, nil
+	}
+	r.seat.Status = showtimeSeat.Status
+	r.seat.LockedBy = showtimeSeat.LockedBy
+	r.seat.LockedUntil = showtimeSeat.LockedUntil
+	return true, nil
+}
+
+func TestHoldShowtimeSeatTxHasOneWinner(t *testing.T) {
+	const contenders = 50
+	var read sync.WaitGroup
+	read.Add(contenders)
+	repo := &casShowtimeSeatRepo{
+		seat: model.ShowtimeSeat{ID: 1, ShowtimeID: 1, SeatID: 1, Status: model.StatusAvailable},
+		read: &read,
+	}
+	bus := event.NewBus(zap.NewNop())
+	db := newFakeDB(t)
+	s := NewShowtimeSeatService(db, repo, nil, nil, bus)
+
+	until := time.Now().Add(10 * time.Minute)
+	errs := make([]error, contenders)
+	var wg sync.WaitGroup
+	for i := range contenders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = bus.Transaction(db, func(tx *gorm.DB) error {
+				return s.HoldShowtimeSeatTx(tx, 1, uint(i+1), until)
+			})
+		}()
+	}
+	wg.Wait()
+
+	var winner uint
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if winner != 0 {
+				t.Fatalf("users %d and %d both hold the seat", winner, i+1)
+			}
+			winner = uint(i + 1)
+		case !errors.Is(err, ErrSeatUnavailable):
+			t.Errorf("user %d: HoldShowtimeSeatTx() error = %v, want ErrSeatUnavailable", i+1, err)
+		}
+	}
+	if winner == 0 {
+		t.Fatal("nobody holds the seat")
+	}
+	if repo.seat.Status != model.StatusLocked || repo.seat.LockedBy == nil || *repo.seat.LockedBy != winner {
+		t.Errorf("the seat is %s by %v, want locked by user %d", repo.seat.Status, repo.seat.LockedBy, winner)
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// maxRecurrenceShowtimes caps how many showtimes one recurrence rule may expand into
+const maxRecurrenceShowtimes = 1000
+
+var (
+	ErrInvalidRecurrence  = errors.New("the recurrence rule is not valid")
+	ErrRecurrenceTooLarge = errors.New("the recurrence rule expands into too many showtimes")
+)
+
+// ClockTime is a wall clock time, it keeps its meaning across daylight saving changes
+type ClockTime struct {
+	Hour   int
+	Minute int
+}
+
+// RecurrenceRule schedules the movie in every hall at every time of every matching day between From and Until
+type RecurrenceRule struct {
+	MovieID uint
+	HallIDs []uint
+	// Weekdays limits the days the movie plays, every day when empty
+	Weekdays []time.Weekday
+	Times    []ClockTime
+	// From and Until are inclusive, only their dates are used
+	From     time.Time
+	Until    time.Time
+	Location *time.Location
+	// BasePrice is in cents
+	BasePrice int64
+}
+
+// Expand returns the start time and hall of every showtime of the rule, sorted by day then time then hall
+func (r *RecurrenceRule) Expand() ([]ScheduledShowtime, error) {
+	if len(r.HallIDs) == 0 || len(r.Times) == 0 || r.Location == nil {
+		return nil, ErrInvalidRecurrence
+	}
+	for _, clock := range r.Times {
+		if clock.Hour < 0 || clock.Hour > 23 || clock.Minute < 0 || clock.Minute > 59 {
+			return nil, ErrInvalidRecurrence
+		}
+	}
+	from := time.Date(r.From.Year(), r.From.Month(), r.From.Day(), 0, 0, 0, 0, r.Location)
+	until := time.Date(r.Until.Year(), r.Until.Month(), r.Until.Day(), 0, 0, 0, 0, r.Location)
+	if until.Before(from) {
+		return nil, ErrInvalidRecurrence
+	}
+
+	times := slices.Clone(r.Times)
+	slices.SortFunc(times, func(a, b ClockTime) int {
+		return (a.Hour*60 + a.Minute) - (b.Hour*60 + b.Minute)
+	})
+	var showtimes []ScheduledShowtime
+	for day := from; !day.After(until); day = day.AddDate(0, 0, 1) {
+		if len(r.Weekdays) != 0 && !slices.Contains(r.Weekdays, day.Weekday()) {
+			continue
+		}
+		for _, clock := range times {
+			startAt := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour, clock.Minute, 0, 0, r.Location)
+			for _, hallID := range r.HallIDs {
+				if len(showtimes) == maxRecurrenceShowtimes {
+					return nil, ErrRecurrenceTooLarge
+				}
+				showtimes = append(showtimes, ScheduledShowtime{HallID: hallID, StartAt: startAt})
+			}
+		}
+	}
+	return showtimes, nil
+}
+
+// ScheduledShowtime is one showtime expanded from a recurrence rule
+type ScheduledShowtime struct {
+	ShowtimeID uint      `json:"showtime_id,omitempty"`
+	HallID     uint      `json:"hall_id"`
+	StartAt    time.Time `json:"start_at"`
+	EndAt      time.Time `json:"end_at"`
+	// Conflicts are the showtimes, existing or expanded earlier from the rule, clashing with this one
+	Conflicts []ShowtimeSlot `json:"conflicts,omitempty"`
+}
+
+// ShowtimeSlot is when and where a showtime plays
+type ShowtimeSlot struct {
+	ShowtimeID uint      `json:"showtime_id"`
+	MovieID    uint      `json:"movie_id"`
+	HallID     uint      `json:"hall_id"`
+	StartAt    time.Time `json:"start_at"`
+	EndAt      time.Time `json:"end_at"`
+}
+
+func NewShowtimeSlot(showtime *model.Showtime) ShowtimeSlot {
+	return ShowtimeSlot{
+		ShowtimeID: showtime.ID,
+		MovieID:    showtime.MovieID,
+		HallID:     showtime.HallID,
+		StartAt:    showtime.StartAt,
+		EndAt:      showtime.EndAt,
+	}
+}
+
+func ShowtimeSlots(showtimes []model.Showtime) []ShowtimeSlot {
+	slots := make([]ShowtimeSlot, 0, len(showtimes))
+	for i := range showtimes {
+		slots = append(slots, NewShowtimeSlot(&showtimes[i]))
+	}
+	return slots
+}
+
+type BulkSchedule struct {
+	Showtimes []ScheduledShowtime `json:"showtimes"`
+	// Conflicts counts the expanded showtimes having conflicts
+	Conflicts int  `json:"conflicts"`
+	Created   bool `json:"created"`
+}
+
+// errRollbackSchedule rolls back the transaction of a dry run or of a schedule having conflicts
+var errRollbackSchedule = errors.New("rollback bulk schedule")
+
+func (s *showtimeService) ScheduleShowtimes(rule *RecurrenceRule, dryRun bool) (*BulkSchedule, error) {
+	if rule.BasePrice < 0 {
+		return nil, ErrInvalidPrice
+	}
+	showtimes, err := rule.Expand()
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &BulkSchedule{Showtimes: showtimes}
+	// a dry run schedules everything too, so clashes between the expanded showtimes are found the same way
+	err = s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		for i := range schedule.Showtimes {
+			planned := &schedule.Showtimes[i]
+			showtime, err := s.createShowtimeTx(tx, rule.MovieID, planned.StartAt, planned.HallID, rule.BasePrice)
+			var conflictErr *ShowtimeConflictError
+			if errors.As(err, &conflictErr) {
+				planned.Conflicts = ShowtimeSlots(conflictErr.Conflicts)
+				schedule.Conflicts++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			planned.ShowtimeID = showtime.ID
+			planned.EndAt = showtime.EndAt
+		}
+		if dryRun || schedule.Conflicts != 0 {
+			return errRollbackSchedule
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollbackSchedule) {
+		return nil, err
+	}
+
+	if dryRun || schedule.Conflicts != 0 {
+		clearRolledBackIDs(schedule)
+	}
+	if dryRun {
+		return schedule, nil
+	}
+	if schedule.Conflicts != 0 {
+		return schedule, ErrShowtimeConflict
+	}
+	schedule.Created = true
+	return schedule, nil
+}
+
+// clearRolledBackIDs zeroes the IDs of the showtimes rolled back with the schedule,
+// a conflict with an earlier showtime of the same schedule included
+func clearRolledBackIDs(schedule *BulkSchedule) {
+	rolledBack := make(map[uint]bool)
+	for i := range schedule.Showtimes {
+		if id := schedule.Showtimes[i].ShowtimeID; id != 0 {
+			rolledBack[id] = true
+		}
+		schedule.Showtimes[i].ShowtimeID = 0
+	}
+	for i := range schedule.Showtimes {
+		for j := range schedule.Showtimes[i].Conflicts {
+			if conflict := &schedule.Showtimes[i].Conflicts[j]; rolledBack[conflict.ShowtimeID] {
+				conflict.ShowtimeID = 0
+			}
+		}
+	}
+}
@@ -2,90 +2,327 @@ package service
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
 
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
 	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/notify"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
 )
 
 type ShowtimeService interface {
-	CreateShowtime(movieID uint, startTime time.Time, hallID uint) error
-	UpdateShowtime(showtimeID uint, startTime time.Time, hallID uint) error
+	CreateShowtime(movieID uint, startTime time.Time, hallID uint, basePrice int64) error
+	// ScheduleShowtimes creates every showtime of the rule in one transaction, nothing is created if any of them
+	// has a conflict. On conflicts the returned schedule lists them along with ErrShowtimeConflict.
+	// A dry run only reports what would be created.
+	ScheduleShowtimes(rule *RecurrenceRule, dryRun bool) (*BulkSchedule, error)
+	// UpdateShowtime reschedules the showtime in place, a zero startTime or hallID keeps the current one.
+	// Moving to another hall moves the bookings onto the seats at the same row and col,
+	// the bookings without such seat are cancelled and fully refunded. Affected users are notified.
+	UpdateShowtime(showtimeID uint, startTime time.Time, hallID uint) (*ShowtimeUpdate, error)
 	DeleteShowtimeByID(showtimeID uint) error
 	GetShowtimeByID(showtimeID uint) (*model.Showtime, error)
 	GetShowtimesByMovieID(movieID uint) ([]model.Showtime, error)
 	GetShowtimesByMovieIDTx(tx *gorm.DB, movieID uint) ([]model.Showtime, error)
 	GetShowtimesByHallID(hallID uint) ([]model.Showtime, error)
 	GetShowtimesByHallIDTx(tx *gorm.DB, hallID uint) ([]model.Showtime, error)
+	GetUpcomingShowtimesByHallIDTx(tx *gorm.DB, hallID uint, now time.Time) ([]model.Showtime, error)
+	// SetShowtimeSeatBlocked blocks or unblocks one seat of the showtime
+	SetShowtimeSeatBlocked(showtimeID, seatID uint, blocked bool) error
 	GetAllShowtimes() ([]model.Showtime, error)
+	// GetSeatMap returns the status of every seat of the showtime laid out as the hall grid
+	GetSeatMap(showtimeID uint) (*SeatMap, error)
+	// RecommendSeats returns the best count available seats of the showtime without holding them,
+	// ErrNoTicketsAvailable when fewer seats are available
+	RecommendSeats(showtimeID uint, count int) (*SeatRecommendation, error)
 }
 
 type showtimeService struct {
 	db                  *gorm.DB
 	repo                repository.ShowtimeRepo
+	hallRepo            repository.HallRepo
+	movieRepo           repository.MovieRepo
+	reservationRepo     repository.ReservationRepo
 	showtimeSeatService ShowtimeSeatService
+	orderService        OrderService
+	notificationService NotificationService
+	cleaningBuffer      time.Duration
+	bus                 *event.Bus
 }
 
 var _ ShowtimeService = (*showtimeService)(nil)
 
-func NewShowtimeService(db *gorm.DB, showtimeRepo repository.ShowtimeRepo, showtimeSeatService ShowtimeSeatService) *showtimeService {
+func NewShowtimeService(db *gorm.DB, showtimeRepo repository.ShowtimeRepo, hallRepo repository.HallRepo,
+	movieRepo repository.MovieRepo, reservationRepo repository.ReservationRepo, showtimeSeatService ShowtimeSeatService,
+	orderService OrderService, notificationService NotificationService, cleaningBuffer time.Duration,
+	bus *event.Bus) *showtimeService {
 	return &showtimeService{
 		db:                  db,
 		repo:                showtimeRepo,
+		hallRepo:            hallRepo,
+		movieRepo:           movieRepo,
+		reservationRepo:     reservationRepo,
 		showtimeSeatService: showtimeSeatService,
+		orderService:        orderService,
+		notificationService: notificationService,
+		cleaningBuffer:      cleaningBuffer,
+		bus:                 bus,
 	}
 }
 
-func (s *showtimeService) CreateShowtime(movieID uint, startTime time.Time, hallID uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		showtime := &model.Showtime{
-			MovieID: uint(movieID),
-			StartAt: startTime,
-			HallID:  uint(hallID),
+// error for showtime scheduling
+var (
+	ErrShowtimeConflict    = errors.New("the hall is already used by another showtime at that time")
+	ErrMovieRuntimeMissing = errors.New("the movie runtime is not set")
+)
+
+// ShowtimeConflictError lists the showtimes clashing with the one being scheduled,
+// errors.Is(err, ErrShowtimeConflict) reports true for it
+type ShowtimeConflictError struct {
+	Conflicts []model.Showtime
+}
+
+func (e *ShowtimeConflictError) Error() string {
+	return fmt.Sprintf("%s: %d clashing showtimes", ErrShowtimeConflict, len(e.Conflicts))
+}
+
+func (e *ShowtimeConflictError) Is(target error) bool {
+	return target == ErrShowtimeConflict
+}
+
+// scheduleTx returns when a showtime of the movie starting at startAt in the hall ends,
+// or a *ShowtimeConflictError if the hall is taken by another showtime than showtimeID during that time.
+// The hall row stays locked until tx ends, so two showtimes can't be scheduled into the same slot concurrently.
+func (s *showtimeService) scheduleTx(tx *gorm.DB, showtimeID, movieID, hallID uint, startAt time.Time) (time.Time, error) {
+	if _, err := s.hallRepo.WithTx(tx).GetByIDForUpdate(hallID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, ErrNotFound
 		}
-		if err := s.repo.WithTx(tx).Create(showtime); err != nil {
-			return err
+		return time.Time{}, err
+	}
+	movie, err := s.movieRepo.WithTx(tx).GetByID(movieID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, ErrNotFound
 		}
+		return time.Time{}, err
+	}
+	if movie.RuntimeMinutes <= 0 {
+		return time.Time{}, ErrMovieRuntimeMissing
+	}
 
-		return s.showtimeSeatService.InitShowtimeSeatsForShowtimeTx(tx, showtime)
+	endAt := startAt.Add(time.Duration(movie.RuntimeMinutes)*time.Minute + s.cleaningBuffer)
+	conflicts, err := s.repo.WithTx(tx).GetOverlappingInHall(hallID, startAt, endAt, showtimeID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(conflicts) != 0 {
+		return time.Time{}, &ShowtimeConflictError{Conflicts: conflicts}
+	}
+	return endAt, nil
+}
+
+func (s *showtimeService) CreateShowtime(movieID uint, startTime time.Time, hallID uint, basePrice int64) error {
+	if basePrice < 0 {
+		return ErrInvalidPrice
+	}
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		_, err := s.createShowtimeTx(tx, movieID, startTime, hallID, basePrice)
+		return err
 	})
 }
 
-func (s *showtimeService) UpdateShowtime(showtimeID uint, startTime time.Time, hallID uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		// Ensure no related ShowtimeSeat
-		relatedShowtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsByShowtimeIDTx(tx, showtimeID)
+func (s *showtimeService) createShowtimeTx(tx *gorm.DB, movieID uint, startTime time.Time, hallID uint, basePrice int64) (*model.Showtime, error) {
+	endAt, err := s.scheduleTx(tx, 0, movieID, hallID, startTime)
+	if err != nil {
+		return nil, err
+	}
+	showtime := &model.Showtime{
+		MovieID:   uint(movieID),
+		StartAt:   startTime,
+		EndAt:     endAt,
+		HallID:    uint(hallID),
+		BasePrice: basePrice,
+	}
+	if err := s.repo.WithTx(tx).Create(showtime); err != nil {
+		return nil, err
+	}
+	if err := s.showtimeSeatService.InitShowtimeSeatsForShowtimeTx(tx, showtime); err != nil {
+		return nil, err
+	}
+	return showtime, nil
+}
+
+// ShowtimeUpdate reports what rescheduling a showtime did to its bookings
+type ShowtimeUpdate struct {
+	Showtime ShowtimeSlot `json:"showtime"`
+	// MovedSeats are the reservations moved onto the seat at the same row and col of the new hall
+	MovedSeats []RemappedReservation `json:"moved_seats,omitempty"`
+	// UnmappedSeats are the reservations cancelled and fully refunded because the new hall has no such seat
+	UnmappedSeats []RemappedReservation `json:"unmapped_seats,omitempty"`
+}
+
+type RemappedReservation struct {
+	ReservationID uint `json:"reservation_id"`
+	UserID        uint `json:"user_id"`
+	FromSeatID    uint `json:"from_seat_id"`
+	ToSeatID      uint `json:"to_seat_id,omitempty"`
+	Row           int  `json:"row"`
+	Col           int  `json:"col"`
+}
+
+func (s *showtimeService) UpdateShowtime(showtimeID uint, startTime time.Time, hallID uint) (*ShowtimeUpdate, error) {
+	var update *ShowtimeUpdate
+	var notifications []notify.Notification
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		showtime, err := s.repo.WithTx(tx).GetByIDForUpdate(showtimeID)
 		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
 			return err
 		}
-		if len(relatedShowtimeSeats) != 0 {
-			return ErrRelatedResourceExists
+		if !time.Now().Before(showtime.StartAt) {
+			return ErrShowtimeStarted
 		}
 
-		showtime, err := s.repo.WithTx(tx).GetByID(uint(showtimeID))
+		oldStartAt, oldHallID := showtime.StartAt, showtime.HallID
+		// only the provided fields are changed
+		if !startTime.IsZero() {
+			showtime.StartAt = startTime
+		}
+		if hallID != 0 {
+			showtime.HallID = hallID
+		}
+		showtime.EndAt, err = s.scheduleTx(tx, showtime.ID, showtime.MovieID, showtime.HallID, showtime.StartAt)
+		if err != nil {
+			return err
+		}
+		if err := s.repo.WithTx(tx).Update(showtime); err != nil {
+			return err
+		}
+		update = &ShowtimeUpdate{Showtime: NewShowtimeSlot(showtime)}
+
+		if showtime.HallID != oldHallID {
+			if err := s.moveReservationsTx(tx, showtime, update); err != nil {
+				return err
+			}
+			for _, moved := range update.MovedSeats {
+				notifications = append(notifications, notify.Notification{
+					UserID:  moved.UserID,
+					Subject: "Your seat has changed",
+					Body: fmt.Sprintf("Showtime %d moved to another hall, reservation %d is now at row %d, seat %d.",
+						showtime.ID, moved.ReservationID, moved.Row, moved.Col),
+				})
+			}
+			for _, unmapped := range update.UnmappedSeats {
+				notifications = append(notifications, notify.Notification{
+					UserID:  unmapped.UserID,
+					Subject: "Your reservation was cancelled",
+					Body: fmt.Sprintf("Showtime %d moved to a hall without your seat, reservation %d was cancelled and fully refunded.",
+						showtime.ID, unmapped.ReservationID),
+				})
+			}
+		}
+
+		if !showtime.StartAt.Equal(oldStartAt) {
+			reservations, err := s.reservationRepo.WithTx(tx).GetActiveByShowtimeID(showtime.ID)
+			if err != nil {
+				return err
+			}
+			notified := make(map[uint]bool)
+			for _, reservation := range reservations {
+				if notified[reservation.UserID] {
+					continue
+				}
+				notified[reservation.UserID] = true
+				notifications = append(notifications, notify.Notification{
+					UserID:  reservation.UserID,
+					Subject: "Your showtime was rescheduled",
+					Body:    fmt.Sprintf("Showtime %d now starts at %s.", showtime.ID, showtime.StartAt.Format(time.RFC1123)),
+				})
+			}
+		}
+
+		for _, notification := range notifications {
+			if err := s.notificationService.EnqueueTx(tx, notification); err != nil {
+				return err
+			}
+		}
+		if showtime.HallID != oldHallID || !showtime.StartAt.Equal(oldStartAt) {
+			s.bus.Record(tx, event.ShowtimeRescheduled{
+				ShowtimeID: showtime.ID,
+				OldHallID:  oldHallID,
+				HallID:     showtime.HallID,
+				OldStartAt: oldStartAt,
+				StartAt:    showtime.StartAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// moveReservationsTx moves the active reservations of the showtime along with their seats into its new hall
+func (s *showtimeService) moveReservationsTx(tx *gorm.DB, showtime *model.Showtime, update *ShowtimeUpdate) error {
+	remaps, err := s.showtimeSeatService.RemapShowtimeSeatsTx(tx, showtime.ID, showtime.HallID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, remap := range remaps {
+		reservation, err := s.reservationRepo.WithTx(tx).GetActiveByShowtimeIDSeatID(showtime.ID, remap.FromSeatID)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return ErrNotFound
+				continue
 			}
 			return err
 		}
-		if err := s.repo.WithTx(tx).DeleteByID(uint(showtimeID)); err != nil {
+		remapped := RemappedReservation{
+			ReservationID: reservation.ID,
+			UserID:        reservation.UserID,
+			FromSeatID:    remap.FromSeatID,
+			ToSeatID:      remap.ToSeatID,
+			Row:           remap.Row,
+			Col:           remap.Col,
+		}
+		if remap.ToSeatID != 0 {
+			if err := s.reservationRepo.WithTx(tx).UpdateSeatID(reservation.ID, remap.ToSeatID); err != nil {
+				return err
+			}
+			update.MovedSeats = append(update.MovedSeats, remapped)
+			continue
+		}
+
+		// the seat is gone with the old hall, it is not the user's fault so everything is refunded
+		reservation.Status = model.ReservationCancelled
+		reservation.CancelledAt = &now
+		if err := s.reservationRepo.WithTx(tx).Update(reservation); err != nil {
 			return err
 		}
-		showtime.ID = uint(showtimeID)
-		showtime.StartAt = startTime
-		showtime.HallID = uint(hallID)
-		if err := s.repo.WithTx(tx).Create(showtime); err != nil {
+		if _, err := s.orderService.RefundReservationTx(tx, reservation, 100); err != nil {
 			return err
 		}
-		return nil
-	})
+		s.bus.Record(tx, event.ReservationCancelled{
+			ReservationID: reservation.ID,
+			UserID:        reservation.UserID,
+			ShowtimeID:    showtime.ID,
+			SeatID:        remap.FromSeatID,
+			RefundPercent: 100,
+		})
+		update.UnmappedSeats = append(update.UnmappedSeats, remapped)
+	}
+	return nil
 }
 
 func (s *showtimeService) DeleteShowtimeByID(showtimeID uint) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		// Ensure no related ShowtimeSeat
 		relatedShowtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsByShowtimeIDTx(tx, showtimeID)
 		if err != nil {
@@ -124,6 +361,82 @@ func (s *showtimeService) GetShowtimesByHallIDTx(tx *gorm.DB, hallID uint) ([]mo
 	return s.repo.WithTx(tx).GetByHallID(hallID)
 }
 
+func (s *showtimeService) GetUpcomingShowtimesByHallIDTx(tx *gorm.DB, hallID uint, now time.Time) ([]model.Showtime, error) {
+	return s.repo.WithTx(tx).GetUpcomingByHallID(hallID, now)
+}
+
+func (s *showtimeService) SetShowtimeSeatBlocked(showtimeID, seatID uint, blocked bool) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		showtimeSeat, err := s.showtimeSeatService.GetShowtimeSeatByShowtimeIDSeatIDTx(tx, showtimeID, seatID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if !blocked {
+			return s.showtimeSeatService.UnblockShowtimeSeatTx(tx, showtimeSeat.ID)
+		}
+		// blocking a seat twice is a no-op
+		err = s.showtimeSeatService.BlockShowtimeSeatTx(tx, showtimeSeat.ID)
+		if errors.Is(err, ErrShowtimeSeatStatusNotChange) {
+			return nil
+		}
+		return err
+	})
+}
+
 func (s *showtimeService) GetAllShowtimes() ([]model.Showtime, error) {
 	return s.repo.ListAll()
 }
+
+func (s *showtimeService) GetSeatMap(showtimeID uint) (*SeatMap, error) {
+	showtime, err := s.repo.GetByID(showtimeID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	hall, err := s.hallRepo.GetByID(showtime.HallID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	showtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsWithSeatByShowtimeIDTx(s.db, showtimeID)
+	if err != nil {
+		return nil, err
+	}
+	return buildSeatMap(showtime, hall, showtimeSeats), nil
+}
+
+func (s *showtimeService) RecommendSeats(showtimeID uint, count int) (*SeatRecommendation, error) {
+	if count < 1 {
+		return nil, ErrInvalidSeatSelection
+	}
+	showtime, err := s.repo.GetByID(showtimeID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	hall, err := s.hallRepo.GetByID(showtime.HallID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	showtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsWithSeatByShowtimeIDTx(s.db, showtimeID)
+	if err != nil {
+		return nil, err
+	}
+	recommendation := recommendSeats(showtime, hall, showtimeSeats, count)
+	if recommendation == nil {
+		return nil, ErrNoTicketsAvailable
+	}
+	return recommendation, nil
+}
@@ -5,13 +5,15 @@ import (
 
 	"gorm.io/gorm"
 
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
 	"github.com/qs-lzh/movie-reservation/internal/model"
 	"github.com/qs-lzh/movie-reservation/internal/repository"
 	"github.com/qs-lzh/movie-reservation/internal/security"
 )
 
 type UserService interface {
-	CreateUser(userName, password string, role model.UserRole) error
+	// CreateUser registers the user, email is optional
+	CreateUser(userName, password, email string, role model.UserRole) error
 	DeleteUser(userName string, password string) error
 	ValidateUser(userName string, password string) (bool, error)
 	GetUserRoleByName(userName string) (model.UserRole, error)
@@ -23,21 +25,24 @@ type userService struct {
 	hasher             security.PasswordHasher
 	repo               repository.UserRepo
 	reservationService ReservationService
+	bus                *event.Bus
 }
 
 var _ UserService = (*userService)(nil)
 
-func NewUserService(db *gorm.DB, userRepo repository.UserRepo, reservationService ReservationService) *userService {
+func NewUserService(db *gorm.DB, userRepo repository.UserRepo, reservationService ReservationService,
+	bus *event.Bus) *userService {
 	return &userService{
 		db:                 db,
 		hasher:             security.NewBcryptHasher(10),
 		repo:               userRepo,
 		reservationService: reservationService,
+		bus:                bus,
 	}
 }
 
-func (s *userService) CreateUser(userName, password string, role model.UserRole) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
+func (s *userService) CreateUser(userName, password, email string, role model.UserRole) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
 		_, err := s.repo.WithTx(tx).GetByName(userName)
 		if err == nil {
 			return ErrAlreadyExists
@@ -49,11 +54,21 @@ func (s *userService) CreateUser(userName, password string, role model.UserRole)
 		if err != nil {
 			return err
 		}
-		return s.repo.WithTx(tx).Create(&model.User{
+		user := &model.User{
 			Name:           userName,
 			HashedPassword: hash,
 			Role:           role,
+			Email:          email,
+		}
+		if err := s.repo.WithTx(tx).Create(user); err != nil {
+			return err
+		}
+		s.bus.Record(tx, event.UserRegistered{
+			UserID:   user.ID,
+			UserName: user.Name,
+			Role:     user.Role,
 		})
+		return nil
 	})
 }
 
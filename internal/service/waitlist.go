@@ -0,0 +1,239 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/model"
+)
+
+// A waitlisted user is offered seats by holding them in a pending order of their own, so nobody else can take them.
+// The offer lapses with the order, the seats are then freed and offered to the next waiting user.
+
+func (s *reservationService) JoinWaitlist(userID, showtimeID uint, seats int) (*model.WaitlistEntry, error) {
+	if seats < 1 {
+		return nil, ErrInvalidSeatSelection
+	}
+	if seats > s.maxSeatsPerUser {
+		return nil, ErrSeatLimitExceeded
+	}
+
+	var entry *model.WaitlistEntry
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		showtime, err := s.showtimeRepo.WithTx(tx).GetByID(showtimeID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrShowtimeNotExist
+			}
+			return err
+		}
+		if !time.Now().Before(showtime.StartAt) {
+			return ErrShowtimeStarted
+		}
+
+		// the waitlist is only for showtimes that can't serve the user right now
+		remainingTickets, err := s.GetRemainingTicketsTx(tx, showtime)
+		if err != nil && !errors.Is(err, ErrNoTicketsAvailable) {
+			return err
+		}
+		if remainingTickets >= seats {
+			return ErrTicketsAvailable
+		}
+
+		if _, err := s.waitlistRepo.WithTx(tx).GetOpenByShowtimeIDUserID(showtimeID, userID); err == nil {
+			return ErrAlreadyOnWaitlist
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		entry = &model.WaitlistEntry{
+			ShowtimeID: showtimeID,
+			UserID:     userID,
+			Seats:      seats,
+			Status:     model.WaitlistWaiting,
+		}
+		return s.waitlistRepo.WithTx(tx).Create(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *reservationService) LeaveWaitlist(userID, entryID uint) error {
+	return s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		entry, err := s.waitlistRepo.WithTx(tx).GetByIDForUpdate(entryID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if entry.UserID != userID {
+			return ErrNotFound
+		}
+		// an offered entry already owns its order, the user can let it expire or cancel its reservations
+		if entry.Status != model.WaitlistWaiting {
+			return ErrWaitlistEntryNotOpen
+		}
+		entry.Status = model.WaitlistLeft
+		return s.waitlistRepo.WithTx(tx).Update(entry)
+	})
+}
+
+func (s *reservationService) GetWaitlistByUserID(userID uint) ([]model.WaitlistEntry, error) {
+	return s.waitlistRepo.GetByUserID(userID)
+}
+
+// ProcessWaitlists settles the offers in a transaction of their own, then offers each showtime in its own transaction,
+// so a failing showtime neither holds back nor rolls back the others. The errors are returned together.
+func (s *reservationService) ProcessWaitlists() (int, error) {
+	var errs []error
+	if err := s.bus.Transaction(s.db, s.settleOffersTx); err != nil {
+		errs = append(errs, fmt.Errorf("settling the waitlist offers: %w", err))
+	}
+
+	waiting, err := s.waitlistRepo.GetByStatus(model.WaitlistWaiting)
+	if err != nil {
+		return 0, errors.Join(append(errs, err)...)
+	}
+	showtimeIDs := make(map[uint]bool)
+	for _, entry := range waiting {
+		showtimeIDs[entry.ShowtimeID] = true
+	}
+	var offered int
+	for showtimeID := range showtimeIDs {
+		offers, err := s.OfferWaitlist(showtimeID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("offering the waitlist of showtime %d: %w", showtimeID, err))
+			continue
+		}
+		offered += offers
+	}
+	return offered, errors.Join(errs...)
+}
+
+func (s *reservationService) OfferWaitlist(showtimeID uint) (int, error) {
+	var offered int
+	err := s.bus.Transaction(s.db, func(tx *gorm.DB) error {
+		showtime, err := s.showtimeRepo.WithTx(tx).GetByID(showtimeID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrShowtimeNotExist
+			}
+			return err
+		}
+		offered, err = s.offerWaitlistTx(tx, showtime)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return offered, nil
+}
+
+// settleOffersTx marks the offers whose order was paid as accepted and the ones whose order is gone as expired
+func (s *reservationService) settleOffersTx(tx *gorm.DB) error {
+	offered, err := s.waitlistRepo.WithTx(tx).GetByStatus(model.WaitlistOffered)
+	if err != nil {
+		return err
+	}
+	for _, entry := range offered {
+		if entry.OrderID == nil {
+			continue
+		}
+		order, err := s.orderRepo.WithTx(tx).GetByID(*entry.OrderID)
+		if err != nil {
+			return err
+		}
+		switch order.Status {
+		case model.OrderPending:
+			continue
+		case model.OrderPaid, model.OrderRefunding, model.OrderRefunded:
+			entry.Status = model.WaitlistAccepted
+		default:
+			entry.Status = model.WaitlistExpired
+		}
+		if err := s.waitlistRepo.WithTx(tx).Update(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offerWaitlistTx holds the free seats of the showtime for its waiting users, first come first served.
+// It stops at the first user whose seats can't be offered, so nobody jumps the queue,
+// and it expires every waiting entry once the showtime has started. It returns how many offers were made.
+func (s *reservationService) offerWaitlistTx(tx *gorm.DB, showtime *model.Showtime) (int, error) {
+	var offered int
+	started := !time.Now().Before(showtime.StartAt)
+	for {
+		entry, err := s.waitlistRepo.WithTx(tx).GetFirstWaitingForUpdate(showtime.ID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return offered, nil
+			}
+			return 0, err
+		}
+		if started {
+			entry.Status = model.WaitlistExpired
+			if err := s.waitlistRepo.WithTx(tx).Update(entry); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		// a sold-out showtime is skipped before locking its seats, most waitlisted showtimes are
+		remainingTickets, err := s.GetRemainingTicketsTx(tx, showtime)
+		if err != nil && !errors.Is(err, ErrNoTicketsAvailable) {
+			return 0, err
+		}
+		if remainingTickets < entry.Seats {
+			return offered, nil
+		}
+
+		hall, err := s.hallRepo.WithTx(tx).GetByID(showtime.HallID)
+		if err != nil {
+			return 0, err
+		}
+		showtimeSeats, err := s.showtimeSeatService.GetShowtimeSeatsWithSeatByShowtimeIDForUpdateTx(tx, showtime.ID)
+		if err != nil {
+			return 0, err
+		}
+		recommendation := recommendSeats(showtime, hall, showtimeSeats, entry.Seats)
+		if recommendation == nil {
+			return offered, nil
+		}
+		hold, err := s.holdSeatsTx(tx, entry.UserID, showtime, recommendation.seatIDs(), s.offerTTL)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrSeatLimitExceeded):
+			// the user booked other seats meanwhile, the entry is skipped
+			entry.Status = model.WaitlistExpired
+			if err := s.waitlistRepo.WithTx(tx).Update(entry); err != nil {
+				return 0, err
+			}
+			continue
+		case errors.Is(err, ErrNoTicketsAvailable), errors.Is(err, ErrOrphanSeat):
+			return offered, nil
+		default:
+			return 0, err
+		}
+
+		entry.Status = model.WaitlistOffered
+		entry.OrderID = &hold.OrderID
+		entry.OfferExpiresAt = &hold.ExpiresAt
+		if err := s.waitlistRepo.WithTx(tx).Update(entry); err != nil {
+			return 0, err
+		}
+		notification := holdNotification(entry.UserID, showtime, hold)
+		notification.Subject = "Seats available from the waitlist"
+		if err := s.notificationService.EnqueueTx(tx, notification); err != nil {
+			return 0, err
+		}
+		offered++
+	}
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+	"github.com/qs-lzh/movie-reservation/internal/webhook"
+)
+
+// WebhookEventTypes are the events partners can subscribe to
+var WebhookEventTypes = []string{
+	event.ReservationCreated{}.Name(),
+	event.ReservationCancelled{}.Name(),
+	event.ShowtimeRescheduled{}.Name(),
+}
+
+type WebhookService interface {
+	// CreateEndpoint subscribes the URL to the event types, a secret is generated when secret is empty.
+	// The returned subscription is the only one carrying the secret.
+	CreateEndpoint(url string, eventTypes []string, secret string) (*WebhookSubscription, error)
+	GetEndpoints() ([]WebhookSubscription, error)
+	// UpdateEndpoint only changes the provided fields, enabling a disabled endpoint resets its failures
+	UpdateEndpoint(id uint, url string, eventTypes []string, active *bool) (*WebhookSubscription, error)
+	DeleteEndpoint(id uint) error
+	// GetDeliveries returns the latest deliveries of the endpoint, newest first
+	GetDeliveries(endpointID uint) ([]model.WebhookDelivery, error)
+	// ReplayDelivery sends the event of the delivery again as a new delivery
+	ReplayDelivery(deliveryID uint) (*model.WebhookDelivery, error)
+	// EnqueueEventTx creates in tx a delivery of the event for every active endpoint subscribed to it,
+	// it subscribes to the event bus in the transaction recording the event so no event is lost
+	EnqueueEventTx(tx *gorm.DB, e event.Event) error
+	// DeliverDue sends the due deliveries and returns how many succeeded, failed deliveries are retried
+	// with an exponential backoff and an endpoint failing too many times in a row is disabled
+	DeliverDue() (int, error)
+}
+
+// WebhookSubscription is what admins see of an endpoint
+type WebhookSubscription struct {
+	ID         uint     `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	// Secret is only set when the endpoint is created
+	Secret              string     `json:"secret,omitempty"`
+	Active              bool       `json:"active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+func newWebhookSubscription(endpoint *model.WebhookEndpoint) WebhookSubscription {
+	return WebhookSubscription{
+		ID:                  endpoint.ID,
+		URL:                 endpoint.URL,
+		EventTypes:          strings.Split(endpoint.EventTypes, ","),
+		Active:              endpoint.Active,
+		ConsecutiveFailures: endpoint.ConsecutiveFailures,
+		DisabledAt:          endpoint.DisabledAt,
+		CreatedAt:           endpoint.CreatedAt,
+	}
+}
+
+// webhookPayload is the body posted to the endpoints
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      event.Event `json:"data"`
+}
+
+type webhookService struct {
+	db           *gorm.DB
+	endpointRepo repository.WebhookEndpointRepo
+	deliveryRepo repository.WebhookDeliveryRepo
+	sender       *webhook.Sender
+	maxAttempts  int
+	retryBackoff time.Duration
+	// disableAfter is how many failed attempts in a row disable an endpoint
+	disableAfter int
+}
+
+var _ WebhookService = (*webhookService)(nil)
+
+func NewWebhookService(db *gorm.DB, endpointRepo repository.WebhookEndpointRepo, deliveryRepo repository.WebhookDeliveryRepo,
+	sender *webhook.Sender, maxAttempts int, retryBackoff time.Duration, disableAfter int) *webhookService {
+	return &webhookService{
+		db:           db,
+		endpointRepo: endpointRepo,
+		deliveryRepo: deliveryRepo,
+		sender:       sender,
+		maxAttempts:  maxAttempts,
+		retryBackoff: retryBackoff,
+		disableAfter: disableAfter,
+	}
+}
+
+const (
+	// webhookBatchSize caps how many deliveries one DeliverDue call sends
+	webhookBatchSize = 100
+	// webhookDeliveryLogSize caps how many deliveries GetDeliveries returns
+	webhookDeliveryLogSize = 100
+	// webhookClaimLease is how long a claimed delivery is left to the worker sending its batch
+	// before another run may send it again
+	webhookClaimLease = webhookBatchSize * deliveryTimeout
+)
+
+func (s *webhookService) CreateEndpoint(url string, eventTypes []string, secret string) (*WebhookSubscription, error) {
+	if err := validateWebhookURL(url); err != nil {
+		return nil, err
+	}
+	if err := validateWebhookEventTypes(eventTypes); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		var err error
+		if secret, err = randomHex(32); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := &model.WebhookEndpoint{
+		URL:        url,
+		Secret:     secret,
+		EventTypes: strings.Join(eventTypes, ","),
+		Active:     true,
+	}
+	if err := s.endpointRepo.Create(endpoint); err != nil {
+		return nil, err
+	}
+	subscription := newWebhookSubscription(endpoint)
+	subscription.Secret = secret
+	return &subscription, nil
+}
+
+func (s *webhookService) GetEndpoints() ([]WebhookSubscription, error) {
+	endpoints, err := s.endpointRepo.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := make([]WebhookSubscription, 0, len(endpoints))
+	for i := range endpoints {
+		subscriptions = append(subscriptions, newWebhookSubscription(&endpoints[i]))
+	}
+	return subscriptions, nil
+}
+
+func (s *webhookService) UpdateEndpoint(id uint, url string, eventTypes []string, active *bool) (*WebhookSubscription, error) {
+	if url != "" {
+		if err := validateWebhookURL(url); err != nil {
+			return nil, err
+		}
+	}
+	if eventTypes != nil {
+		if err := validateWebhookEventTypes(eventTypes); err != nil {
+			return nil, err
+		}
+	}
+
+	var endpoint *model.WebhookEndpoint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		endpoint, err = s.endpointRepo.WithTx(tx).GetByIDForUpdate(id)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if url != "" {
+			endpoint.URL = url
+		}
+		if eventTypes != nil {
+			endpoint.EventTypes = strings.Join(eventTypes, ",")
+		}
+		if active != nil && *active != endpoint.Active {
+			endpoint.Active = *active
+			if endpoint.Active {
+				endpoint.ConsecutiveFailures = 0
+				endpoint.DisabledAt = nil
+			} else {
+				now := time.Now()
+				endpoint.DisabledAt = &now
+			}
+		}
+		return s.endpointRepo.WithTx(tx).Update(endpoint)
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscription := newWebhookSubscription(endpoint)
+	return &subscription, nil
+}
+
+func (s *webhookService) DeleteEndpoint(id uint) error {
+	if _, err := s.endpointRepo.GetByID(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return s.endpointRepo.DeleteByID(id)
+}
+
+func (s *webhookService) GetDeliveries(endpointID uint) ([]model.WebhookDelivery, error) {
+	if _, err := s.endpointRepo.GetByID(endpointID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return s.deliveryRepo.GetByEndpointID(endpointID, webhookDeliveryLogSize)
+}
+
+// ReplayDelivery keeps the event ID of the original delivery, so receivers that already processed it can ignore it
+func (s *webhookService) ReplayDelivery(deliveryID uint) (*model.WebhookDelivery, error) {
+	original, err := s.deliveryRepo.GetByID(deliveryID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	replay := &model.WebhookDelivery{
+		EndpointID:    original.EndpointID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        model.WebhookDeliveryPending,
+		NextAttemptAt: time.Now(),
+		ReplayOf:      &original.ID,
+	}
+	if err := s.deliveryRepo.Create(replay); err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+func (s *webhookService) EnqueueEventTx(tx *gorm.DB, e event.Event) error {
+	if !slices.Contains(WebhookEventTypes, e.Name()) {
+		return nil
+	}
+	eventID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	payload, err := json.Marshal(webhookPayload{
+		ID:        eventID,
+		Type:      e.Name(),
+		CreatedAt: now,
+		Data:      e,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := s.endpointRepo.WithTx(tx).ListActive()
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if !slices.Contains(strings.Split(endpoint.EventTypes, ","), e.Name()) {
+			continue
+		}
+		if err := s.deliveryRepo.WithTx(tx).Create(&model.WebhookDelivery{
+			EndpointID:    endpoint.ID,
+			EventID:       eventID,
+			EventType:     e.Name(),
+			Payload:       string(payload),
+			Status:        model.WebhookDeliveryPending,
+			NextAttemptAt: now,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeliverDue claims the due deliveries in a short transaction like the notification outbox, then sends them
+// without holding any lock and records every result and the health of its endpoint on its own.
+// An event can be sent twice if the process dies between sending and recording, but it is never lost.
+func (s *webhookService) DeliverDue() (int, error) {
+	var deliveries []model.WebhookDelivery
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		var err error
+		deliveries, err = s.deliveryRepo.WithTx(tx).GetDueForUpdate(now, webhookBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range deliveries {
+			deliveries[i].Attempts++
+			deliveries[i].NextAttemptAt = now.Add(webhookClaimLease)
+			if err := s.deliveryRepo.WithTx(tx).Update(&deliveries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var delivered int
+	var errs []error
+	endpoints := make(map[uint]*model.WebhookEndpoint)
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		endpoint, ok := endpoints[delivery.EndpointID]
+		if !ok {
+			endpoint, err = s.endpointRepo.GetByID(delivery.EndpointID)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			endpoints[endpoint.ID] = endpoint
+		}
+		// the endpoint was disabled earlier in the batch, its deliveries wait for it to be enabled again
+		if !endpoint.Active {
+			delivery.Attempts--
+			delivery.NextAttemptAt = time.Now()
+			if err := s.deliveryRepo.Update(delivery); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		status, sendErr := s.send(endpoint, delivery)
+		now := time.Now()
+		delivery.ResponseStatus = status
+		if sendErr != nil {
+			delivery.LastError = sendErr.Error()
+			if delivery.Attempts >= s.maxAttempts {
+				delivery.Status = model.WebhookDeliveryFailed
+			} else {
+				delivery.NextAttemptAt = now.Add(retryDelay(s.retryBackoff, delivery.Attempts))
+			}
+		} else {
+			delivery.Status = model.WebhookDeliveryDelivered
+			delivery.DeliveredAt = &now
+			delivery.LastError = ""
+			delivered++
+		}
+		if err := s.deliveryRepo.Update(delivery); err != nil {
+			errs = append(errs, err)
+		}
+		if endpoint, err = s.recordEndpointHealth(endpoint.ID, sendErr == nil, now); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		endpoints[endpoint.ID] = endpoint
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// recordEndpointHealth counts the failed attempt of the endpoint, or resets its failures after a successful one,
+// and disables it once it failed disableAfter times in a row. It returns the endpoint as written.
+func (s *webhookService) recordEndpointHealth(endpointID uint, succeeded bool, now time.Time) (*model.WebhookEndpoint, error) {
+	var endpoint *model.WebhookEndpoint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		endpoint, err = s.endpointRepo.WithTx(tx).GetByIDForUpdate(endpointID)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			endpoint.ConsecutiveFailures = 0
+		} else {
+			endpoint.ConsecutiveFailures++
+			if endpoint.Active && endpoint.ConsecutiveFailures >= s.disableAfter {
+				endpoint.Active = false
+				endpoint.DisabledAt = &now
+			}
+		}
+		return s.endpointRepo.WithTx(tx).Update(endpoint)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (s *webhookService) send(endpoint *model.WebhookEndpoint, delivery *model.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	return s.sender.Send(ctx, endpoint.URL, endpoint.Secret, webhook.Message{
+		ID:      delivery.EventID,
+		Event:   delivery.EventType,
+		Payload: []byte(delivery.Payload),
+	})
+}
+
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	return nil
+}
+
+func validateWebhookEventTypes(eventTypes []string) error {
+	if len(eventTypes) == 0 {
+		return ErrInvalidWebhookEventType
+	}
+	for _, eventType := range eventTypes {
+		if !slices.Contains(WebhookEventTypes, eventType) {
+			return ErrInvalidWebhookEventType
+		}
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
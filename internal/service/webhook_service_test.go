@@ -0,0 +1,286 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/movie-reservation/internal/app/event"
+	"github.com/qs-lzh/movie-reservation/internal/model"
+	"github.com/qs-lzh/movie-reservation/internal/repository"
+	"github.com/qs-lzh/movie-reservation/internal/webhook"
+)
+
+// fakeWebhookEndpointRepo keeps copies of the endpoints like a table would
+type fakeWebhookEndpointRepo struct {
+	repository.WebhookEndpointRepo
+	mu        sync.Mutex
+	endpoints map[uint]model.WebhookEndpoint
+}
+
+func (r *fakeWebhookEndpointRepo) WithTx(tx *gorm.DB) repository.WebhookEndpointRepo {
+	return r
+}
+
+func (r *fakeWebhookEndpointRepo) GetByID(id uint) (*model.WebhookEndpoint, error) {
+	return r.GetByIDForUpdate(id)
+}
+
+func (r *fakeWebhookEndpointRepo) GetByIDForUpdate(id uint) (*model.WebhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint, ok := r.endpoints[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &endpoint, nil
+}
+
+func (r *fakeWebhookEndpointRepo) ListActive() ([]model.WebhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var endpoints []model.WebhookEndpoint
+	for _, endpoint := range r.endpoints {
+		if endpoint.Active {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+func (r *fakeWebhookEndpointRepo) Update(endpoint *model.WebhookEndpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints[endpoint.ID] = *endpoint
+	return nil
+}
+
+func (r *fakeWebhookEndpointRepo) active(id uint) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endpoints[id].Active
+}
+
+// fakeWebhookDeliveryRepo keeps copies of the deliveries like a table would
+type fakeWebhookDeliveryRepo struct {
+	repository.WebhookDeliveryRepo
+	mu         sync.Mutex
+	endpoints  *fakeWebhookEndpointRepo
+	deliveries []model.WebhookDelivery
+}
+
+func (r *fakeWebhookDeliveryRepo) WithTx(tx *gorm.DB) repository.WebhookDeliveryRepo {
+	return r
+}
+
+func (r *fakeWebhookDeliveryRepo) Create(delivery *model.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delivery.ID = uint(len(r.deliveries) + 1)
+	r.deliveries = append(r.deliveries, *delivery)
+	return nil
+}
+
+func (r *fakeWebhookDeliveryRepo) GetDueForUpdate(now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []model.WebhookDelivery
+	for _, delivery := range r.deliveries {
+		if len(due) == limit {
+			break
+		}
+		if delivery.Status == model.WebhookDeliveryPending && !delivery.NextAttemptAt.After(now) &&
+			r.endpoints.active(delivery.EndpointID) {
+			due = append(due, delivery)
+		}
+	}
+	return due, nil
+}
+
+func (r *fakeWebhookDeliveryRepo) Update(delivery *model.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries[delivery.ID-1] = *delivery
+	return nil
+}
+
+func (r *fakeWebhookDeliveryRepo) get(id uint) model.WebhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deliveries[id-1]
+}
+
+// makeDue moves the next attempt of every pending delivery to the past
+func (r *fakeWebhookDeliveryRepo) makeDue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.deliveries {
+		r.deliveries[i].NextAttemptAt = time.Now().Add(-time.Second)
+	}
+}
+
+// webhookReceiver verifies the requests the way a partner should and answers with status
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	status   int
+	received []string
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		rc.t.Errorf("reading the webhook body: %v", err)
+	}
+	if err := webhook.Verify(rc.secret, r.Header.Get(webhook.HeaderTimestamp), r.Header.Get(webhook.HeaderSignature),
+		payload, 5*time.Minute); err != nil {
+		rc.t.Errorf("webhook.Verify() error = %v", err)
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, r.Header.Get(webhook.HeaderID))
+	w.WriteHeader(rc.status)
+}
+
+func (rc *webhookReceiver) setStatus(status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = status
+}
+
+func (rc *webhookReceiver) requests() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return slices.Clone(rc.received)
+}
+
+const testWebhookSecret = "test-secret"
+
+func newTestWebhookService(t *testing.T, status int) (*webhookService, *fakeWebhookEndpointRepo,
+	*fakeWebhookDeliveryRepo, *webhookReceiver) {
+	t.Helper()
+	receiver := &webhookReceiver{t: t, secret: testWebhookSecret, status: status}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	endpoints := &fakeWebhookEndpointRepo{endpoints: map[uint]model.WebhookEndpoint{
+		1: {ID: 1, URL: srv.URL, Secret: testWebhookSecret, EventTypes: "reservation.created", Active: true},
+	}}
+	deliveries := &fakeWebhookDeliveryRepo{endpoints: endpoints}
+	s := NewWebhookService(newFakeDB(t), endpoints, deliveries, webhook.NewSender(srv.Client()), 5, time.Minute, 3)
+	return s, endpoints, deliveries, receiver
+}
+
+func TestWebhookServiceDeliversSignedEvents(t *testing.T) {
+	s, _, deliveries, receiver := newTestWebhookService(t, http.StatusOK)
+
+	if err := s.EnqueueEventTx(s.db, event.ReservationCreated{OrderID: 7}); err != nil {
+		t.Fatalf("EnqueueEventTx() error = %v", err)
+	}
+	// the endpoint isn't subscribed to it
+	if err := s.EnqueueEventTx(s.db, event.ShowtimeRescheduled{ShowtimeID: 3}); err != nil {
+		t.Fatalf("EnqueueEventTx() error = %v", err)
+	}
+
+	delivered, err := s.DeliverDue()
+	if err != nil {
+		t.Fatalf("DeliverDue() error = %v", err)
+	}
+	if delivered != 1 {
+		t.Fatalf("DeliverDue() = %d, want 1", delivered)
+	}
+	delivery := deliveries.get(1)
+	if delivery.Status != model.WebhookDeliveryDelivered || delivery.ResponseStatus != http.StatusOK {
+		t.Errorf("delivery status = %s (%d), want delivered (200)", delivery.Status, delivery.ResponseStatus)
+	}
+	if got := receiver.requests(); !slices.Equal(got, []string{delivery.EventID}) {
+		t.Errorf("received event IDs = %q, want [%q]", got, delivery.EventID)
+	}
+}
+
+func TestWebhookServiceRetriesWithBackoff(t *testing.T) {
+	s, endpoints, deliveries, receiver := newTestWebhookService(t, http.StatusInternalServerError)
+	if err := s.EnqueueEventTx(s.db, event.ReservationCreated{OrderID: 7}); err != nil {
+		t.Fatalf("EnqueueEventTx() error = %v", err)
+	}
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		deliveries.makeDue()
+		before := time.Now()
+		delivered, err := s.DeliverDue()
+		if err != nil {
+			t.Fatalf("DeliverDue() error = %v", err)
+		}
+		if delivered != 0 {
+			t.Fatalf("DeliverDue() = %d, want 0", delivered)
+		}
+		delivery := deliveries.get(1)
+		if delivery.Status != model.WebhookDeliveryPending || delivery.Attempts != attempt+1 {
+			t.Fatalf("delivery = %s after %d attempts, want pending after %d", delivery.Status, delivery.Attempts, attempt+1)
+		}
+		if delivery.ResponseStatus != http.StatusInternalServerError || delivery.LastError == "" {
+			t.Errorf("the failed response isn't logged: %d %q", delivery.ResponseStatus, delivery.LastError)
+		}
+		if delay := delivery.NextAttemptAt.Sub(before); delay < backoff || delay > backoff+time.Minute/2 {
+			t.Errorf("attempt %d is retried after %s, want %s", attempt+1, delay, backoff)
+		}
+		// not due yet
+		if delivered, _ := s.DeliverDue(); delivered != 0 || deliveries.get(1).Attempts != attempt+1 {
+			t.Fatalf("the delivery was retried before its backoff")
+		}
+	}
+
+	receiver.setStatus(http.StatusNoContent)
+	deliveries.makeDue()
+	if delivered, err := s.DeliverDue(); err != nil || delivered != 1 {
+		t.Fatalf("DeliverDue() = %d, %v, want 1", delivered, err)
+	}
+	if got := len(receiver.requests()); got != 3 {
+		t.Errorf("the receiver got %d requests, want 3", got)
+	}
+	if endpoint, _ := endpoints.GetByIDForUpdate(1); endpoint.ConsecutiveFailures != 0 {
+		t.Errorf("ConsecutiveFailures = %d after a success, want 0", endpoint.ConsecutiveFailures)
+	}
+}
+
+func TestWebhookServiceDisablesFailingEndpoints(t *testing.T) {
+	s, endpoints, deliveries, receiver := newTestWebhookService(t, http.StatusBadGateway)
+	for orderID := uint(1); orderID <= 4; orderID++ {
+		if err := s.EnqueueEventTx(s.db, event.ReservationCreated{OrderID: orderID}); err != nil {
+			t.Fatalf("EnqueueEventTx() error = %v", err)
+		}
+	}
+
+	if _, err := s.DeliverDue(); err != nil {
+		t.Fatalf("DeliverDue() error = %v", err)
+	}
+	endpoint, _ := endpoints.GetByIDForUpdate(1)
+	if endpoint.Active || endpoint.DisabledAt == nil {
+		t.Fatalf("the endpoint is still active after %d failures", endpoint.ConsecutiveFailures)
+	}
+	if endpoint.ConsecutiveFailures != 3 {
+		t.Errorf("ConsecutiveFailures = %d, want 3", endpoint.ConsecutiveFailures)
+	}
+	if got := len(receiver.requests()); got != 3 {
+		t.Errorf("the receiver got %d requests, want 3", got)
+	}
+	// the delivery after the third failure waits for the endpoint to be enabled again
+	if delivery := deliveries.get(4); delivery.Attempts != 0 || delivery.Status != model.WebhookDeliveryPending {
+		t.Errorf("delivery 4 = %s after %d attempts, want pending and untried", delivery.Status, delivery.Attempts)
+	}
+
+	deliveries.makeDue()
+	if delivered, err := s.DeliverDue(); err != nil || delivered != 0 {
+		t.Fatalf("DeliverDue() = %d, %v, want 0", delivered, err)
+	}
+	if got := len(receiver.requests()); got != 3 {
+		t.Errorf("a disabled endpoint got %d requests, want 3", got)
+	}
+}